@@ -0,0 +1,35 @@
+package libcore
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// The options set by the exported setters are read by concurrent dials, the booleans and
+// durations among them are accessed with these helpers.
+
+func loadBool(addr *uint32) bool {
+	return atomic.LoadUint32(addr) != 0
+}
+
+func storeBool(addr *uint32, value bool) {
+	var v uint32
+	if value {
+		v = 1
+	}
+	atomic.StoreUint32(addr, v)
+}
+
+func loadDuration(addr *time.Duration) time.Duration {
+	return time.Duration(atomic.LoadInt64((*int64)(addr)))
+}
+
+func storeDuration(addr *time.Duration, value time.Duration) {
+	atomic.StoreInt64((*int64)(addr), int64(value))
+}
+
+// loadString returns the string stored in v, empty if none.
+func loadString(v *atomic.Value) string {
+	s, _ := v.Load().(string)
+	return s
+}
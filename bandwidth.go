@@ -0,0 +1,203 @@
+package libcore
+
+import (
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxBandwidthBurst bounds the burst of fast limiters.
+const maxBandwidthBurst = 1 << 20
+
+var uplinkLimit, downlinkLimit int64
+
+// SetBandwidthLimit throttles each protected connection created afterwards to upload and
+// download bytes per second, to test the behavior of apps on slow links. 0 disables a
+// direction.
+func SetBandwidthLimit(upload int64, download int64) error {
+	if upload < 0 || download < 0 {
+		return newError("invalid bandwidth limit ", upload, "/", download)
+	}
+	atomic.StoreInt64(&uplinkLimit, upload)
+	atomic.StoreInt64(&downlinkLimit, download)
+	return nil
+}
+
+// bandwidthLimiter is a token bucket holding up to a tenth of a second of traffic. IO waits until
+// the bucket is not in debt and then takes what it transferred, so it never waits with data
+// in hand and any size fits.
+type bandwidthLimiter struct {
+	access   sync.Mutex
+	rate     float64
+	burst    int
+	tokens   float64
+	last     time.Time
+	deadline time.Time
+}
+
+// newBandwidthLimiter returns a limiter to rate bytes per second, nil if rate is 0.
+func newBandwidthLimiter(rate int64) *bandwidthLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	burst := rate / 10
+	if burst < 1 {
+		burst = 1
+	} else if burst > maxBandwidthBurst {
+		burst = maxBandwidthBurst
+	}
+	return &bandwidthLimiter{
+		rate:   float64(rate),
+		burst:  int(burst),
+		tokens: float64(burst),
+		last:   clk.Now(),
+	}
+}
+
+// setDeadline makes wait fail after deadline, l may be nil.
+func (l *bandwidthLimiter) setDeadline(deadline time.Time) {
+	if l == nil {
+		return
+	}
+	l.access.Lock()
+	l.deadline = deadline
+	l.access.Unlock()
+}
+
+// refill adds the tokens earned since the last call, access must be held.
+func (l *bandwidthLimiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+	l.last = now
+}
+
+// wait blocks until the bucket is not in debt, failing once the deadline passes or done is
+// closed.
+func (l *bandwidthLimiter) wait(done <-chan struct{}) error {
+	for {
+		now := clk.Now()
+		l.access.Lock()
+		l.refill(now)
+		delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+		deadline := l.deadline
+		l.access.Unlock()
+		if delay <= 0 {
+			return nil
+		}
+		if !deadline.IsZero() {
+			if !now.Before(deadline) {
+				return os.ErrDeadlineExceeded
+			}
+			if remaining := deadline.Sub(now); remaining < delay {
+				delay = remaining
+			}
+		}
+		timer := clk.NewTimer(delay)
+		select {
+		case <-done:
+			timer.Stop()
+			return net.ErrClosed
+		case <-timer.C():
+		}
+	}
+}
+
+// take takes n transferred bytes from the bucket.
+func (l *bandwidthLimiter) take(n int) {
+	l.access.Lock()
+	l.refill(clk.Now())
+	l.tokens -= float64(n)
+	l.access.Unlock()
+}
+
+func (c *dialerConn) readThrottled(p []byte) (int, error) {
+	err := c.downlinkLimiter.wait(c.done)
+	if err != nil {
+		return 0, err
+	}
+	if len(p) > c.downlinkLimiter.burst {
+		p = p[:c.downlinkLimiter.burst]
+	}
+	n, err := c.Conn.Read(p)
+	c.downlinkLimiter.take(n)
+	return n, err
+}
+
+// writeThrottled writes p in chunks of the burst of the uplink limiter.
+func (c *dialerConn) writeThrottled(p []byte) (written int, err error) {
+	for len(p) > 0 {
+		err = c.uplinkLimiter.wait(c.done)
+		if err != nil {
+			return
+		}
+		chunk := p
+		if len(chunk) > c.uplinkLimiter.burst {
+			chunk = chunk[:c.uplinkLimiter.burst]
+		}
+		var n int
+		n, err = c.Conn.Write(chunk)
+		c.uplinkLimiter.take(n)
+		written += n
+		if err != nil {
+			return
+		}
+		p = p[n:]
+	}
+	return
+}
+
+func (c *dialerConn) SetDeadline(t time.Time) error {
+	c.uplinkLimiter.setDeadline(t)
+	c.downlinkLimiter.setDeadline(t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *dialerConn) SetReadDeadline(t time.Time) error {
+	c.downlinkLimiter.setDeadline(t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *dialerConn) SetWriteDeadline(t time.Time) error {
+	c.uplinkLimiter.setDeadline(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *dialerPacketConn) readFromThrottled(p []byte) (int, net.Addr, error) {
+	err := c.downlinkLimiter.wait(c.done)
+	if err != nil {
+		return 0, nil, err
+	}
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	c.downlinkLimiter.take(n)
+	return n, addr, err
+}
+
+func (c *dialerPacketConn) writeToThrottled(p []byte, addr net.Addr) (int, error) {
+	err := c.uplinkLimiter.wait(c.done)
+	if err != nil {
+		return 0, err
+	}
+	n, err := c.PacketConn.WriteTo(p, addr)
+	c.uplinkLimiter.take(n)
+	return n, err
+}
+
+func (c *dialerPacketConn) SetDeadline(t time.Time) error {
+	c.uplinkLimiter.setDeadline(t)
+	c.downlinkLimiter.setDeadline(t)
+	return c.PacketConn.SetDeadline(t)
+}
+
+func (c *dialerPacketConn) SetReadDeadline(t time.Time) error {
+	c.downlinkLimiter.setDeadline(t)
+	return c.PacketConn.SetReadDeadline(t)
+}
+
+func (c *dialerPacketConn) SetWriteDeadline(t time.Time) error {
+	c.uplinkLimiter.setDeadline(t)
+	return c.PacketConn.SetWriteDeadline(t)
+}
@@ -0,0 +1,64 @@
+package libcore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBandwidthLimit(t *testing.T) {
+	defer resetOptions()
+	const rate = 200000
+	if err := SetBandwidthLimit(rate, rate); err != nil {
+		t.Fatal(err)
+	}
+	c, peer := tcpPair(t)
+	defer c.Close()
+	defer peer.Close()
+	// a burst of a tenth of a second and a chunk taken on credit go at once
+	const size = rate / 2
+	minimum := time.Duration(size-2*rate/10) * time.Second / rate
+	payload := bytes.Repeat([]byte{'x'}, size)
+
+	start := time.Now()
+	go c.Write(payload)
+	if _, err := io.ReadFull(peer, make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < minimum*9/10 {
+		t.Fatal("uploaded ", size, " bytes in ", elapsed, ", faster than ", rate, " bytes per second")
+	}
+
+	start = time.Now()
+	go peer.Write(payload)
+	// reads smaller than the burst
+	buffer := make([]byte, 1000)
+	for read := 0; read < size; {
+		n, err := c.Read(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read += n
+	}
+	if elapsed := time.Since(start); elapsed < minimum*9/10 {
+		t.Fatal("downloaded ", size, " bytes in ", elapsed, ", faster than ", rate, " bytes per second")
+	}
+
+	// a throttled write fails at its deadline
+	c.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	go io.Copy(io.Discard, peer)
+	start = time.Now()
+	if _, err := c.Write(payload); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("unexpected error past the deadline: ", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatal("write returned ", elapsed, " after its deadline")
+	}
+
+	if err := SetBandwidthLimit(-1, 0); err == nil {
+		t.Fatal("accepted a negative limit")
+	}
+}
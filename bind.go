@@ -1,27 +1,26 @@
 package libcore
 
 import (
-	"syscall"
+	"sync/atomic"
 
 	"github.com/sirupsen/logrus"
 )
 
-var upstreamNetworkName string
+var upstreamNetworkName atomic.Value
 
-func bindToUpstream(fd uintptr) {
-	if upstreamNetworkName == "" {
-		logrus.Warn("empty upstream network name")
-		return
-	}
-	err := syscall.BindToDevice(int(fd), upstreamNetworkName)
-	if err != nil {
-		logrus.Warn("failed to bind socket to upstream network ", upstreamNetworkName, ": ", err)
+func BindNetworkName(name string) {
+	if name != loadString(&upstreamNetworkName) {
+		upstreamNetworkName.Store(name)
+		logrus.Debug("updated upstream network name: ", name)
 	}
 }
 
-func BindNetworkName(name string) {
-	if name != upstreamNetworkName {
-		upstreamNetworkName = name
-		logrus.Debug("updated upstream network name: ", upstreamNetworkName)
+var bindInterfaceName atomic.Value
+
+// SetBindInterface binds protected sockets to the named interface, empty disables binding.
+func SetBindInterface(name string) {
+	if name != loadString(&bindInterfaceName) {
+		bindInterfaceName.Store(name)
+		logrus.Debug("updated bind interface: ", name)
 	}
 }
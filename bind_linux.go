@@ -0,0 +1,21 @@
+//go:build linux || android
+
+package libcore
+
+import (
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+func bindToUpstream(fd uintptr) {
+	name := loadString(&upstreamNetworkName)
+	if name == "" {
+		logrus.Warn("empty upstream network name")
+		return
+	}
+	err := syscall.BindToDevice(int(fd), name)
+	if err != nil {
+		logrus.Warn("failed to bind socket to upstream network ", name, ": ", err)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !android
+
+package libcore
+
+import "github.com/sirupsen/logrus"
+
+func bindToUpstream(fd uintptr) {
+	logrus.Warn("binding to upstream network is not supported on this platform")
+}
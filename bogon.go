@@ -0,0 +1,79 @@
+package libcore
+
+import (
+	"net"
+
+	"github.com/sirupsen/logrus"
+)
+
+// bogonNetworks are the special purpose ranges of the IANA registries that are never
+// reachable on the internet. The NAT64 prefix 64:ff9b::/96 is left out since DNS64
+// answers on IPv6-only networks use it.
+var bogonNetworks = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"100::/64",
+	"2001:db8::/32",
+	"3fff::/20",
+	"fc00::/7",
+	"fe80::/10",
+	"fec0::/10",
+	"ff00::/8",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+var filterBogons uint32
+
+// SetFilterBogons makes protected dials drop the private, loopback, link-local, multicast
+// and other reserved addresses a domain resolves to, guarding against poisoned or
+// misconfigured DNS. Dials of IP destinations are not affected.
+func SetFilterBogons(enabled bool) {
+	storeBool(&filterBogons, enabled)
+}
+
+func isBogon(ip net.IP) bool {
+	for _, network := range bogonNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// dropBogons drops the bogon addresses domain resolved to.
+func dropBogons(domain string, ips []net.IP) []net.IP {
+	public := ips[:0:0]
+	for _, ip := range ips {
+		if isBogon(ip) {
+			logrus.Debug("dropped bogon address ", ip, " of ", domain)
+		} else {
+			public = append(public, ip)
+		}
+	}
+	return public
+}
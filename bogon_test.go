@@ -0,0 +1,90 @@
+package libcore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/features/dns"
+)
+
+func TestIsBogon(t *testing.T) {
+	for address, bogon := range map[string]bool{
+		"0.0.0.0":          true,
+		"10.1.2.3":         true,
+		"100.64.0.1":       true,
+		"127.0.0.1":        true,
+		"169.254.1.1":      true,
+		"172.31.255.255":   true,
+		"192.168.1.1":      true,
+		"198.19.0.1":       true,
+		"224.0.0.251":      true,
+		"255.255.255.255":  true,
+		"::":               true,
+		"::1":              true,
+		"::ffff:10.0.0.1":  true,
+		"fd00::1":          true,
+		"fe80::1":          true,
+		"ff02::1":          true,
+		"2001:db8::1":      true,
+		"1.1.1.1":          false,
+		"8.8.8.8":          false,
+		"100.128.0.1":      false,
+		"172.32.0.1":       false,
+		"198.20.0.1":       false,
+		"2606:4700::1111":  false,
+		"64:ff9b::808:808": false,
+	} {
+		if isBogon(net.ParseIP(address)) != bogon {
+			t.Fatal(address, " bogon: ", !bogon)
+		}
+	}
+}
+
+func TestFilterBogons(t *testing.T) {
+	defer resetOptions()
+	public := []net.IP{net.ParseIP("1.1.1.1"), net.ParseIP("2606:4700::1111")}
+	mixed := []net.IP{net.ParseIP("10.0.0.1"), public[0], net.ParseIP("fe80::1"), public[1], net.ParseIP("127.0.0.1")}
+	if filtered := dropBogons("mixed.test", mixed); fmt.Sprint(filtered) != fmt.Sprint(public) {
+		t.Fatal("kept ", filtered)
+	}
+	if len(mixed) != 5 {
+		t.Fatal("modified the answer")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	dialer := protectedDialer{
+		protector: noopProtectorInstance,
+		resolver: func(ctx context.Context, domain string) ([]net.IP, error) {
+			return []net.IP{net.IPv4(127, 0, 0, 1), net.IPv4(192, 168, 0, 1)}, nil
+		},
+	}
+	port := v2rayNet.Port(listener.Addr().(*net.TCPAddr).Port)
+	destination := v2rayNet.TCPDestination(v2rayNet.DomainAddress("bogon.test"), port)
+	conn, err := dialer.Dial(context.Background(), nil, destination, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// an answer of bogons only is empty
+	SetFilterBogons(true)
+	_, err = dialer.Dial(context.Background(), nil, destination, nil)
+	var resolveError *ResolveError
+	if !errors.As(err, &resolveError) || !errors.Is(err, dns.ErrEmptyResponse) {
+		t.Fatal("unexpected error dialing bogons: ", err)
+	}
+	// while IP destinations are dialed
+	conn, err = dialer.Dial(context.Background(), nil, v2rayNet.TCPDestination(v2rayNet.LocalHostIP, port), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,109 @@
+package libcore
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+)
+
+// bootstrapMinTTL is the least time bootstrap answers are cached, as DNS servers rarely move.
+const bootstrapMinTTL = 30 * time.Minute
+
+type bootstrapEntry struct {
+	ips    []net.IP
+	expire time.Time
+}
+
+var (
+	bootstrapAccess  sync.Mutex
+	bootstrapServers []v2rayNet.Destination
+	bootstrapCache   = make(map[string]bootstrapEntry)
+)
+
+// SetBootstrapDNS sets the comma separated DNS servers, as IP or IP:port, queried as plain DNS
+// to resolve the hostnames of DoH and DoT resolvers created without a bootstrap IP.
+// An empty list resolves them with the default resolver.
+func SetBootstrapDNS(servers string) error {
+	destinations, err := parseDNSServers(servers)
+	if err != nil {
+		return err
+	}
+	bootstrapAccess.Lock()
+	bootstrapServers = destinations
+	bootstrapCache = make(map[string]bootstrapEntry)
+	bootstrapAccess.Unlock()
+	return nil
+}
+
+// parseDNSServers parses comma separated DNS servers, as IP or IP:port, into UDP destinations.
+func parseDNSServers(servers string) ([]v2rayNet.Destination, error) {
+	var destinations []v2rayNet.Destination
+	for _, server := range strings.Split(servers, ",") {
+		server = strings.TrimSpace(server)
+		if server == "" {
+			continue
+		}
+		host, port := server, "53"
+		if net.ParseIP(server) == nil {
+			var err error
+			host, port, err = net.SplitHostPort(server)
+			if err != nil {
+				return nil, newError("invalid dns server ", server).Base(err)
+			}
+		}
+		ip := net.ParseIP(host)
+		portNum, err := strconv.ParseUint(port, 10, 16)
+		if ip == nil || err != nil {
+			return nil, newError("invalid dns server ", server)
+		}
+		destinations = append(destinations, v2rayNet.UDPDestination(v2rayNet.IPAddress(ip), v2rayNet.Port(portNum)))
+	}
+	return destinations, nil
+}
+
+// dialBootstrapped dials destination with the default dialer, resolving its domain with the
+// bootstrap DNS servers if set.
+func dialBootstrapped(ctx context.Context, destination v2rayNet.Destination) (net.Conn, error) {
+	dialer := *defaultDialer()
+	bootstrapAccess.Lock()
+	if len(bootstrapServers) > 0 {
+		dialer.resolver = lookupBootstrap
+	}
+	bootstrapAccess.Unlock()
+	return dialer.Dial(ctx, nil, destination, nil)
+}
+
+func lookupBootstrap(ctx context.Context, domain string) ([]net.IP, error) {
+	domain = normalizeDomain(domain)
+	bootstrapAccess.Lock()
+	entry, cached := bootstrapCache[domain]
+	servers := bootstrapServers
+	bootstrapAccess.Unlock()
+	if cached && clk.Now().Before(entry.expire) {
+		return entry.ips, nil
+	}
+
+	var lastErr error
+	for _, server := range servers {
+		ips, ttl, err := lookupWire(ctx, lookupNetwork(), domain, func(ctx context.Context, query []byte) ([]byte, error) {
+			return exchangePlain(ctx, server, query)
+		})
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if ttl < bootstrapMinTTL {
+			ttl = bootstrapMinTTL
+		}
+		bootstrapAccess.Lock()
+		bootstrapCache[domain] = bootstrapEntry{ips, clk.Now().Add(ttl)}
+		bootstrapAccess.Unlock()
+		return ips, nil
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,121 @@
+package libcore
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// bootstrapServer is a plain DNS server over UDP answering every query with ips, counting
+// the queries.
+type bootstrapServer struct {
+	address string
+	queries int32
+}
+
+func newBootstrapServer(t *testing.T, ips ...net.IP) *bootstrapServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	server := &bootstrapServer{address: conn.LocalAddr().String()}
+	go func() {
+		buffer := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&server.queries, 1)
+			conn.WriteTo(dnsAnswer(t, buffer[:n], 60, ips...), addr)
+		}
+	}()
+	return server
+}
+
+func TestBootstrapDNS(t *testing.T) {
+	defer resetOptions()
+	doh := newDohServer(t, net.IPv4(192, 0, 2, 1))
+	bootstrap := newBootstrapServer(t, net.IPv4(127, 0, 0, 1))
+	// the first server refuses the queries
+	refusing, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refusing.Close()
+	if err = SetBootstrapDNS(refusing.LocalAddr().String() + ", " + bootstrap.address); err != nil {
+		t.Fatal(err)
+	}
+
+	// the hostname of the certificate is resolved with the bootstrap server
+	serverUrl, _ := url.Parse(doh.URL)
+	resolver, err := NewDohResolver("https://example.com:"+serverUrl.Port()+"/dns-query", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := resolver.(*dohResolver)
+	r.client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{RootCAs: doh.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+	result, err := r.LookupIP("ip4", "doh.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ips, err := decodeIPs(result); err != nil || len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Fatal("unexpected answer ", ips, ": ", err)
+	}
+	if atomic.LoadInt32(&bootstrap.queries) == 0 {
+		t.Fatal("bootstrap server not queried")
+	}
+
+	for _, servers := range []string{"dns.example", "192.0.2.53:dns", "[2001:db8::53]:65536"} {
+		if err = SetBootstrapDNS(servers); err == nil {
+			t.Fatal("accepted ", servers)
+		}
+	}
+	if destinations, err := parseDNSServers("192.0.2.53, [2001:db8::53]:5353"); err != nil || len(destinations) != 2 ||
+		destinations[0].NetAddr() != "192.0.2.53:53" || destinations[1].NetAddr() != "[2001:db8::53]:5353" {
+		t.Fatal("parsed ", destinations, ": ", err)
+	}
+}
+
+func TestBootstrapDNSCache(t *testing.T) {
+	defer resetOptions()
+	bootstrap := newBootstrapServer(t, net.IPv4(127, 0, 0, 1))
+	if err := SetBootstrapDNS(bootstrap.address); err != nil {
+		t.Fatal(err)
+	}
+	fake := useFakeClock(t)
+	lookup := func() int32 {
+		ips, err := lookupBootstrap(context.Background(), "EXAMPLE.com.")
+		if err != nil || len(ips) != 1 || !ips[0].Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Fatal("unexpected bootstrap answer ", ips, ": ", err)
+		}
+		return atomic.LoadInt32(&bootstrap.queries)
+	}
+	queries := lookup()
+	if queries == 0 {
+		t.Fatal("bootstrap server not queried")
+	}
+	// answers are cached for at least bootstrapMinTTL, though the server gave 60 seconds
+	fake.Advance(bootstrapMinTTL - time.Second)
+	if n := lookup(); n != queries {
+		t.Fatal(n-queries, " queries for a cached answer")
+	}
+	fake.Advance(2 * time.Second)
+	if n := lookup(); n == queries {
+		t.Fatal("expired answer not queried again")
+	}
+	// and dropped when the servers change
+	queries = atomic.LoadInt32(&bootstrap.queries)
+	_ = SetBootstrapDNS(bootstrap.address)
+	if n := lookup(); n == queries {
+		t.Fatal("answer of the previous servers used")
+	}
+}
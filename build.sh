@@ -9,7 +9,8 @@ rm -rf $BUILD/android \
   $BUILD/javac-output \
   $BUILD/src
 
-gomobile bind -v -cache $(realpath $BUILD) -trimpath -tags='disable_debug' -ldflags='-s -w' . || exit 1
+LDFLAGS="-s -w -X libcore.buildRevision=$(git rev-parse --short HEAD) -X libcore.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+gomobile bind -v -cache $(realpath $BUILD) -trimpath -tags='disable_debug' -ldflags="$LDFLAGS" . || exit 1
 rm -r libcore-sources.jar
 
 proj=../SagerNet/app/libs
@@ -0,0 +1,98 @@
+package libcore
+
+import (
+	"context"
+	"sync"
+)
+
+type cleanupEntry struct {
+	closer func()
+}
+
+var (
+	cleanupAccess  sync.Mutex
+	cleanupEntries = make(map[*cleanupEntry]struct{})
+
+	rootCtx, rootCancel = context.WithCancel(context.Background())
+)
+
+// rootContext returns the context cancelled by Close.
+func rootContext() context.Context {
+	cleanupAccess.Lock()
+	defer cleanupAccess.Unlock()
+	return rootCtx
+}
+
+// registerCleanup makes Close call closer, until the returned function is called.
+func registerCleanup(closer func()) (unregister func()) {
+	entry := &cleanupEntry{closer}
+	cleanupAccess.Lock()
+	cleanupEntries[entry] = struct{}{}
+	cleanupAccess.Unlock()
+	return func() {
+		cleanupAccess.Lock()
+		delete(cleanupEntries, entry)
+		cleanupAccess.Unlock()
+	}
+}
+
+// Close tears down libcore when the VPN service stops: long-lived helpers such as
+// the sessions of StartPing register themselves here and are closed, the log hook is
+// detached and the options are restored to their defaults. Calling it again is a no-op.
+func Close() error {
+	cleanupAccess.Lock()
+	entries := cleanupEntries
+	cleanupEntries = make(map[*cleanupEntry]struct{})
+	rootCancel()
+	rootCtx, rootCancel = context.WithCancel(context.Background())
+	cleanupAccess.Unlock()
+
+	for entry := range entries {
+		entry.closer()
+	}
+	SetLogHook(nil)
+	resetOptions()
+	return nil
+}
+
+func resetOptions() {
+	SetConnectTimeout(-1)
+	SetResolveTimeout(0)
+	SetDialDeadline(0)
+	_ = SetDialStrategy(DialStrategyPreferredFamilyFirst)
+	storeDuration(&fallbackDelay, defaultFallbackDelay)
+	SetMaxDialCandidates(defaultMaxDialCandidates)
+	_ = SetPingMode(PingModeAuto)
+	SetSocketMark(0)
+	SetTcpKeepAlive(0, 0, 0)
+	SetDialRetry(0, 0)
+	SetProtectRetry(defaultProtectRetryAttempts, 0)
+	SetMultipathTCP(false)
+	SetTCPFastOpen(false)
+	SetStrictSockopt(false)
+	SetUDPKeepAlive(0)
+	SetConnIdleTimeout(0)
+	SetUDPConnected(true)
+	SetReusePort(false)
+	SetTcpNoDelay(true)
+	SetSocketBuffers(0, 0)
+	SetUDPReadBuffer(0)
+	_ = SetBandwidthLimit(0, 0)
+	_ = SetDSCP(0)
+	SetBindInterface("")
+	resetIPv6Mode()
+	_ = SetUpstreamSocks("", 0)
+	SetSocksUDP(false)
+	_ = SetDNSTransport(DNSTransportAuto)
+	_ = SetEdnsClientSubnet("")
+	SetDNSCacheTTL(-1, -1)
+	_ = SetHosts("")
+	_ = SetDialFilter("")
+	SetFilterBogons(false)
+	_ = SetBootstrapDNS("")
+	_ = SetSystemDNS("")
+	ClearDialHistory()
+	_ = SetDialLogCapacity(0)
+	SetDialObserver(nil)
+	SetLogRateLimit(defaultLogRateLimit)
+}
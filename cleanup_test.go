@@ -0,0 +1,77 @@
+package libcore
+
+import (
+	"os"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type countingPingHandler struct {
+	results int32
+}
+
+func (h *countingPingHandler) OnResult(seq int32, rtt int32, err string) {
+	atomic.AddInt32(&h.results, 1)
+}
+
+func TestClose(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	hook := useLogHook(t)
+	SetSocketMark(0x2333)
+	handler := &countingPingHandler{}
+	var sessions []*PingSession
+	for i := 0; i < 3; i++ {
+		session, err := StartPing("127.0.0.1", 10, handler)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessions = append(sessions, session)
+	}
+	ctx := rootContext()
+
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+	default:
+		t.Fatal("root context not canceled")
+	}
+	if rootContext().Err() != nil {
+		t.Fatal("root context not renewed")
+	}
+	for i := 0; i < 100 && runtime.NumGoroutine() > goroutines; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Fatal(n-goroutines, " goroutines leaked")
+	}
+	results := atomic.LoadInt32(&handler.results)
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&handler.results) != results {
+		t.Fatal("ping session still running after close")
+	}
+
+	logrus.Error("after close")
+	if len(hook.entries) != 0 {
+		t.Fatal("log hook still attached: ", hook.entries)
+	}
+	if logrus.StandardLogger().Out != os.Stderr {
+		t.Fatal("stderr output not restored")
+	}
+	if atomic.LoadInt32(&socketMark) != 0 {
+		t.Fatal("options not reset")
+	}
+
+	// closing again, or the closed sessions, is a no-op
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, session := range sessions {
+		session.Close()
+	}
+}
@@ -0,0 +1,143 @@
+package libcore
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// clock is the source of time of the timers in dials and pings, replaceable to drive
+// them without waiting.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) clockTimer
+	AfterFunc(d time.Duration, f func()) clockTimer
+}
+
+// clockTimer is the subset of time.Timer used with clock, C is nil for AfterFunc timers.
+type clockTimer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+var clk clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTimer(d time.Duration) clockTimer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// timeoutContext is a context done timeout after its creation on clk. It does not embed
+// a context.WithCancel of its parent, which would report context.Canceled to the contexts
+// derived from it on timeout.
+type timeoutContext struct {
+	parent   context.Context
+	deadline time.Time
+	done     chan struct{}
+	access   sync.Mutex
+	err      error
+}
+
+// withTimeout is context.WithTimeout timed by clk.
+func withTimeout(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx := &timeoutContext{
+		parent:   parent,
+		deadline: clk.Now().Add(timeout),
+		done:     make(chan struct{}),
+	}
+	if deadline, ok := parent.Deadline(); ok && deadline.Before(ctx.deadline) {
+		ctx.deadline = deadline
+	}
+	timer := clk.AfterFunc(timeout, func() {
+		ctx.cancel(context.DeadlineExceeded)
+	})
+	if parentDone := parent.Done(); parentDone != nil {
+		go func() {
+			select {
+			case <-parentDone:
+				ctx.cancel(parent.Err())
+			case <-ctx.done:
+			}
+		}()
+	}
+	return ctx, func() {
+		timer.Stop()
+		ctx.cancel(context.Canceled)
+	}
+}
+
+// cancel closes the context with err, unless already done.
+func (c *timeoutContext) cancel(err error) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if c.err == nil {
+		c.err = err
+		close(c.done)
+	}
+}
+
+func (c *timeoutContext) Deadline() (time.Time, bool) {
+	return c.deadline, true
+}
+
+func (c *timeoutContext) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *timeoutContext) Err() error {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return c.err
+}
+
+func (c *timeoutContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+// aLongTimeAgo is a deadline making pending IO fail immediately.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// watchDeadline makes the IO of conn fail with os.ErrDeadlineExceeded once ctx is done,
+// until the returned function is called.
+func watchDeadline(ctx context.Context, conn interface{ SetDeadline(time.Time) error }) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(aLongTimeAgo)
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
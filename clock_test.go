@@ -0,0 +1,161 @@
+package libcore
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock only moving forward with Advance.
+type fakeClock struct {
+	access sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	when  time.Time
+	c     chan time.Time
+	f     func()
+}
+
+// useFakeClock replaces clk with a fake clock for the duration of the test.
+func useFakeClock(t *testing.T) *fakeClock {
+	c := &fakeClock{now: time.Now()}
+	c.cond = sync.NewCond(&c.access)
+	clk = c
+	t.Cleanup(func() {
+		clk = realClock{}
+	})
+	return c
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) clockTimer {
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	t := &fakeTimer{clock: c, f: f}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward by d, firing the timers due in order.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.access.Lock()
+	end := c.now.Add(d)
+	for {
+		sort.Slice(c.timers, func(i, j int) bool {
+			return c.timers[i].when.Before(c.timers[j].when)
+		})
+		if len(c.timers) == 0 || c.timers[0].when.After(end) {
+			break
+		}
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		c.now = t.when
+		c.access.Unlock()
+		t.fire()
+		c.access.Lock()
+	}
+	c.now = end
+	c.access.Unlock()
+}
+
+// WaitTimers blocks until n timers are pending.
+func (c *fakeClock) WaitTimers(n int) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+func (t *fakeTimer) fire() {
+	if t.f != nil {
+		go t.f()
+		return
+	}
+	select {
+	case t.c <- t.clock.Now():
+	default:
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+// remove drops t from the pending timers, access must be held.
+func (t *fakeTimer) remove() bool {
+	timers := t.clock.timers
+	for i, pending := range timers {
+		if pending == t {
+			t.clock.timers = append(timers[:i:i], timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.access.Lock()
+	defer t.clock.access.Unlock()
+	return t.remove()
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	c := t.clock
+	c.access.Lock()
+	defer c.access.Unlock()
+	active := t.remove()
+	t.when = c.now.Add(d)
+	c.timers = append(c.timers, t)
+	c.cond.Broadcast()
+	return active
+}
+
+func TestWithTimeoutFakeClock(t *testing.T) {
+	fake := useFakeClock(t)
+	ctx, cancel := withTimeout(context.Background(), time.Second)
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	if !ok || !deadline.Equal(fake.Now().Add(time.Second)) {
+		t.Fatalf("deadline %v, %v", deadline, ok)
+	}
+	fake.Advance(999 * time.Millisecond)
+	if ctx.Err() != nil {
+		t.Fatal("done before the timeout: ", ctx.Err())
+	}
+	fake.Advance(time.Millisecond)
+	<-ctx.Done()
+	if ctx.Err() != context.DeadlineExceeded {
+		t.Fatal("unexpected error: ", ctx.Err())
+	}
+}
+
+func TestWithTimeoutCanceled(t *testing.T) {
+	fake := useFakeClock(t)
+	ctx, cancel := withTimeout(context.Background(), time.Second)
+	cancel()
+	fake.Advance(time.Second)
+	if ctx.Err() != context.Canceled {
+		t.Fatal("unexpected error: ", ctx.Err())
+	}
+}
@@ -0,0 +1,385 @@
+package libcore
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+)
+
+// dialerUplink and dialerDownlink count the traffic of all protected connections.
+var dialerUplink, dialerDownlink uint64
+
+var activeConnections int32
+
+type DialerStats struct {
+	Uplink   int64
+	Downlink int64
+}
+
+// ReadStats returns the bytes written to and read from protected connections since the last reset.
+func ReadStats() *DialerStats {
+	return &DialerStats{
+		Uplink:   int64(atomic.LoadUint64(&dialerUplink)),
+		Downlink: int64(atomic.LoadUint64(&dialerDownlink)),
+	}
+}
+
+func ResetStats() {
+	atomic.StoreUint64(&dialerUplink, 0)
+	atomic.StoreUint64(&dialerDownlink, 0)
+}
+
+// ActiveConnections returns the number of protected connections not closed yet.
+func ActiveConnections() int32 {
+	return atomic.LoadInt32(&activeConnections)
+}
+
+// dialerConn counts the traffic of a protected stream connection.
+type dialerConn struct {
+	// lastActive is the UnixNano time of the last IO, for the idle timeout. It comes
+	// first to stay 64-bit aligned for the atomic functions on 32-bit platforms.
+	lastActive  int64
+	idleTimeout time.Duration
+	net.Conn
+	closed uint32
+	done   chan struct{}
+
+	uplinkLimiter, downlinkLimiter *bandwidthLimiter
+}
+
+func newDialerConn(conn net.Conn) *dialerConn {
+	atomic.AddInt32(&activeConnections, 1)
+	c := &dialerConn{
+		Conn:            conn,
+		idleTimeout:     loadDuration(&connIdleTimeout),
+		done:            make(chan struct{}),
+		uplinkLimiter:   newBandwidthLimiter(atomic.LoadInt64(&uplinkLimit)),
+		downlinkLimiter: newBandwidthLimiter(atomic.LoadInt64(&downlinkLimit)),
+	}
+	if c.idleTimeout > 0 {
+		watchIdle(&c.lastActive, c.idleTimeout, c.done, c.Close)
+	}
+	return c
+}
+
+func (c *dialerConn) Read(p []byte) (n int, err error) {
+	if c.downlinkLimiter != nil {
+		n, err = c.readThrottled(p)
+	} else {
+		n, err = c.Conn.Read(p)
+	}
+	atomic.AddUint64(&dialerDownlink, uint64(n))
+	if c.idleTimeout > 0 {
+		atomic.StoreInt64(&c.lastActive, clk.Now().UnixNano())
+	}
+	return
+}
+
+func (c *dialerConn) Write(p []byte) (n int, err error) {
+	if c.uplinkLimiter != nil {
+		n, err = c.writeThrottled(p)
+	} else {
+		n, err = c.Conn.Write(p)
+	}
+	atomic.AddUint64(&dialerUplink, uint64(n))
+	if c.idleTimeout > 0 {
+		atomic.StoreInt64(&c.lastActive, clk.Now().UnixNano())
+	}
+	return
+}
+
+// ReadFrom keeps the splice of TCP connections for io.Copy to c, unless throttled or timing out
+// when idle, which need the IO to go through Write.
+func (c *dialerConn) ReadFrom(r io.Reader) (n int64, err error) {
+	readerFrom, ok := c.Conn.(io.ReaderFrom)
+	if !ok || c.uplinkLimiter != nil || c.idleTimeout > 0 {
+		return io.Copy(struct{ io.Writer }{c}, r)
+	}
+	n, err = readerFrom.ReadFrom(r)
+	atomic.AddUint64(&dialerUplink, uint64(n))
+	return
+}
+
+// CloseWrite shuts down the writing side of TCP and unix connections.
+func (c *dialerConn) CloseWrite() error {
+	if closer, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return closer.CloseWrite()
+	}
+	return newError("half close is not supported by ", c.Conn.LocalAddr().Network())
+}
+
+func (c *dialerConn) Close() error {
+	if atomic.CompareAndSwapUint32(&c.closed, 0, 1) {
+		atomic.AddInt32(&activeConnections, -1)
+		close(c.done)
+	}
+	return c.Conn.Close()
+}
+
+// dialerPacketConn counts the traffic of a protected packet connection.
+type dialerPacketConn struct {
+	// lastWrite is the UnixNano time of the last write, for the keepalive, and
+	// lastActive the one of the last IO, for the idle timeout.
+	lastWrite   int64
+	lastActive  int64
+	idleTimeout time.Duration
+	net.PacketConn
+	closed uint32
+	done   chan struct{}
+
+	uplinkLimiter, downlinkLimiter *bandwidthLimiter
+}
+
+func newDialerPacketConn(conn net.PacketConn) *dialerPacketConn {
+	atomic.AddInt32(&activeConnections, 1)
+	c := &dialerPacketConn{
+		PacketConn:      conn,
+		idleTimeout:     loadDuration(&connIdleTimeout),
+		done:            make(chan struct{}),
+		uplinkLimiter:   newBandwidthLimiter(atomic.LoadInt64(&uplinkLimit)),
+		downlinkLimiter: newBandwidthLimiter(atomic.LoadInt64(&downlinkLimit)),
+	}
+	if c.idleTimeout > 0 {
+		watchIdle(&c.lastActive, c.idleTimeout, c.done, c.Close)
+	}
+	return c
+}
+
+// startKeepAlive sends an empty datagram to dest whenever nothing was written for interval,
+// keeping the NAT mapping alive until the connection is closed. Keepalives do not count
+// as activity for the idle timeout.
+func (c *dialerPacketConn) startKeepAlive(dest net.Addr, interval time.Duration) {
+	atomic.StoreInt64(&c.lastWrite, clk.Now().UnixNano())
+	go func() {
+		timer := clk.NewTimer(interval)
+		defer timer.Stop()
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-timer.C():
+				idle := clk.Now().Sub(time.Unix(0, atomic.LoadInt64(&c.lastWrite)))
+				if idle < interval {
+					timer.Reset(interval - idle)
+					continue
+				}
+				_, err := c.PacketConn.WriteTo(nil, dest)
+				if err != nil {
+					return
+				}
+				atomic.StoreInt64(&c.lastWrite, clk.Now().UnixNano())
+				timer.Reset(interval)
+			}
+		}
+	}()
+}
+
+func (c *dialerPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	if c.downlinkLimiter != nil {
+		n, addr, err = c.readFromThrottled(p)
+	} else {
+		n, addr, err = c.PacketConn.ReadFrom(p)
+	}
+	atomic.AddUint64(&dialerDownlink, uint64(n))
+	if c.idleTimeout > 0 {
+		atomic.StoreInt64(&c.lastActive, clk.Now().UnixNano())
+	}
+	return
+}
+
+func (c *dialerPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	if c.uplinkLimiter != nil {
+		n, err = c.writeToThrottled(p, addr)
+	} else {
+		n, err = c.PacketConn.WriteTo(p, addr)
+	}
+	atomic.AddUint64(&dialerUplink, uint64(n))
+	atomic.StoreInt64(&c.lastWrite, clk.Now().UnixNano())
+	if c.idleTimeout > 0 {
+		atomic.StoreInt64(&c.lastActive, clk.Now().UnixNano())
+	}
+	return
+}
+
+func (c *dialerPacketConn) Close() error {
+	if atomic.CompareAndSwapUint32(&c.closed, 0, 1) {
+		atomic.AddInt32(&activeConnections, -1)
+		close(c.done)
+	}
+	return c.PacketConn.Close()
+}
+
+// watchIdle calls closer once lastActive is older than timeout, until done is closed.
+func watchIdle(lastActive *int64, timeout time.Duration, done <-chan struct{}, closer func() error) {
+	atomic.StoreInt64(lastActive, clk.Now().UnixNano())
+	go func() {
+		timer := clk.NewTimer(timeout)
+		defer timer.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-timer.C():
+				idle := now.Sub(time.Unix(0, atomic.LoadInt64(lastActive)))
+				if idle >= timeout {
+					logrus.Debug("closing connection idle for ", idle)
+					closer()
+					return
+				}
+				timer.Reset(timeout - idle)
+			}
+		}
+	}()
+}
+
+// Conn is a protected connection opened by the host app with DialProtected.
+type Conn struct {
+	conn net.Conn
+}
+
+// DialProtected connects to address over network ("tcp" or "udp") outside the VPN, using
+// the protector and resolver of libcore, within timeout milliseconds or the connect timeout
+// if not positive.
+func DialProtected(network string, address string, timeout int32) (*Conn, error) {
+	return dialConn(defaultDialer(), network, address, timeout)
+}
+
+func dialConn(dialer *protectedDialer, network string, address string, timeout int32) (*Conn, error) {
+	if network != "tcp" && network != "udp" {
+		return nil, newError("unsupported network ", network)
+	}
+	destination, err := v2rayNet.ParseDestination(network + ":" + address)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withCallTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := dialer.Dial(ctx, nil, destination, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{conn}, nil
+}
+
+// AdoptFd takes ownership of the connected socket fd created and protected by the host app,
+// network ("tcp", "udp" or "unix") must match the type of the socket.
+func AdoptFd(fd int32, network string) (*Conn, error) {
+	if network != "tcp" && network != "udp" && network != "unix" {
+		return nil, newError("unsupported network ", network)
+	}
+	file := os.NewFile(uintptr(fd), "socket")
+	if file == nil {
+		return nil, newError("invalid fd ", fd)
+	}
+	defer file.Close()
+	conn, err := net.FileConn(file)
+	if err != nil {
+		return nil, err
+	}
+	var matched bool
+	switch network {
+	case "tcp":
+		_, matched = conn.(*net.TCPConn)
+	case "udp":
+		_, matched = conn.(*net.UDPConn)
+	case "unix":
+		_, matched = conn.(*net.UnixConn)
+	}
+	if !matched {
+		conn.Close()
+		return nil, newError("fd ", fd, " is not a ", network, " socket")
+	}
+	return &Conn{newDialerConn(conn)}, nil
+}
+
+func (c *Conn) Read(b []byte) (int32, error) {
+	n, err := c.conn.Read(b)
+	return int32(n), err
+}
+
+func (c *Conn) Write(b []byte) (int32, error) {
+	n, err := c.conn.Write(b)
+	return int32(n), err
+}
+
+// SetTimeout sets the deadline of reads and writes to timeout milliseconds from now,
+// 0 removes it.
+func (c *Conn) SetTimeout(timeout int32) error {
+	if timeout <= 0 {
+		return c.conn.SetDeadline(time.Time{})
+	}
+	return c.conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Millisecond))
+}
+
+func (c *Conn) LocalAddress() string {
+	return c.conn.LocalAddr().String()
+}
+
+func (c *Conn) RemoteAddress() string {
+	return c.conn.RemoteAddr().String()
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+var reusePort uint32
+
+// SetReusePort makes the sockets bound by ListenProtectedUDP set SO_REUSEADDR and
+// SO_REUSEPORT, so that several of them can bind the same port.
+func SetReusePort(enabled bool) {
+	storeBool(&reusePort, enabled)
+}
+
+// PacketConn is a protected UDP socket opened by the host app with ListenProtectedUDP.
+type PacketConn struct {
+	conn net.PacketConn
+}
+
+// Datagram describes a datagram received by PacketConn.ReadFrom.
+type Datagram struct {
+	Length  int32
+	Address string
+}
+
+func (c *PacketConn) ReadFrom(b []byte) (*Datagram, error) {
+	n, addr, err := c.conn.ReadFrom(b)
+	if err != nil {
+		return nil, err
+	}
+	return &Datagram{int32(n), addr.String()}, nil
+}
+
+// WriteTo sends b to address, which must be an IP and port.
+func (c *PacketConn) WriteTo(b []byte, address string) (int32, error) {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return 0, err
+	}
+	n, err := c.conn.WriteTo(b, net.UDPAddrFromAddrPort(addrPort))
+	return int32(n), err
+}
+
+// SetTimeout sets the deadline of reads and writes to timeout milliseconds from now,
+// 0 removes it.
+func (c *PacketConn) SetTimeout(timeout int32) error {
+	if timeout <= 0 {
+		return c.conn.SetDeadline(time.Time{})
+	}
+	return c.conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Millisecond))
+}
+
+func (c *PacketConn) LocalAddress() string {
+	return c.conn.LocalAddr().String()
+}
+
+func (c *PacketConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,90 @@
+//go:build linux || android
+
+package libcore
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"golang.org/x/sys/unix"
+	"libcore/comm"
+)
+
+// ListenProtectedUDP binds a UDP socket to address outside the VPN, the socket is
+// protected before being bound. An empty host listens on all addresses.
+func ListenProtectedUDP(address string) (*PacketConn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, newError("invalid port ", portStr)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil && host != "" {
+		return nil, newError("unable to parse ip ", host)
+	}
+	ipv6 := ip == nil && GetIPv6Mode() != comm.IPv6Disable || ip != nil && ip.To4() == nil
+	fd, err := getFd(v2rayNet.Network_UDP, ipv6, false)
+	if err != nil {
+		return nil, err
+	}
+	if !protect(rootContext(), defaultDialer().protector, fd) {
+		unix.Close(fd)
+		return nil, errors.New("protect failed")
+	}
+	if size := atomic.LoadInt32(&udpReadBuffer); size > 0 {
+		setSocketBuffer(fd, unix.SO_RCVBUF, size)
+	}
+	if loadBool(&reusePort) {
+		err = setReuse(fd)
+		if err != nil {
+			unix.Close(fd)
+			return nil, newError("failed to set port reuse").Base(err)
+		}
+	}
+	var sockaddr unix.Sockaddr
+	if !ipv6 {
+		socketAddress := &unix.SockaddrInet4{Port: int(port)}
+		if ip != nil {
+			copy(socketAddress.Addr[:], ip.To4())
+		}
+		sockaddr = socketAddress
+	} else {
+		socketAddress := &unix.SockaddrInet6{Port: int(port)}
+		if ip != nil {
+			copy(socketAddress.Addr[:], ip)
+		} else {
+			err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 0)
+		}
+		sockaddr = socketAddress
+	}
+	if err == nil {
+		err = unix.Bind(fd, sockaddr)
+	}
+	if err != nil {
+		unix.Close(fd)
+		return nil, newError("failed to bind udp socket to ", address).Base(err)
+	}
+	file := os.NewFile(uintptr(fd), "socket")
+	defer file.Close()
+	conn, err := net.FilePacketConn(file)
+	if err != nil {
+		return nil, err
+	}
+	return &PacketConn{newDialerPacketConn(conn)}, nil
+}
+
+// setReuse sets SO_REUSEADDR and SO_REUSEPORT on fd before it is bound.
+func setReuse(fd int) error {
+	err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+	if err != nil {
+		return err
+	}
+	return unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+}
@@ -0,0 +1,441 @@
+//go:build linux || android
+
+package libcore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestDialProtected(t *testing.T) {
+	defer setDefaultDialer(defaultDialer())
+	protector := NewRecordingProtector()
+	setDefaultDialer(&protectedDialer{protector: protector, resolver: lookupDefault})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	conn, err := DialProtected("tcp", listener.Addr().String(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if protector.Count() != 1 {
+		t.Fatal(protector.Count(), " sockets protected")
+	}
+	if conn.RemoteAddress() != listener.Addr().String() {
+		t.Fatal("connected to ", conn.RemoteAddress())
+	}
+	if n, err := conn.Write([]byte("license")); n != 7 || err != nil {
+		t.Fatal("wrote ", n, ": ", err)
+	}
+	reply := make([]byte, 7)
+	for read := 0; read < len(reply); {
+		n, err := conn.Read(reply[read:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		read += int(n)
+	}
+	if string(reply) != "license" {
+		t.Fatalf("read %q", reply)
+	}
+	if err = conn.SetTimeout(10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Read(reply); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("unexpected error reading after the timeout: ", err)
+	}
+	if err = conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write([]byte("closed")); err == nil {
+		t.Fatal("wrote to a closed conn")
+	}
+
+	for _, test := range []struct{ network, address string }{
+		{"ip", listener.Addr().String()},
+		{"tcp", "127.0.0.1"},
+		{"tcp", "127.0.0.1:65536"},
+	} {
+		if conn, err = DialProtected(test.network, test.address, 1000); err == nil {
+			conn.Close()
+			t.Fatal("dialed ", test.network, " ", test.address)
+		}
+	}
+}
+
+// unboundProtector records whether the sockets it protects are still unbound.
+type unboundProtector struct {
+	protected, bound int32
+}
+
+func (p *unboundProtector) Protect(fd int32) bool {
+	p.protected++
+	sockaddr, err := unix.Getsockname(int(fd))
+	if err != nil {
+		return false
+	}
+	switch sockaddr := sockaddr.(type) {
+	case *unix.SockaddrInet4:
+		if sockaddr.Port != 0 {
+			p.bound++
+		}
+	case *unix.SockaddrInet6:
+		if sockaddr.Port != 0 {
+			p.bound++
+		}
+	}
+	return true
+}
+
+func TestListenProtectedUDP(t *testing.T) {
+	defer setDefaultDialer(defaultDialer())
+	protector := &unboundProtector{}
+	setDefaultDialer(&protectedDialer{protector: protector, resolver: lookupDefault})
+
+	first, err := ListenProtectedUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := ListenProtectedUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if protector.protected != 2 || protector.bound != 0 {
+		t.Fatal(protector.protected, " sockets protected, ", protector.bound, " of them after binding")
+	}
+
+	if n, err := first.WriteTo([]byte("query"), second.LocalAddress()); n != 5 || err != nil {
+		t.Fatal("wrote ", n, ": ", err)
+	}
+	if err = second.SetTimeout(1000); err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, 16)
+	datagram, err := second.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buffer[:datagram.Length]) != "query" || datagram.Address != first.LocalAddress() {
+		t.Fatalf("received %q from %s", buffer[:datagram.Length], datagram.Address)
+	}
+	// and back to the sender
+	if _, err = second.WriteTo([]byte("answer"), datagram.Address); err != nil {
+		t.Fatal(err)
+	}
+	if err = first.SetTimeout(1000); err != nil {
+		t.Fatal(err)
+	}
+	if datagram, err = first.ReadFrom(buffer); err != nil || string(buffer[:datagram.Length]) != "answer" {
+		t.Fatal("unexpected answer: ", err)
+	}
+
+	if _, err = first.WriteTo([]byte("query"), "localhost:53"); err == nil {
+		t.Fatal("wrote to a domain")
+	}
+	for _, address := range []string{"127.0.0.1", "127.0.0.1:65536", "localhost:0"} {
+		if conn, err := ListenProtectedUDP(address); err == nil {
+			conn.Close()
+			t.Fatal("listened on ", address)
+		}
+	}
+}
+
+func TestUDPKeepAlive(t *testing.T) {
+	defer resetOptions()
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	buffer := make([]byte, 16)
+	// received returns the length of the next datagram, -1 if none arrives shortly
+	received := func() int {
+		listener.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		n, _, err := listener.ReadFrom(buffer)
+		if err != nil {
+			return -1
+		}
+		return n
+	}
+	goroutines := runtime.NumGoroutine()
+	fake := useFakeClock(t)
+	SetUDPKeepAlive(5)
+
+	conn, err := DialProtected("udp", listener.LocalAddr().String(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		fake.WaitTimers(1)
+		fake.Advance(5 * time.Second)
+		if n := received(); n != 0 {
+			t.Fatal("keepalive ", i, ": received ", n, " bytes")
+		}
+	}
+
+	// writes postpone the keepalive
+	fake.WaitTimers(1)
+	fake.Advance(2 * time.Second)
+	if _, err = conn.Write([]byte("dns")); err != nil {
+		t.Fatal(err)
+	}
+	if n := received(); n != 3 {
+		t.Fatal("received ", n, " bytes of a write")
+	}
+	fake.Advance(3 * time.Second)
+	if n := received(); n != -1 {
+		t.Fatal("keepalive of ", n, " bytes right after a write")
+	}
+	fake.WaitTimers(1)
+	fake.Advance(2 * time.Second)
+	if n := received(); n != 0 {
+		t.Fatal("received ", n, " bytes instead of a keepalive")
+	}
+
+	conn.Close()
+	waitGoroutines(t, goroutines)
+
+	// disabled by default
+	SetUDPKeepAlive(0)
+	if conn, err = DialProtected("udp", listener.LocalAddr().String(), 0); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fake.Advance(time.Minute)
+	if n := received(); n != -1 {
+		t.Fatal("keepalive of ", n, " bytes with keepalive disabled")
+	}
+}
+
+func TestAdoptFd(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fds[1])
+	conn, err := AdoptFd(int32(fds[0]), "unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = unix.Write(fds[1], []byte("native")); err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, 16)
+	if err = conn.SetTimeout(1000); err != nil {
+		t.Fatal(err)
+	}
+	n, err := conn.Read(buffer)
+	if err != nil || string(buffer[:n]) != "native" {
+		t.Fatalf("read %q: %v", buffer[:n], err)
+	}
+	if _, err = conn.Write([]byte("go")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := unix.Read(fds[1], buffer); err != nil || string(buffer[:n]) != "go" {
+		t.Fatalf("read %q: %v", buffer[:n], err)
+	}
+
+	// the socket type must match the network
+	fds, err = unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fds[1])
+	for _, network := range []string{"tcp", "udp"} {
+		fd, err := unix.Dup(fds[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn, err := AdoptFd(int32(fd), network); err == nil {
+			conn.Close()
+			t.Fatal("adopted a unix socket as ", network)
+		}
+	}
+	if conn, err := AdoptFd(int32(fds[0]), "ip"); err == nil {
+		conn.Close()
+		t.Fatal("adopted a socket of an unsupported network")
+	}
+	unix.Close(fds[0])
+	if conn, err := AdoptFd(-1, "unix"); err == nil {
+		conn.Close()
+		t.Fatal("adopted an invalid fd")
+	}
+}
+
+func TestReusePort(t *testing.T) {
+	defer resetOptions()
+	first, err := ListenProtectedUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	address := first.LocalAddress()
+	if conn, err := ListenProtectedUDP(address); err == nil {
+		conn.Close()
+		t.Fatal("bound a port in use without reuse")
+	}
+	first.Close()
+
+	SetReusePort(true)
+	if first, err = ListenProtectedUDP(address); err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := ListenProtectedUDP(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if second.LocalAddress() != address {
+		t.Fatal("bound ", second.LocalAddress(), ", expected ", address)
+	}
+}
+
+func TestConnHandles(t *testing.T) {
+	listener, accepted := acceptingListener(t, "127.0.0.1:0")
+	handle, err := DialProtectedHandle("tcp", listener.Addr().String(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := <-accepted
+	if n, err := WriteHandle(handle, []byte("ping")); n != 4 || err != nil {
+		t.Fatal("wrote ", n, ": ", err)
+	}
+	buffer := make([]byte, 4)
+	if _, err = io.ReadFull(peer, buffer); err != nil || string(buffer) != "ping" {
+		t.Fatalf("peer read %q: %v", buffer, err)
+	}
+	if _, err = peer.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := ReadHandle(handle, buffer); n != 4 || err != nil || string(buffer) != "pong" {
+		t.Fatalf("read %q: %v", buffer[:n], err)
+	}
+
+	if err = CloseHandle(handle); err != nil {
+		t.Fatal(err)
+	}
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = peer.Read(buffer); err != io.EOF {
+		t.Fatal("connection of the closed handle still open: ", err)
+	}
+	if _, err = ReadHandle(handle, buffer); err == nil {
+		t.Fatal("read a closed handle")
+	}
+	if _, err = WriteHandle(handle, buffer); err == nil {
+		t.Fatal("wrote a closed handle")
+	}
+	if err = CloseHandle(handle); err != nil {
+		t.Fatal("closing a handle twice: ", err)
+	}
+
+	// handles are distinct and those left open are closed by Close
+	first, err := DialProtectedHandle("tcp", listener.Addr().String(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := DialProtectedHandle("tcp", listener.Addr().String(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second || first == handle || second == handle {
+		t.Fatal("reused handles ", handle, ", ", first, " and ", second)
+	}
+	Close()
+	for _, handle := range []int64{first, second} {
+		if _, err = ReadHandle(handle, buffer); err == nil {
+			t.Fatal("handle ", handle, " open after Close")
+		}
+	}
+	handleAccess.Lock()
+	left := len(handles)
+	handleAccess.Unlock()
+	if left != 0 {
+		t.Fatal(left, " handles left in the registry")
+	}
+}
+
+func TestDialProtectedWithoutTimeout(t *testing.T) {
+	defer resetOptions()
+	listener, _ := acceptingListener(t, "127.0.0.1:0")
+	// non-positive timeouts leave the dial to the connect timeout
+	for _, timeout := range []int32{0, -1} {
+		conn, err := DialProtected("tcp", listener.Addr().String(), timeout)
+		if err != nil {
+			t.Fatal("timeout ", timeout, ": ", err)
+		}
+		conn.Close()
+		handle, err := DialProtectedHandle("tcp", listener.Addr().String(), timeout)
+		if err != nil {
+			t.Fatal("handle with timeout ", timeout, ": ", err)
+		}
+		CloseHandle(handle)
+	}
+
+	fake := useFakeClock(t)
+	SetConnectTimeout(500)
+	address := blackhole(t)
+	result := make(chan error, 1)
+	go func() {
+		_, err := DialProtected("tcp", address, 0)
+		result <- err
+	}()
+	fake.WaitTimers(1)
+	fake.Advance(500 * time.Millisecond)
+	if err := <-result; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("unexpected error past the connect timeout: ", err)
+	}
+}
+
+func TestProtectedDialerDialConn(t *testing.T) {
+	listener, accepted := acceptingListener(t, "127.0.0.1:0")
+	protector := NewRecordingProtector()
+	dialer := NewProtectedDialer(protector, nil)
+	conn, err := dialer.DialConn("tcp", listener.Addr().String(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer := <-accepted
+	if protector.Count() != 1 {
+		t.Fatal(protector.Count(), " sockets protected by the dialer")
+	}
+	if n, err := conn.Write([]byte("ping")); n != 4 || err != nil {
+		t.Fatal("wrote ", n, ": ", err)
+	}
+	buffer := make([]byte, 4)
+	if _, err = io.ReadFull(peer, buffer); err != nil || string(buffer) != "ping" {
+		t.Fatalf("peer read %q: %v", buffer, err)
+	}
+	if conn, err := dialer.DialConn("ip", listener.Addr().String(), 1000); err == nil {
+		conn.Close()
+		t.Fatal("dialed network ip")
+	}
+}
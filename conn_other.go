@@ -0,0 +1,8 @@
+//go:build !linux && !android
+
+package libcore
+
+// ListenProtectedUDP binds a UDP socket to address outside the VPN, only supported on Linux.
+func ListenProtectedUDP(address string) (*PacketConn, error) {
+	return nil, errUnsupportedPlatform
+}
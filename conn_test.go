@@ -0,0 +1,208 @@
+package libcore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// tcpPair returns a dialerConn over a loopback TCP connection and its peer.
+func tcpPair(t *testing.T) (*dialerConn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newDialerConn(conn)
+	t.Cleanup(func() {
+		c.Close()
+		peer.Close()
+	})
+	return c, peer
+}
+
+// waitGoroutines waits for the number of goroutines to drop to n, failing after a second.
+func waitGoroutines(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if runtime.NumGoroutine() <= n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal(runtime.NumGoroutine(), " goroutines, expected ", n)
+}
+
+func TestDialerConnStats(t *testing.T) {
+	ResetStats()
+	defer ResetStats()
+	active := ActiveConnections()
+	conn, peer := tcpPair(t)
+	go peer.Write(make([]byte, 3000))
+	if _, err := conn.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 3000)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(peer, make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if stats := ReadStats(); stats.Uplink != 1000 || stats.Downlink != 3000 {
+		t.Fatalf("unexpected stats %+v", *stats)
+	}
+	if n := ActiveConnections(); n != active+1 {
+		t.Fatal("active connections ", n)
+	}
+	conn.Close()
+	conn.Close()
+	if n := ActiveConnections(); n != active {
+		t.Fatal("active connections after close ", n)
+	}
+	ResetStats()
+	if stats := ReadStats(); stats.Uplink != 0 || stats.Downlink != 0 {
+		t.Fatalf("stats not reset %+v", *stats)
+	}
+}
+
+func TestDialerConnCloseWrite(t *testing.T) {
+	conn, peer := tcpPair(t)
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("peer read ", err, " after close write")
+	}
+	// the reading side stays open
+	go peer.Write([]byte("reply"))
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "reply" {
+		t.Fatalf("read %q, %v", reply, err)
+	}
+}
+
+func TestDialerConnReadFrom(t *testing.T) {
+	defer resetOptions()
+	payload := bytes.Repeat([]byte("libcore"), 100000)
+	for _, limit := range []int64{0, 100 << 20} {
+		_ = SetBandwidthLimit(limit, 0)
+		ResetStats()
+		conn, peer := tcpPair(t)
+		if _, ok := interface{}(conn).(io.ReaderFrom); !ok {
+			t.Fatal("dialerConn is not an io.ReaderFrom")
+		}
+		received := make(chan []byte, 1)
+		go func() {
+			data, _ := io.ReadAll(peer)
+			received <- data
+		}()
+		n, err := io.Copy(conn, bytes.NewReader(payload))
+		if err != nil || n != int64(len(payload)) {
+			t.Fatal("copied ", n, ": ", err)
+		}
+		_ = conn.CloseWrite()
+		if data := <-received; !bytes.Equal(data, payload) {
+			t.Fatal("peer received ", len(data), " bytes")
+		}
+		if stats := ReadStats(); stats.Uplink != int64(len(payload)) {
+			t.Fatalf("limit %d: unexpected stats %+v", limit, *stats)
+		}
+	}
+	ResetStats()
+}
+
+func TestActiveConnections(t *testing.T) {
+	active := ActiveConnections()
+	expect := func(n int32) {
+		t.Helper()
+		if count := ActiveConnections() - active; count != n {
+			t.Fatal(count, " active connections, expected ", n)
+		}
+	}
+	var conns []io.Closer
+	for i := 0; i < 3; i++ {
+		conn, _ := tcpPair(t)
+		conns = append(conns, conn)
+	}
+	for i := 0; i < 2; i++ {
+		packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := newDialerPacketConn(packetConn)
+		t.Cleanup(func() {
+			conn.Close()
+		})
+		conns = append(conns, conn)
+	}
+	expect(5)
+	conns[0].Close()
+	conns[3].Close()
+	expect(3)
+	// closing twice is counted once
+	for _, conn := range conns {
+		conn.Close()
+		conn.Close()
+	}
+	expect(0)
+}
+
+func TestConnIdleTimeout(t *testing.T) {
+	defer resetOptions()
+	fake := useFakeClock(t)
+	SetConnIdleTimeout(10)
+	conn, peer := tcpPair(t)
+
+	// IO postpones the timeout
+	fake.WaitTimers(1)
+	fake.Advance(6 * time.Second)
+	if _, err := conn.Write([]byte("io")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(peer, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	fake.Advance(4 * time.Second)
+	fake.WaitTimers(1)
+	peer.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := peer.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("closed before the idle timeout: ", err)
+	}
+
+	// and the conn closes once idle for the whole window
+	fake.Advance(6 * time.Second)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("idle conn not closed: ", err)
+	}
+	if _, err := conn.Write([]byte("io")); err == nil {
+		t.Fatal("wrote to the idle conn")
+	}
+
+	// the watcher stops with the conn
+	goroutines := runtime.NumGoroutine()
+	conn, _ = tcpPair(t)
+	conn.Close()
+	waitGoroutines(t, goroutines)
+
+	// disabled by default
+	SetConnIdleTimeout(0)
+	conn, _ = tcpPair(t)
+	fake.Advance(time.Hour)
+	if _, err := conn.Write([]byte("io")); err != nil {
+		t.Fatal("closed without an idle timeout: ", err)
+	}
+}
@@ -1,10 +1,17 @@
 package libcore
 
 import (
+	"context"
+	"encoding/json"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/sagernet/libping"
 	"github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/features/dns"
 	"libcore/stun"
 )
 
@@ -18,8 +25,411 @@ func Unsetenv(key string) error {
 	return os.Unsetenv(key)
 }
 
-func IcmpPing(address string, timeout int32) (int32, error) {
-	return libping.IcmpPing(address, timeout)
+// SetenvBatch sets all variables of the JSON object kvJson, restoring the
+// environment if any of them fails.
+func SetenvBatch(kvJson string) error {
+	var env map[string]string
+	err := json.Unmarshal([]byte(kvJson), &env)
+	if err != nil {
+		return newError("failed to parse environment variables").Base(err)
+	}
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	type previousEnv struct {
+		key    string
+		value  string
+		exists bool
+	}
+	var applied []previousEnv
+	for _, key := range keys {
+		value, exists := os.LookupEnv(key)
+		err = os.Setenv(key, env[key])
+		if err == nil {
+			applied = append(applied, previousEnv{key, value, exists})
+			continue
+		}
+		for i := len(applied) - 1; i >= 0; i-- {
+			if applied[i].exists {
+				_ = os.Setenv(applied[i].key, applied[i].value)
+			} else {
+				_ = os.Unsetenv(applied[i].key)
+			}
+		}
+		return newError("failed to set environment variable ", key).Base(err)
+	}
+	return nil
+}
+
+var (
+	envDumpAccess   sync.Mutex
+	envDumpDenylist = []string{"PASSWORD", "SECRET", "TOKEN"}
+)
+
+// SetEnvDumpDenylist sets the comma separated key patterns whose values are redacted by DumpEnv,
+// a key is redacted if it contains any of the patterns, ignoring case.
+func SetEnvDumpDenylist(csv string) {
+	var denylist []string
+	for _, pattern := range strings.Split(csv, ",") {
+		pattern = strings.ToUpper(strings.TrimSpace(pattern))
+		if pattern != "" {
+			denylist = append(denylist, pattern)
+		}
+	}
+	envDumpAccess.Lock()
+	envDumpDenylist = denylist
+	envDumpAccess.Unlock()
+}
+
+// DumpEnv returns the sorted KEY=VALUE lines of the environment for diagnostics.
+func DumpEnv() string {
+	env := os.Environ()
+	sort.Strings(env)
+	envDumpAccess.Lock()
+	denylist := envDumpDenylist
+	envDumpAccess.Unlock()
+	for i, kv := range env {
+		key := strings.SplitN(kv, "=", 2)[0]
+		for _, pattern := range denylist {
+			if strings.Contains(strings.ToUpper(key), pattern) {
+				env[i] = key + "=***"
+				break
+			}
+		}
+	}
+	return strings.Join(env, "\n")
+}
+
+const defaultConnectTimeout = 10 * time.Second
+
+var connectTimeout = defaultConnectTimeout
+
+// SetConnectTimeout sets the connect timeout of protected dials in milliseconds,
+// negative values restore the default of 10 seconds. 0 removes the timeout so dials
+// wait until their context is done, a dial with a context never done may then hang
+// forever on an unresponsive address.
+func SetConnectTimeout(timeout int32) {
+	if timeout < 0 {
+		storeDuration(&connectTimeout, defaultConnectTimeout)
+	} else {
+		storeDuration(&connectTimeout, time.Duration(timeout)*time.Millisecond)
+	}
+}
+
+// withConnectTimeout bounds ctx by the connect timeout, keeping an earlier deadline of ctx.
+func withConnectTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := loadDuration(&connectTimeout)
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return withTimeout(ctx, timeout)
+}
+
+// withCallTimeout bounds ctx by the timeout in milliseconds passed to an API call,
+// non-positive values leaving the dials to the connect timeout of SetConnectTimeout.
+func withCallTimeout(ctx context.Context, timeout int32) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return withTimeout(ctx, time.Duration(timeout)*time.Millisecond)
+}
+
+var dialDeadline time.Duration
+
+// SetDialDeadline caps the total time protected dials spend connecting to all addresses
+// of a destination in milliseconds, unlike the connect timeout applying to each address.
+// Non-positive values remove the cap.
+func SetDialDeadline(deadline int32) {
+	if deadline <= 0 {
+		storeDuration(&dialDeadline, 0)
+	} else {
+		storeDuration(&dialDeadline, time.Duration(deadline)*time.Millisecond)
+	}
+}
+
+const defaultResolveTimeout = 5 * time.Second
+
+var resolveTimeout = defaultResolveTimeout
+
+// SetResolveTimeout sets the timeout of domain resolution in protected dials in milliseconds,
+// non-positive values restore the default of 5 seconds.
+func SetResolveTimeout(timeout int32) {
+	if timeout <= 0 {
+		storeDuration(&resolveTimeout, defaultResolveTimeout)
+	} else {
+		storeDuration(&resolveTimeout, time.Duration(timeout)*time.Millisecond)
+	}
+}
+
+var socketMark int32
+
+// SetSocketMark sets the fwmark of protected sockets, 0 disables marking.
+func SetSocketMark(mark int32) {
+	atomic.StoreInt32(&socketMark, mark)
+}
+
+// TcpPing measures the time taken to connect to address:port in milliseconds,
+// dialing through the protected dialer within timeout milliseconds, or the connect
+// timeout if not positive.
+func TcpPing(address string, port int32, timeout int32) (int32, error) {
+	ctx, cancel := withCallTimeout(context.Background(), timeout)
+	defer cancel()
+	destination := net.Destination{
+		Network: net.Network_TCP,
+		Address: net.ParseAddress(address),
+		Port:    net.Port(port),
+	}
+	if destination.Address.Family().IsDomain() {
+		ips, err := defaultDialer().lookup(ctx, address)
+		if err != nil {
+			return -1, err
+		}
+		mode := GetIPv6Mode()
+		ips = sortIPs(filterIPs(ips, mode), mode)
+		if len(ips) == 0 {
+			return -1, dns.ErrEmptyResponse
+		}
+		destination.Address = net.IPAddress(ips[0])
+	}
+	start := clk.Now()
+	conn, err := defaultDialer().Dial(ctx, nil, destination, nil)
+	if err != nil {
+		return -1, err
+	}
+	rtt := clk.Now().Sub(start)
+	conn.Close()
+	return int32(rtt.Milliseconds()), nil
+}
+
+var tcpKeepAliveIdle, tcpKeepAliveInterval, tcpKeepAliveCount int32
+
+// SetTcpKeepAlive enables keepalive on protected TCP sockets with the idle time and interval
+// in seconds and the probe count, zero values leave the kernel defaults.
+func SetTcpKeepAlive(idle int32, interval int32, count int32) {
+	atomic.StoreInt32(&tcpKeepAliveIdle, idle)
+	atomic.StoreInt32(&tcpKeepAliveInterval, interval)
+	atomic.StoreInt32(&tcpKeepAliveCount, count)
+}
+
+var (
+	dialRetryAttempts int32
+	dialRetryBackoff  time.Duration
+)
+
+// SetDialRetry makes protected dials retry each address up to attempts times when the
+// network is unreachable or the connect times out, waiting backoff milliseconds times the
+// attempt number in between. Refused connections are not retried.
+func SetDialRetry(attempts int32, backoff int32) {
+	if attempts < 0 {
+		attempts = 0
+	}
+	if backoff < 0 {
+		backoff = 0
+	}
+	atomic.StoreInt32(&dialRetryAttempts, attempts)
+	storeDuration(&dialRetryBackoff, time.Duration(backoff)*time.Millisecond)
+}
+
+var (
+	multipathTCP             uint32
+	lastDialUsedMultipathTCP uint32
+)
+
+// SetMultipathTCP makes protected TCP dials use MPTCP sockets where the kernel supports them.
+func SetMultipathTCP(enabled bool) {
+	storeBool(&multipathTCP, enabled)
+}
+
+// LastDialUsedMPTCP reports whether the last protected TCP connection was established with MPTCP.
+func LastDialUsedMPTCP() bool {
+	return atomic.LoadUint32(&lastDialUsedMultipathTCP) == 1
+}
+
+// lastDialRTT is the duration of the TCP handshake of the last protected dial.
+var lastDialRTT int64
+
+// LastDialRTTMicros returns the handshake RTT of the last protected dial in microseconds,
+// as loopback and LAN handshakes take well under a millisecond. It is 0 for UDP dials and
+// not updated by SelfTest.
+func LastDialRTTMicros() int32 {
+	return int32(time.Duration(atomic.LoadInt64(&lastDialRTT)).Microseconds())
+}
+
+var (
+	lastLocalAddrAccess sync.Mutex
+	lastLocalAddr       string
+)
+
+// LastLocalAddr returns the local address and port the kernel bound the last protected
+// dial to, empty for unconnected UDP dials.
+func LastLocalAddr() string {
+	lastLocalAddrAccess.Lock()
+	defer lastLocalAddrAccess.Unlock()
+	return lastLocalAddr
+}
+
+func setLastLocalAddr(address string) {
+	lastLocalAddrAccess.Lock()
+	lastLocalAddr = address
+	lastLocalAddrAccess.Unlock()
+}
+
+const defaultProtectRetryAttempts = 1
+
+var (
+	protectRetryAttempts int32 = defaultProtectRetryAttempts
+	protectRetryDelay    time.Duration
+)
+
+// SetProtectRetry makes protected dials call Protect up to attempts times, waiting delay
+// milliseconds in between, before failing, since protect may fail right after the VPN starts.
+func SetProtectRetry(attempts int32, delay int32) {
+	if attempts < 1 {
+		attempts = defaultProtectRetryAttempts
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	atomic.StoreInt32(&protectRetryAttempts, attempts)
+	storeDuration(&protectRetryDelay, time.Duration(delay)*time.Millisecond)
+}
+
+var udpConnected uint32 = 1
+
+// SetUDPConnected sets whether protected UDP sockets are connected to their destination,
+// the default. Unconnected sockets also receive datagrams from other peers, as needed to
+// traverse full cone NATs.
+func SetUDPConnected(connected bool) {
+	storeBool(&udpConnected, connected)
+}
+
+var udpKeepAliveInterval time.Duration
+
+// SetUDPKeepAlive makes protected UDP connections send an empty datagram after interval
+// seconds without writes, keeping carrier-grade NAT mappings alive. 0 disables it.
+func SetUDPKeepAlive(interval int32) {
+	if interval <= 0 {
+		storeDuration(&udpKeepAliveInterval, 0)
+	} else {
+		storeDuration(&udpKeepAliveInterval, time.Duration(interval)*time.Second)
+	}
+}
+
+var connIdleTimeout time.Duration
+
+// SetConnIdleTimeout makes protected connections close themselves after timeout seconds
+// without reads or writes, reclaiming stalled flows. 0 disables it. Only connections
+// opened afterwards are affected.
+func SetConnIdleTimeout(timeout int32) {
+	if timeout <= 0 {
+		storeDuration(&connIdleTimeout, 0)
+	} else {
+		storeDuration(&connIdleTimeout, time.Duration(timeout)*time.Second)
+	}
+}
+
+var strictSockopt uint32
+
+// SetStrictSockopt makes protected dials fail when the socket options of v2ray-core
+// cannot be applied, instead of only logging it.
+func SetStrictSockopt(strict bool) {
+	storeBool(&strictSockopt, strict)
+}
+
+var tcpFastOpen uint32
+
+// SetTCPFastOpen makes protected TCP dials send the first write with the SYN when the kernel
+// supports it, saving a round trip to servers seen before. It has no effect on UDP.
+func SetTCPFastOpen(enabled bool) {
+	storeBool(&tcpFastOpen, enabled)
+}
+
+const (
+	// DialStrategyPreferredFamilyFirst dials the preferred address family first and races
+	// the other one shortly after, as in RFC 8305.
+	DialStrategyPreferredFamilyFirst = iota
+	// DialStrategySequential dials the addresses one after another.
+	DialStrategySequential
+	// DialStrategyParallelAll dials all addresses at once and keeps the first connected.
+	DialStrategyParallelAll
+)
+
+var dialStrategy int32 = DialStrategyPreferredFamilyFirst
+
+// SetDialStrategy sets how protected dials try the addresses of a destination, one of the
+// DialStrategy constants.
+func SetDialStrategy(strategy int32) error {
+	if strategy < DialStrategyPreferredFamilyFirst || strategy > DialStrategyParallelAll {
+		return newError("invalid dial strategy ", strategy)
+	}
+	atomic.StoreInt32(&dialStrategy, strategy)
+	return nil
+}
+
+const defaultMaxDialCandidates = 8
+
+var maxDialCandidates int32 = defaultMaxDialCandidates
+
+// SetMaxDialCandidates limits how many of the resolved addresses of a destination protected
+// dials try, in order of preference, 8 by default. 0 tries all of them.
+func SetMaxDialCandidates(n int32) {
+	if n < 0 {
+		n = 0
+	}
+	atomic.StoreInt32(&maxDialCandidates, n)
+}
+
+// lastDialFamily is the IP version of the last successful protected dial, 0 if none.
+var lastDialFamily uint32
+
+// LastDialFamily returns the address family of the last successful protected dial,
+// "v4", "v6" or empty if nothing was dialed yet.
+func LastDialFamily() string {
+	switch atomic.LoadUint32(&lastDialFamily) {
+	case 4:
+		return "v4"
+	case 6:
+		return "v6"
+	default:
+		return ""
+	}
+}
+
+var tcpNoDelay uint32 = 1
+
+// SetTcpNoDelay sets TCP_NODELAY on protected TCP sockets, it is enabled by default as in Go.
+func SetTcpNoDelay(enabled bool) {
+	storeBool(&tcpNoDelay, enabled)
+}
+
+var socketSendBuffer, socketReceiveBuffer int32
+
+// SetSocketBuffers sets the send and receive buffer sizes of protected sockets in bytes,
+// zero values leave the kernel autotuning.
+func SetSocketBuffers(send int32, receive int32) {
+	atomic.StoreInt32(&socketSendBuffer, send)
+	atomic.StoreInt32(&socketReceiveBuffer, receive)
+}
+
+var udpReadBuffer int32
+
+// SetUDPReadBuffer sets the receive buffer size in bytes of protected UDP sockets, dialed or
+// listening, taking precedence over SetSocketBuffers for them. 0 disables it.
+func SetUDPReadBuffer(size int32) {
+	atomic.StoreInt32(&udpReadBuffer, size)
+}
+
+var dscp int32
+
+// SetDSCP sets the DSCP class (0-63) of protected sockets, 0 leaves them unmarked.
+func SetDSCP(value int32) error {
+	if value < 0 || value > 63 {
+		return newError("invalid dscp ", value)
+	}
+	atomic.StoreInt32(&dscp, value)
+	return nil
 }
 
 const (
@@ -0,0 +1,42 @@
+package libcore
+
+import (
+	"encoding/json"
+	"os"
+	"runtime"
+)
+
+type diagnosticsInfo struct {
+	Goroutines        int   `json:"goroutines"`
+	FDs               int   `json:"fds"`
+	ActiveConnections int32 `json:"activeConnections"`
+	DNSCacheEntries   int32 `json:"dnsCacheEntries"`
+}
+
+// Diagnostics returns a JSON object with the counters useful to spot leaks: the number of
+// goroutines, of open file descriptors (-1 if unknown), of connections made by the
+// protected dialer still open and of answers the DNS caches would serve. It only reads
+// counters and walks the bounded caches, so it is cheap enough to poll.
+func Diagnostics() string {
+	content, _ := json.Marshal(diagnosticsInfo{
+		Goroutines:        runtime.NumGoroutine(),
+		FDs:               openFDs(),
+		ActiveConnections: ActiveConnections(),
+		DNSCacheEntries:   dnsCacheSize(),
+	})
+	return string(content)
+}
+
+// openFDs counts the entries of /proc/self/fd, excluding the one opened to list it.
+func openFDs() int {
+	dir, err := os.Open("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return -1
+	}
+	return len(names) - 1
+}
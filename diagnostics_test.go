@@ -0,0 +1,36 @@
+package libcore
+
+import (
+	"encoding/json"
+	"net"
+	"runtime"
+	"testing"
+)
+
+func TestDiagnosticsCountsFDs(t *testing.T) {
+	diagnostics := func() diagnosticsInfo {
+		var info diagnosticsInfo
+		if err := json.Unmarshal([]byte(Diagnostics()), &info); err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+	before := diagnostics()
+	if before.FDs < 0 {
+		t.Skip("open fds are unknown on ", runtime.GOOS)
+	}
+	if before.Goroutines <= 0 {
+		t.Fatal("unexpected goroutines ", before.Goroutines)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if open := diagnostics().FDs; open != before.FDs+1 {
+		t.Fatal(open, " fds with a socket open, ", before.FDs, " before")
+	}
+	conn.Close()
+	if closed := diagnostics().FDs; closed != before.FDs {
+		t.Fatal(closed, " fds after closing the socket, ", before.FDs, " before")
+	}
+}
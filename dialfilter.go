@@ -0,0 +1,111 @@
+package libcore
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrBlocked is returned by protected dials whose addresses are all denied by SetDialFilter.
+var ErrBlocked = errors.New("destination blocked by dial filter")
+
+type dialFilterRule struct {
+	allow   bool
+	network *net.IPNet
+	portMin uint16
+	portMax uint16
+}
+
+var (
+	dialFilterAccess sync.RWMutex
+	dialFilterRules  []dialFilterRule
+)
+
+// SetDialFilter sets the egress rules of protected dials, from a JSON array of objects with
+// an action ("allow" or "deny"), an optional cidr and an optional port or port range such as
+// "443" or "8000-9000". Resolved addresses are checked against the rules in order, the first
+// matching one deciding, and addresses matching none are allowed. Empty removes the rules.
+func SetDialFilter(rulesJson string) error {
+	var entries []struct {
+		Action string `json:"action"`
+		CIDR   string `json:"cidr"`
+		Ports  string `json:"ports"`
+	}
+	if rulesJson != "" {
+		err := json.Unmarshal([]byte(rulesJson), &entries)
+		if err != nil {
+			return newError("failed to parse dial filter").Base(err)
+		}
+	}
+	rules := make([]dialFilterRule, 0, len(entries))
+	for _, entry := range entries {
+		rule := dialFilterRule{portMax: 65535}
+		switch entry.Action {
+		case "allow":
+			rule.allow = true
+		case "deny":
+		default:
+			return newError("invalid dial filter action ", entry.Action)
+		}
+		if entry.CIDR != "" {
+			_, network, err := net.ParseCIDR(entry.CIDR)
+			if err != nil {
+				return newError("invalid dial filter cidr ", entry.CIDR).Base(err)
+			}
+			rule.network = network
+		}
+		if entry.Ports != "" {
+			minPort, maxPort, found := strings.Cut(entry.Ports, "-")
+			if !found {
+				maxPort = minPort
+			}
+			portMin, err := strconv.ParseUint(strings.TrimSpace(minPort), 10, 16)
+			if err != nil {
+				return newError("invalid dial filter ports ", entry.Ports)
+			}
+			portMax, err := strconv.ParseUint(strings.TrimSpace(maxPort), 10, 16)
+			if err != nil || portMax < portMin {
+				return newError("invalid dial filter ports ", entry.Ports)
+			}
+			rule.portMin, rule.portMax = uint16(portMin), uint16(portMax)
+		}
+		rules = append(rules, rule)
+	}
+	dialFilterAccess.Lock()
+	dialFilterRules = rules
+	dialFilterAccess.Unlock()
+	return nil
+}
+
+func dialAllowed(ip net.IP, port uint16) bool {
+	dialFilterAccess.RLock()
+	defer dialFilterAccess.RUnlock()
+	for _, rule := range dialFilterRules {
+		if port < rule.portMin || port > rule.portMax {
+			continue
+		}
+		if rule.network != nil && !rule.network.Contains(ip) {
+			continue
+		}
+		return rule.allow
+	}
+	return true
+}
+
+// filterBlocked drops the addresses denied by the dial filter for port.
+func filterBlocked(ips []net.IP, port uint16) []net.IP {
+	allowed := ips[:0:0]
+	for _, ip := range ips {
+		if dialAllowed(ip, port) {
+			allowed = append(allowed, ip)
+		} else {
+			logrus.Debug("dial to ", net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), " blocked by dial filter")
+		}
+	}
+	return allowed
+}
@@ -0,0 +1,90 @@
+package libcore
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+)
+
+func TestDialFilter(t *testing.T) {
+	defer resetOptions()
+	err := SetDialFilter(`[
+		{"action": "allow", "cidr": "10.0.0.53/32", "ports": "53"},
+		{"action": "deny", "cidr": "10.0.0.0/8"},
+		{"action": "deny", "ports": "25"},
+		{"action": "deny", "cidr": "2001:db8::/32", "ports": "8000-9000"}
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		ip      string
+		port    uint16
+		allowed bool
+	}{
+		// the first matching rule decides
+		{"10.0.0.53", 53, true},
+		{"10.0.0.53", 80, false},
+		{"10.1.2.3", 443, false},
+		// port only rules match every address
+		{"192.0.2.1", 25, false},
+		{"2001:db8::1", 25, false},
+		// port ranges are inclusive
+		{"2001:db8::1", 7999, true},
+		{"2001:db8::1", 8000, false},
+		{"2001:db8::1", 9000, false},
+		{"2001:db8::1", 9001, true},
+		// addresses matching no rule are allowed
+		{"192.0.2.1", 443, true},
+		{"2001:db9::1", 8080, true},
+	} {
+		if allowed := dialAllowed(net.ParseIP(test.ip), test.port); allowed != test.allowed {
+			t.Fatal(test.ip, " port ", test.port, " allowed ", allowed, ", expected ", test.allowed)
+		}
+	}
+
+	dialer := protectedDialer{
+		protector: noopProtectorInstance,
+		resolver: func(ctx context.Context, domain string) ([]net.IP, error) {
+			return []net.IP{net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)}, nil
+		},
+	}
+	for _, address := range []v2rayNet.Address{v2rayNet.DomainAddress("blocked.test"), v2rayNet.IPAddress(net.IPv4(10, 0, 0, 1))} {
+		_, err = dialer.Dial(context.Background(), nil, v2rayNet.TCPDestination(address, 443), nil)
+		if !errors.Is(err, ErrBlocked) {
+			t.Fatal(address, ": unexpected error ", err)
+		}
+	}
+
+	if err = SetDialFilter(""); err != nil {
+		t.Fatal(err)
+	}
+	if !dialAllowed(net.IPv4(10, 0, 0, 1), 443) {
+		t.Fatal("blocked without rules")
+	}
+}
+
+func TestSetDialFilterInvalid(t *testing.T) {
+	defer resetOptions()
+	if err := SetDialFilter(`[{"action": "deny", "ports": "25"}]`); err != nil {
+		t.Fatal(err)
+	}
+	for _, rules := range []string{
+		`{"action": "deny"}`,
+		`[{"action": "block"}]`,
+		`[{"action": "deny", "cidr": "10.0.0.0"}]`,
+		`[{"action": "deny", "ports": "65536"}]`,
+		`[{"action": "deny", "ports": "9000-8000"}]`,
+		`[{"action": "deny", "ports": "http"}]`,
+	} {
+		if err := SetDialFilter(rules); err == nil {
+			t.Fatal("accepted ", rules)
+		}
+	}
+	if dialAllowed(net.IPv4(192, 0, 2, 1), 25) {
+		t.Fatal("invalid rules replaced the filter")
+	}
+}
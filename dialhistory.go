@@ -0,0 +1,56 @@
+package libcore
+
+import (
+	"sync"
+	"time"
+)
+
+// dialHistoryTTL is how long IPv4 is tried first for a domain after IPv6 failed.
+const dialHistoryTTL = time.Minute
+
+var (
+	dialHistoryAccess sync.Mutex
+	// ipv6Failures maps domains to the time dialing them over IPv6 last failed.
+	ipv6Failures = make(map[string]time.Time)
+)
+
+// ClearDialHistory forgets the domains IPv6 recently failed for.
+func ClearDialHistory() {
+	dialHistoryAccess.Lock()
+	ipv6Failures = make(map[string]time.Time)
+	dialHistoryAccess.Unlock()
+}
+
+func ipv6RecentlyFailed(domain string) bool {
+	dialHistoryAccess.Lock()
+	defer dialHistoryAccess.Unlock()
+	failedAt, loaded := ipv6Failures[domain]
+	if !loaded {
+		return false
+	}
+	if clk.Now().Sub(failedAt) > dialHistoryTTL {
+		delete(ipv6Failures, domain)
+		return false
+	}
+	return true
+}
+
+func recordIPv6Failure(domain string) {
+	dialHistoryAccess.Lock()
+	defer dialHistoryAccess.Unlock()
+	now := clk.Now()
+	if len(ipv6Failures) >= 256 {
+		for key, failedAt := range ipv6Failures {
+			if now.Sub(failedAt) > dialHistoryTTL {
+				delete(ipv6Failures, key)
+			}
+		}
+	}
+	ipv6Failures[domain] = now
+}
+
+func recordIPv6Success(domain string) {
+	dialHistoryAccess.Lock()
+	delete(ipv6Failures, domain)
+	dialHistoryAccess.Unlock()
+}
@@ -0,0 +1,110 @@
+//go:build linux || android
+
+package libcore
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// connectOrderObserver records the addresses dials connected to, in order.
+type connectOrderObserver struct {
+	access sync.Mutex
+	starts []string
+}
+
+func (o *connectOrderObserver) OnResolve(domain string, ips string, ms int32) {
+}
+
+func (o *connectOrderObserver) OnConnectStart(addr string) {
+	o.access.Lock()
+	o.starts = append(o.starts, addr)
+	o.access.Unlock()
+}
+
+func (o *connectOrderObserver) OnConnectDone(addr string, ms int32, err string) {
+}
+
+// firstStart returns the address the last dial connected to first, forgetting the others.
+func (o *connectOrderObserver) firstStart() string {
+	o.access.Lock()
+	defer o.access.Unlock()
+	var first string
+	if len(o.starts) > 0 {
+		first = o.starts[0]
+	}
+	o.starts = nil
+	return first
+}
+
+func TestDialHistoryReordersFamilies(t *testing.T) {
+	defer resetOptions()
+	// listening on IPv4 only, so that dialing the IPv6 loopback is refused
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	if err = SetHosts(`{"history.test": ["::1", "127.0.0.1"]}`); err != nil {
+		t.Fatal(err)
+	}
+	SetIPv6Mode(IPv6ModePrefer)
+	observer := &connectOrderObserver{}
+	SetDialObserver(observer)
+	dial := func() string {
+		conn, err := DialProtected("tcp", "history.test:"+port, 3000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		return observer.firstStart()
+	}
+
+	if first := dial(); first != "[::1]:"+port {
+		t.Fatal("first dial started with ", first)
+	}
+	// IPv6 failed, so IPv4 goes first
+	if first := dial(); first != "127.0.0.1:"+port {
+		t.Fatal("dial after the ipv6 failure started with ", first)
+	}
+	if !ipv6RecentlyFailed("history.test") {
+		t.Fatal("ipv6 failure forgotten after an ipv4 first dial")
+	}
+	ClearDialHistory()
+	if first := dial(); first != "[::1]:"+port {
+		t.Fatal("dial after clearing the history started with ", first)
+	}
+}
+
+func TestDialHistoryExpires(t *testing.T) {
+	defer ClearDialHistory()
+	fake := useFakeClock(t)
+	recordIPv6Failure("expiring.test")
+	fake.Advance(dialHistoryTTL - time.Second)
+	if !ipv6RecentlyFailed("expiring.test") {
+		t.Fatal("ipv6 failure forgotten before the ttl")
+	}
+	fake.Advance(2 * time.Second)
+	if ipv6RecentlyFailed("expiring.test") {
+		t.Fatal("ipv6 failure kept after the ttl")
+	}
+
+	recordIPv6Failure("recovered.test")
+	recordIPv6Success("recovered.test")
+	if ipv6RecentlyFailed("recovered.test") {
+		t.Fatal("ipv6 failure kept after a success")
+	}
+}
@@ -0,0 +1,90 @@
+package libcore
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+)
+
+type dialLogEntry struct {
+	Time        time.Time `json:"time"`
+	Destination string    `json:"destination"`
+	Address     string    `json:"address,omitempty"`
+	Duration    int64     `json:"duration"`
+	Error       string    `json:"error,omitempty"`
+}
+
+var (
+	dialLogAccess sync.Mutex
+	// dialLog is a ring of the last protected dials, the oldest at dialLogStart.
+	dialLog      []dialLogEntry
+	dialLogStart int
+	dialLogSize  int
+)
+
+// SetDialLogCapacity keeps the last n protected dials in memory for DumpDialLog, keeping
+// the most recent ones already recorded. 0 disables it.
+func SetDialLogCapacity(n int32) error {
+	if n < 0 {
+		return newError("invalid dial log capacity ", n)
+	}
+	dialLogAccess.Lock()
+	defer dialLogAccess.Unlock()
+	entries := orderedDialLog()
+	if len(entries) > int(n) {
+		entries = entries[len(entries)-int(n):]
+	}
+	dialLog = make([]dialLogEntry, n)
+	dialLogStart = 0
+	dialLogSize = copy(dialLog, entries)
+	return nil
+}
+
+// DumpDialLog returns the dials kept by SetDialLogCapacity as a JSON array, oldest first.
+// Each entry has the time, the destination, the address connected to on success or the
+// error otherwise, and the milliseconds the dial took.
+func DumpDialLog() string {
+	dialLogAccess.Lock()
+	entries := orderedDialLog()
+	dialLogAccess.Unlock()
+	content, _ := json.Marshal(entries)
+	return string(content)
+}
+
+// orderedDialLog copies the ring oldest first, dialLogAccess must be held.
+func orderedDialLog() []dialLogEntry {
+	entries := make([]dialLogEntry, 0, dialLogSize)
+	for i := 0; i < dialLogSize; i++ {
+		entries = append(entries, dialLog[(dialLogStart+i)%len(dialLog)])
+	}
+	return entries
+}
+
+// logDial records a dial started at start, overwriting the oldest entry when full.
+func logDial(destination v2rayNet.Destination, start time.Time, conn net.Conn, err error) {
+	dialLogAccess.Lock()
+	defer dialLogAccess.Unlock()
+	if len(dialLog) == 0 {
+		return
+	}
+	entry := dialLogEntry{
+		Time:        start,
+		Destination: destination.String(),
+		Duration:    clk.Now().Sub(start).Milliseconds(),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	} else if conn != nil {
+		entry.Address = conn.RemoteAddr().String()
+	}
+	if dialLogSize < len(dialLog) {
+		dialLog[(dialLogStart+dialLogSize)%len(dialLog)] = entry
+		dialLogSize++
+	} else {
+		dialLog[dialLogStart] = entry
+		dialLogStart = (dialLogStart + 1) % len(dialLog)
+	}
+}
@@ -0,0 +1,96 @@
+package libcore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+)
+
+// dialLogPorts returns the ports of the destinations in the dial log, oldest first.
+func dialLogPorts(t *testing.T) []int {
+	var entries []dialLogEntry
+	if err := json.Unmarshal([]byte(DumpDialLog()), &entries); err != nil {
+		t.Fatal(err)
+	}
+	ports := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		destination, err := v2rayNet.ParseDestination(entry.Destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports = append(ports, int(destination.Port))
+	}
+	return ports
+}
+
+func logDials(from, to int) {
+	for port := from; port <= to; port++ {
+		logDial(v2rayNet.TCPDestination(v2rayNet.LocalHostIP, v2rayNet.Port(port)), clk.Now(), nil, errors.New("refused"))
+	}
+}
+
+func TestDialLog(t *testing.T) {
+	defer resetOptions()
+	logDials(1, 2)
+	if ports := dialLogPorts(t); len(ports) != 0 {
+		t.Fatal("logged ", ports, " while disabled")
+	}
+
+	if err := SetDialLogCapacity(3); err != nil {
+		t.Fatal(err)
+	}
+	logDials(1, 2)
+	if ports := fmt.Sprint(dialLogPorts(t)); ports != "[1 2]" {
+		t.Fatal("logged ", ports)
+	}
+	// the oldest entries are evicted
+	logDials(3, 7)
+	if ports := fmt.Sprint(dialLogPorts(t)); ports != "[5 6 7]" {
+		t.Fatal("logged ", ports)
+	}
+	var entries []dialLogEntry
+	_ = json.Unmarshal([]byte(DumpDialLog()), &entries)
+	if entries[0].Error != "refused" || entries[0].Address != "" {
+		t.Fatalf("unexpected entry %+v", entries[0])
+	}
+
+	// resizing keeps the most recent entries
+	if err := SetDialLogCapacity(2); err != nil {
+		t.Fatal(err)
+	}
+	if ports := fmt.Sprint(dialLogPorts(t)); ports != "[6 7]" {
+		t.Fatal("kept ", ports)
+	}
+	if err := SetDialLogCapacity(4); err != nil {
+		t.Fatal(err)
+	}
+	logDials(8, 10)
+	if ports := fmt.Sprint(dialLogPorts(t)); ports != "[7 8 9 10]" {
+		t.Fatal("logged ", ports)
+	}
+
+	var wait sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			logDials(100, 200)
+			DumpDialLog()
+		}()
+	}
+	wait.Wait()
+	if ports := dialLogPorts(t); len(ports) != 4 {
+		t.Fatal("logged ", len(ports), " entries with a capacity of 4")
+	}
+
+	if err := SetDialLogCapacity(-1); err == nil {
+		t.Fatal("accepted a negative capacity")
+	}
+	if err := SetDialLogCapacity(0); err != nil || DumpDialLog() != "[]" {
+		t.Fatal("dial log not cleared: ", DumpDialLog())
+	}
+}
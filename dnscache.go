@@ -0,0 +1,232 @@
+package libcore
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultDNSCacheMinTTL = 0
+	defaultDNSCacheMaxTTL = time.Hour
+	// unknownDNSTTL is cached for the answers of resolvers not reporting TTL.
+	unknownDNSTTL = time.Minute
+)
+
+var (
+	dnsCacheMinTTL time.Duration = defaultDNSCacheMinTTL
+	dnsCacheMaxTTL               = defaultDNSCacheMaxTTL
+
+	// dnsCacheGeneration is increased by FlushDNSCache, invalidating the answers of lookups
+	// still in flight.
+	dnsCacheGeneration uint32
+
+	// dnsCaches holds the caches of the live cached resolvers, each removed by a finalizer
+	// once its resolver is unreachable.
+	dnsCachesAccess sync.Mutex
+	dnsCaches       = make(map[*dnsCache]struct{})
+)
+
+// SetDNSCacheTTL clamps the TTL of cached answers between min and max seconds,
+// a negative value restores the default.
+func SetDNSCacheTTL(min int32, max int32) {
+	if min < 0 {
+		storeDuration(&dnsCacheMinTTL, defaultDNSCacheMinTTL)
+	} else {
+		storeDuration(&dnsCacheMinTTL, time.Duration(min)*time.Second)
+	}
+	if max < 0 {
+		storeDuration(&dnsCacheMaxTTL, defaultDNSCacheMaxTTL)
+	} else {
+		storeDuration(&dnsCacheMaxTTL, time.Duration(max)*time.Second)
+	}
+}
+
+// FlushDNSCache drops the answers cached by all resolvers created by NewCachedResolver.
+func FlushDNSCache() {
+	atomic.AddUint32(&dnsCacheGeneration, 1)
+	dnsCachesAccess.Lock()
+	defer dnsCachesAccess.Unlock()
+	for cache := range dnsCaches {
+		cache.access.Lock()
+		cache.entries = make(map[dnsCacheKey]*list.Element)
+		cache.lru.Init()
+		cache.access.Unlock()
+	}
+}
+
+// dnsCacheSize counts the answers the cached resolvers would still serve.
+func dnsCacheSize() int32 {
+	generation := atomic.LoadUint32(&dnsCacheGeneration)
+	now := clk.Now()
+	dnsCachesAccess.Lock()
+	defer dnsCachesAccess.Unlock()
+	var size int32
+	for cache := range dnsCaches {
+		cache.access.Lock()
+		for element := cache.lru.Front(); element != nil; element = element.Next() {
+			entry := element.Value.(*dnsCacheEntry)
+			if entry.generation == generation && entry.expire.After(now) {
+				size++
+			}
+		}
+		cache.access.Unlock()
+	}
+	return size
+}
+
+type dnsCacheKey struct {
+	network string
+	domain  string
+}
+
+type dnsCacheEntry struct {
+	key        dnsCacheKey
+	ips        []net.IP
+	expire     time.Time
+	generation uint32
+}
+
+type dnsCacheCall struct {
+	done chan struct{}
+	ips  []net.IP
+	ttl  time.Duration
+	err  error
+}
+
+// cachedResolver caches the answers of another resolver by their TTL, evicting the least
+// recently used entries at capacity. Concurrent lookups of the same domain share one query.
+type cachedResolver struct {
+	inner      func(ctx context.Context, network string, domain string) ([]net.IP, time.Duration, error)
+	maxEntries int
+	*dnsCache
+}
+
+// dnsCache is the state of a cachedResolver, apart so that dnsCaches does not keep the
+// resolver alive.
+type dnsCache struct {
+	access  sync.Mutex
+	entries map[dnsCacheKey]*list.Element
+	lru     *list.List
+	calls   map[dnsCacheKey]*dnsCacheCall
+}
+
+// NewCachedResolver creates a resolver caching at most maxEntries answers of inner.
+func NewCachedResolver(inner Resolver, maxEntries int32) (Resolver, error) {
+	if inner == nil {
+		return nil, newError("nil resolver")
+	}
+	if maxEntries <= 0 {
+		return nil, newError("invalid max entries ", maxEntries)
+	}
+	resolver := &cachedResolver{
+		maxEntries: int(maxEntries),
+		dnsCache: &dnsCache{
+			entries: make(map[dnsCacheKey]*list.Element),
+			lru:     list.New(),
+			calls:   make(map[dnsCacheKey]*dnsCacheCall),
+		},
+	}
+	dnsCachesAccess.Lock()
+	dnsCaches[resolver.dnsCache] = struct{}{}
+	dnsCachesAccess.Unlock()
+	runtime.SetFinalizer(resolver, func(resolver *cachedResolver) {
+		dnsCachesAccess.Lock()
+		delete(dnsCaches, resolver.dnsCache)
+		dnsCachesAccess.Unlock()
+	})
+	switch inner := inner.(type) {
+	case ttlResolver:
+		resolver.inner = inner.lookupIPTTL
+	case contextResolver:
+		resolver.inner = func(ctx context.Context, network string, domain string) ([]net.IP, time.Duration, error) {
+			ips, err := inner.lookupIP(ctx, network, domain)
+			return ips, unknownDNSTTL, err
+		}
+	default:
+		resolver.inner = func(ctx context.Context, network string, domain string) ([]net.IP, time.Duration, error) {
+			ips, err := lookupResolver(ctx, inner, network, domain)
+			return ips, unknownDNSTTL, err
+		}
+	}
+	return resolver, nil
+}
+
+func (r *cachedResolver) LookupIP(network string, domain string) ([]byte, error) {
+	ctx, cancel := withTimeout(context.Background(), loadDuration(&resolveTimeout))
+	defer cancel()
+	ips, err := r.lookupIP(ctx, network, domain)
+	if err != nil {
+		return nil, err
+	}
+	return encodeIPs(ips), nil
+}
+
+func (r *cachedResolver) lookupIP(ctx context.Context, network string, domain string) ([]net.IP, error) {
+	ips, _, err := r.lookupIPTTL(ctx, network, domain)
+	return ips, err
+}
+
+// lookupIPTTL returns the cached answer with its remaining TTL, the returned slice must
+// not be modified.
+func (r *cachedResolver) lookupIPTTL(ctx context.Context, network string, domain string) ([]net.IP, time.Duration, error) {
+	key := dnsCacheKey{network, normalizeDomain(domain)}
+	generation := atomic.LoadUint32(&dnsCacheGeneration)
+
+	r.access.Lock()
+	if element, loaded := r.entries[key]; loaded {
+		entry := element.Value.(*dnsCacheEntry)
+		if remaining := entry.expire.Sub(clk.Now()); remaining > 0 && entry.generation == generation {
+			r.lru.MoveToFront(element)
+			r.access.Unlock()
+			return entry.ips, remaining, nil
+		}
+		r.lru.Remove(element)
+		delete(r.entries, key)
+	}
+	if call, loaded := r.calls[key]; loaded {
+		r.access.Unlock()
+		select {
+		case <-call.done:
+			return call.ips, call.ttl, call.err
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}
+	call := &dnsCacheCall{done: make(chan struct{})}
+	r.calls[key] = call
+	r.access.Unlock()
+
+	ips, ttl, err := r.inner(ctx, network, domain)
+	if minTTL := loadDuration(&dnsCacheMinTTL); ttl < minTTL {
+		ttl = minTTL
+	}
+	if maxTTL := loadDuration(&dnsCacheMaxTTL); ttl > maxTTL {
+		ttl = maxTTL
+	}
+	call.ips, call.ttl, call.err = ips, ttl, err
+
+	r.access.Lock()
+	delete(r.calls, key)
+	// answers of lookups started before a flush are not cached
+	if err == nil && ttl > 0 && generation == atomic.LoadUint32(&dnsCacheGeneration) {
+		r.entries[key] = r.lru.PushFront(&dnsCacheEntry{
+			key:        key,
+			ips:        ips,
+			expire:     clk.Now().Add(ttl),
+			generation: generation,
+		})
+		for r.lru.Len() > r.maxEntries {
+			oldest := r.lru.Back()
+			r.lru.Remove(oldest)
+			delete(r.entries, oldest.Value.(*dnsCacheEntry).key)
+		}
+	}
+	r.access.Unlock()
+	close(call.done)
+	return ips, ttl, err
+}
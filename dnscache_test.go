@@ -0,0 +1,219 @@
+package libcore
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func diagnosedDNSCacheEntries(t *testing.T) int32 {
+	var info diagnosticsInfo
+	if err := json.Unmarshal([]byte(Diagnostics()), &info); err != nil {
+		t.Fatal(err)
+	}
+	return info.DNSCacheEntries
+}
+
+func TestDNSCacheEntries(t *testing.T) {
+	defer resetOptions()
+	fake := useFakeClock(t)
+	inner := &countingResolver{lookups: make(map[string]int)}
+	resolver, err := NewCachedResolver(inner, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := diagnosedDNSCacheEntries(t)
+	lookup := func(domain string) {
+		if _, err := resolver.LookupIP("ip", domain); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(entries int32) {
+		t.Helper()
+		if n := diagnosedDNSCacheEntries(t) - base; n != entries {
+			t.Fatal(n, " dns cache entries, expected ", entries)
+		}
+	}
+
+	lookup("a.example")
+	lookup("a.example")
+	expect(1)
+	lookup("b.example")
+	lookup("c.example")
+	// evicted at capacity
+	expect(2)
+
+	fake.Advance(unknownDNSTTL)
+	expect(0)
+	lookup("a.example")
+	expect(1)
+
+	FlushDNSCache()
+	expect(0)
+	lookup("b.example")
+	expect(1)
+	if n := inner.count("b.example"); n != 2 {
+		t.Fatal(n, " lookups of b.example after the flush")
+	}
+}
+
+func TestDNSCacheEntriesDropWithResolver(t *testing.T) {
+	inner := &countingResolver{lookups: make(map[string]int)}
+	resolver, err := NewCachedResolver(inner, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runtime.GC()
+	base := diagnosedDNSCacheEntries(t)
+	for _, domain := range []string{"a.example", "b.example"} {
+		if _, err := resolver.LookupIP("ip", domain); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := diagnosedDNSCacheEntries(t) - base; n != 2 {
+		t.Fatal(n, " dns cache entries, expected 2")
+	}
+	resolver = nil
+	// finalizers run after the collection, in their own goroutine
+	for i := 0; i < 100; i++ {
+		runtime.GC()
+		if diagnosedDNSCacheEntries(t) == base {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("entries of an unreachable resolver still counted")
+}
+
+// ttlTestResolver answers every domain with 192.0.2.1 and ttl once release is closed,
+// counting its lookups.
+type ttlTestResolver struct {
+	ttl     time.Duration
+	release chan struct{}
+	lookups int32
+}
+
+func (r *ttlTestResolver) LookupIP(network string, domain string) ([]byte, error) {
+	ips, _, err := r.lookupIPTTL(context.Background(), network, domain)
+	return encodeIPs(ips), err
+}
+
+func (r *ttlTestResolver) lookupIPTTL(ctx context.Context, network string, domain string) ([]net.IP, time.Duration, error) {
+	atomic.AddInt32(&r.lookups, 1)
+	if r.release != nil {
+		<-r.release
+	}
+	return []net.IP{net.IPv4(192, 0, 2, 1)}, r.ttl, nil
+}
+
+func TestCachedResolverTTL(t *testing.T) {
+	defer resetOptions()
+	fake := useFakeClock(t)
+	for _, test := range []struct {
+		ttl, min, max, expire int32
+	}{
+		{30, -1, -1, 30},
+		// clamped up and down
+		{30, 60, -1, 60},
+		{3600, -1, 120, 120},
+	} {
+		SetDNSCacheTTL(test.min, test.max)
+		inner := &ttlTestResolver{ttl: time.Duration(test.ttl) * time.Second}
+		resolver, err := NewCachedResolver(inner, 16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cached := resolver.(*cachedResolver)
+		lookup := func() time.Duration {
+			t.Helper()
+			_, ttl, err := cached.lookupIPTTL(context.Background(), "ip", "ttl.example")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ttl
+		}
+		lookup()
+		fake.Advance(time.Duration(test.expire-1) * time.Second)
+		if ttl := lookup(); ttl != time.Second {
+			t.Fatalf("%+v: remaining ttl %v", test, ttl)
+		}
+		if n := atomic.LoadInt32(&inner.lookups); n != 1 {
+			t.Fatalf("%+v: %d lookups before expiry", test, n)
+		}
+		fake.Advance(time.Second)
+		lookup()
+		if n := atomic.LoadInt32(&inner.lookups); n != 2 {
+			t.Fatalf("%+v: %d lookups after expiry", test, n)
+		}
+	}
+
+	// a zero ttl is not cached
+	SetDNSCacheTTL(-1, -1)
+	inner := &ttlTestResolver{}
+	resolver, _ := NewCachedResolver(inner, 16)
+	for i := 0; i < 2; i++ {
+		if _, err := resolver.LookupIP("ip", "ttl.example"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&inner.lookups); n != 2 {
+		t.Fatal(n, " lookups of an answer with a zero ttl")
+	}
+}
+
+func TestCachedResolverCoalescing(t *testing.T) {
+	// answers with a zero ttl are not cached, only coalesced
+	inner := &ttlTestResolver{release: make(chan struct{})}
+	resolver, err := NewCachedResolver(inner, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			_, err := resolver.LookupIP("ip", "coalesced.example")
+			errs <- err
+		}()
+	}
+	// let the lookups join the one in flight
+	time.Sleep(50 * time.Millisecond)
+	close(inner.release)
+	for i := 0; i < 5; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&inner.lookups); n != 1 {
+		t.Fatal(n, " lookups for concurrent queries")
+	}
+	// the families are cached apart
+	if _, err = resolver.LookupIP("ip4", "coalesced.example"); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&inner.lookups); n != 2 {
+		t.Fatal(n, " lookups with another family")
+	}
+}
+
+func TestCachedResolverEvictsLeastRecentlyUsed(t *testing.T) {
+	inner := &countingResolver{lookups: make(map[string]int)}
+	resolver, err := NewCachedResolver(inner, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, domain := range []string{"a.example", "b.example", "a.example", "c.example", "a.example", "b.example"} {
+		if _, err = resolver.LookupIP("ip", domain); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// b was the least recently used when c was added
+	for domain, lookups := range map[string]int{"a.example": 1, "b.example": 2, "c.example": 1} {
+		if n := inner.count(domain); n != lookups {
+			t.Fatal(domain, " looked up ", n, " times, expected ", lookups)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package libcore
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/features/dns"
+	"golang.org/x/net/dns/dnsmessage"
+	"libcore/comm"
+)
+
+// exchangeFunc sends a wire format DNS query and returns the response.
+type exchangeFunc func(ctx context.Context, query []byte) ([]byte, error)
+
+const (
+	// ednsUDPSize is the UDP payload size advertised with EDNS, as recommended by the
+	// DNS flag day 2020.
+	ednsUDPSize = 1232
+	// ednsOptionClientSubnet is the option code of RFC 7871.
+	ednsOptionClientSubnet = 8
+)
+
+// ednsClientSubnet is the data of the client subnet option sent with address queries,
+// nil disables it.
+var ednsClientSubnet atomic.Value
+
+// SetEdnsClientSubnet makes the DNS clients of libcore send cidr as the EDNS client subnet
+// of their address queries, so that CDNs answer for the location of the exit rather than
+// of the device. An address without a prefix length is sent as its /24 or /56, the
+// lengths RFC 7871 recommends for privacy. Empty disables it.
+func SetEdnsClientSubnet(cidr string) error {
+	if cidr == "" {
+		ednsClientSubnet.Store([]byte(nil))
+		return nil
+	}
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return newError("invalid client subnet ", cidr)
+		}
+		if ip.To4() != nil {
+			cidr += "/24"
+		} else {
+			cidr += "/56"
+		}
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return newError("invalid client subnet ", cidr).Base(err)
+	}
+	family, address := uint16(2), network.IP.To16()
+	if ip4 := network.IP.To4(); ip4 != nil {
+		family, address = 1, ip4
+	}
+	prefix, _ := network.Mask.Size()
+	option := make([]byte, 4, 4+(prefix+7)/8)
+	binary.BigEndian.PutUint16(option, family)
+	option[2] = byte(prefix)
+	// the scope prefix length is 0 in queries, and ParseCIDR zeroed the bits after prefix
+	ednsClientSubnet.Store(append(option, address[:(prefix+7)/8]...))
+	return nil
+}
+
+func packQuery(domain string, qtype dnsmessage.Type) ([]byte, error) {
+	if !strings.HasSuffix(domain, ".") {
+		domain = domain + "."
+	}
+	name, err := dnsmessage.NewName(domain)
+	if err != nil {
+		return nil, newError("domain name too long").Base(err)
+	}
+	message := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               uint16(rand.Uint32()),
+			RecursionDesired: true,
+		},
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	if option, _ := ednsClientSubnet.Load().([]byte); option != nil && (qtype == dnsmessage.TypeA || qtype == dnsmessage.TypeAAAA) {
+		var header dnsmessage.ResourceHeader
+		err = header.SetEDNS0(ednsUDPSize, dnsmessage.RCodeSuccess, false)
+		if err != nil {
+			return nil, err
+		}
+		message.Additionals = append(message.Additionals, dnsmessage.Resource{
+			Header: header,
+			Body: &dnsmessage.OPTResource{
+				Options: []dnsmessage.Option{{Code: ednsOptionClientSubnet, Data: option}},
+			},
+		})
+	}
+	return message.Pack()
+}
+
+// parseResponse returns the A and AAAA records of a wire format DNS response
+// and the lowest TTL among them.
+func parseResponse(response []byte) ([]net.IP, time.Duration, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil {
+		return nil, 0, newError("failed to parse DNS response").Base(err)
+	}
+	if header.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, dns.RCodeError(header.RCode)
+	}
+	err = parser.SkipAllQuestions()
+	if err != nil {
+		return nil, 0, newError("failed to skip questions in DNS response").Base(err)
+	}
+	var ips []net.IP
+	var ttl uint32
+	for {
+		answerHeader, err := parser.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		} else if err != nil {
+			return nil, 0, newError("failed to parse answer section").Base(err)
+		}
+		switch answerHeader.Type {
+		case dnsmessage.TypeA:
+			answer, err := parser.AResource()
+			if err != nil {
+				return nil, 0, newError("failed to parse A record").Base(err)
+			}
+			ips = append(ips, answer.A[:])
+		case dnsmessage.TypeAAAA:
+			answer, err := parser.AAAAResource()
+			if err != nil {
+				return nil, 0, newError("failed to parse AAAA record").Base(err)
+			}
+			ips = append(ips, answer.AAAA[:])
+		default:
+			err = parser.SkipAnswer()
+			if err != nil {
+				return nil, 0, newError("failed to skip answer").Base(err)
+			}
+			continue
+		}
+		if len(ips) == 1 || answerHeader.TTL < ttl {
+			ttl = answerHeader.TTL
+		}
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// exchangeStream exchanges a query over a stream connection with two-byte length framing.
+func exchangeStream(conn net.Conn, query []byte) ([]byte, error) {
+	err := writeStream(conn, query)
+	if err != nil {
+		return nil, err
+	}
+	return readStream(conn)
+}
+
+func writeStream(conn net.Conn, message []byte) error {
+	request := make([]byte, 2+len(message))
+	binary.BigEndian.PutUint16(request, uint16(len(message)))
+	copy(request[2:], message)
+	_, err := conn.Write(request)
+	return err
+}
+
+func readStream(conn net.Conn) ([]byte, error) {
+	var length uint16
+	err := binary.Read(conn, binary.BigEndian, &length)
+	if err != nil {
+		return nil, err
+	}
+	message := make([]byte, length)
+	_, err = io.ReadFull(conn, message)
+	if err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// The transports of the queries sent to plain DNS servers, set with SetDNSTransport.
+const (
+	// DNSTransportAuto queries over UDP and retries over TCP when the answer is truncated.
+	DNSTransportAuto int32 = iota
+	DNSTransportUDP
+	DNSTransportTCP
+)
+
+var dnsTransport = DNSTransportAuto
+
+// SetDNSTransport sets how plain DNS servers are queried, one of the DNSTransport constants.
+func SetDNSTransport(transport int32) error {
+	if transport < DNSTransportAuto || transport > DNSTransportTCP {
+		return newError("invalid dns transport ", transport)
+	}
+	atomic.StoreInt32(&dnsTransport, transport)
+	return nil
+}
+
+// exchangePlain sends query to the plain DNS server at destination, a UDP destination,
+// over the transport set with SetDNSTransport.
+func exchangePlain(ctx context.Context, destination v2rayNet.Destination, query []byte) ([]byte, error) {
+	transport := atomic.LoadInt32(&dnsTransport)
+	if transport != DNSTransportTCP {
+		response, err := exchangeUDP(ctx, destination, query)
+		if err != nil || transport == DNSTransportUDP || !truncated(response) {
+			return response, err
+		}
+		logrus.Debug("dns response from ", destination.NetAddr(), " truncated, retrying over tcp")
+	}
+	return exchangeTCP(ctx, v2rayNet.TCPDestination(destination.Address, destination.Port), query)
+}
+
+// truncated reports whether the TC bit of a wire format DNS response is set.
+func truncated(response []byte) bool {
+	return len(response) > 2 && response[2]&0x02 != 0
+}
+
+// exchangeTCP sends query to the DNS server at destination over a protected TCP connection.
+func exchangeTCP(ctx context.Context, destination v2rayNet.Destination, query []byte) ([]byte, error) {
+	conn, err := defaultDialer().Dial(ctx, nil, destination, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer watchDeadline(ctx, conn)()
+	return exchangeStream(conn, query)
+}
+
+// lookupGraceDelay is how long the answer of the other family is waited for
+// once the preferred family has been resolved.
+var lookupGraceDelay = 50 * time.Millisecond
+
+type wireResult struct {
+	ips       []net.IP
+	ttl       time.Duration
+	err       error
+	preferred bool
+}
+
+// lookupWire resolves domain for network ("ip", "ip4" or "ip6") with wire format queries,
+// returning the lowest TTL of the answers. A and AAAA are queried concurrently.
+func lookupWire(ctx context.Context, network string, domain string, exchange exchangeFunc) ([]net.IP, time.Duration, error) {
+	var qtypes []dnsmessage.Type
+	if network != "ip6" {
+		qtypes = append(qtypes, dnsmessage.TypeA)
+	}
+	if network != "ip4" {
+		qtypes = append(qtypes, dnsmessage.TypeAAAA)
+	}
+	preferAAAA := network == "ip6" || GetIPv6Mode() == comm.IPv6Prefer
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan wireResult, len(qtypes))
+	for _, qtype := range qtypes {
+		query, err := packQuery(domain, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+		go func(qtype dnsmessage.Type) {
+			result := wireResult{preferred: (qtype == dnsmessage.TypeAAAA) == preferAAAA}
+			response, err := exchange(ctx, query)
+			if err == nil {
+				result.ips, result.ttl, err = parseResponse(response)
+			}
+			result.err = err
+			results <- result
+		}(qtype)
+	}
+
+	var ips []net.IP
+	var ttl time.Duration
+	var lastErr error
+	var grace <-chan time.Time
+	for pending := len(qtypes); pending > 0; {
+		select {
+		case result := <-results:
+			pending--
+			if result.err != nil {
+				lastErr = result.err
+				continue
+			}
+			if len(result.ips) > 0 && (len(ips) == 0 || result.ttl < ttl) {
+				ttl = result.ttl
+			}
+			ips = append(ips, result.ips...)
+			if result.preferred && len(result.ips) > 0 && pending > 0 {
+				timer := clk.NewTimer(lookupGraceDelay)
+				defer timer.Stop()
+				grace = timer.C()
+			}
+		case <-grace:
+			pending = 0
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}
+	if len(ips) == 0 {
+		if lastErr != nil {
+			return nil, 0, lastErr
+		}
+		return nil, 0, dns.ErrEmptyResponse
+	}
+	return ips, ttl, nil
+}
@@ -0,0 +1,280 @@
+package libcore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// delayingExchange answers A queries with 192.0.2.1 and AAAA queries with 2001:db8::1,
+// holding back the answers of delayed until it is closed and failing those of failing.
+func delayingExchange(t *testing.T, delayed dnsmessage.Type, release <-chan struct{}, failing dnsmessage.Type) exchangeFunc {
+	return func(ctx context.Context, query []byte) ([]byte, error) {
+		var message dnsmessage.Message
+		if err := message.Unpack(query); err != nil {
+			return nil, err
+		}
+		qtype := message.Questions[0].Type
+		if qtype == delayed {
+			select {
+			case <-release:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		if qtype == failing {
+			return nil, errors.New("server failure")
+		}
+		return dnsAnswer(t, query, 60, net.IPv4(192, 0, 2, 1), net.ParseIP("2001:db8::1")), nil
+	}
+}
+
+type wireLookupResult struct {
+	ips []net.IP
+	err error
+}
+
+func lookupWireAsync(exchange exchangeFunc) <-chan wireLookupResult {
+	result := make(chan wireLookupResult, 1)
+	go func() {
+		ips, _, err := lookupWire(context.Background(), "ip", "wire.example", exchange)
+		result <- wireLookupResult{ips, err}
+	}()
+	return result
+}
+
+func TestLookupWireGraceWindow(t *testing.T) {
+	defer resetOptions()
+	fake := useFakeClock(t)
+
+	// the other family answering within the grace window is merged
+	release := make(chan struct{})
+	result := lookupWireAsync(delayingExchange(t, dnsmessage.TypeAAAA, release, 0))
+	fake.WaitTimers(1)
+	close(release)
+	if r := <-result; r.err != nil || fmt.Sprint(r.ips) != "[192.0.2.1 2001:db8::1]" {
+		t.Fatal("resolved ", r.ips, ": ", r.err)
+	}
+
+	// or given up once it expires
+	release = make(chan struct{})
+	defer close(release)
+	result = lookupWireAsync(delayingExchange(t, dnsmessage.TypeAAAA, release, 0))
+	fake.WaitTimers(1)
+	select {
+	case r := <-result:
+		t.Fatal("returned before the grace window ", r.ips)
+	case <-time.After(20 * time.Millisecond):
+	}
+	fake.Advance(lookupGraceDelay)
+	if r := <-result; r.err != nil || fmt.Sprint(r.ips) != "[192.0.2.1]" {
+		t.Fatal("resolved ", r.ips, ": ", r.err)
+	}
+
+	// the grace window starts with the preferred family only
+	SetIPv6Mode(IPv6ModePrefer)
+	preferred := make(chan struct{})
+	result = lookupWireAsync(delayingExchange(t, dnsmessage.TypeAAAA, preferred, 0))
+	time.Sleep(20 * time.Millisecond)
+	fake.Advance(time.Minute)
+	select {
+	case r := <-result:
+		t.Fatal("returned without the preferred family ", r.ips)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(preferred)
+	if r := <-result; r.err != nil || len(r.ips) != 2 {
+		t.Fatal("resolved ", r.ips, ": ", r.err)
+	}
+	result = lookupWireAsync(delayingExchange(t, dnsmessage.TypeA, release, 0))
+	fake.WaitTimers(1)
+	fake.Advance(lookupGraceDelay)
+	if r := <-result; r.err != nil || fmt.Sprint(r.ips) != "[2001:db8::1]" {
+		t.Fatal("resolved ", r.ips, ": ", r.err)
+	}
+}
+
+func TestLookupWireOneFamilyFailing(t *testing.T) {
+	for _, failing := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		ips, _, err := lookupWire(context.Background(), "ip", "wire.example", delayingExchange(t, 0, nil, failing))
+		if err != nil || len(ips) != 1 {
+			t.Fatal(failing, " failing: resolved ", ips, ": ", err)
+		}
+	}
+	_, _, err := lookupWire(context.Background(), "ip4", "wire.example", delayingExchange(t, 0, nil, dnsmessage.TypeA))
+	if err == nil {
+		t.Fatal("no error with the only family failing")
+	}
+}
+
+// truncatingServer is a plain DNS server answering over UDP with truncated empty
+// responses and over TCP with the full answer, counting the UDP queries and TCP connections.
+type truncatingServer struct {
+	destination v2rayNet.Destination
+	udp, tcp    int32
+}
+
+func newTruncatingServer(t *testing.T, ips ...net.IP) *truncatingServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	conn, err := net.ListenPacket("udp", listener.Addr().String())
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	server := &truncatingServer{
+		destination: v2rayNet.UDPDestination(v2rayNet.LocalHostIP, v2rayNet.Port(listener.Addr().(*net.TCPAddr).Port)),
+	}
+	go func() {
+		buffer := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&server.udp, 1)
+			response := dnsAnswer(t, buffer[:n], 60)
+			response[2] |= 0x02
+			conn.WriteTo(response, addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&server.tcp, 1)
+			go func() {
+				defer conn.Close()
+				serveDNSStream(t, conn, ips...)
+			}()
+		}
+	}()
+	return server
+}
+
+func TestDNSTransport(t *testing.T) {
+	defer resetOptions()
+	server := newTruncatingServer(t, net.IPv4(192, 0, 2, 1))
+	exchange := func(ctx context.Context, query []byte) ([]byte, error) {
+		return exchangePlain(ctx, server.destination, query)
+	}
+	for _, test := range []struct {
+		transport       int32
+		udp, tcp, found int32
+	}{
+		// truncated answers are queried again over tcp
+		{DNSTransportAuto, 1, 1, 1},
+		{DNSTransportUDP, 1, 0, 0},
+		{DNSTransportTCP, 0, 1, 1},
+	} {
+		if err := SetDNSTransport(test.transport); err != nil {
+			t.Fatal(err)
+		}
+		atomic.StoreInt32(&server.udp, 0)
+		atomic.StoreInt32(&server.tcp, 0)
+		ips, _, err := lookupWire(context.Background(), "ip4", "truncated.test", exchange)
+		if test.found == 1 && (err != nil || len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 1))) {
+			t.Fatal("transport ", test.transport, ": resolved ", ips, ": ", err)
+		} else if test.found == 0 && err == nil && len(ips) != 0 {
+			t.Fatal("transport ", test.transport, ": resolved ", ips, " from a truncated answer")
+		}
+		if udp, tcp := atomic.LoadInt32(&server.udp), atomic.LoadInt32(&server.tcp); udp != test.udp || tcp != test.tcp {
+			t.Fatal("transport ", test.transport, ": ", udp, " udp and ", tcp, " tcp queries")
+		}
+	}
+	for _, transport := range []int32{DNSTransportAuto - 1, DNSTransportTCP + 1} {
+		if err := SetDNSTransport(transport); err == nil {
+			t.Fatal("accepted transport ", transport)
+		}
+	}
+}
+
+// clientSubnets returns the client subnet options of the queries of a lookup of network.
+func clientSubnets(t *testing.T, network string) [][]byte {
+	var access sync.Mutex
+	var subnets [][]byte
+	_, _, err := lookupWire(context.Background(), network, "subnet.test", func(ctx context.Context, query []byte) ([]byte, error) {
+		var message dnsmessage.Message
+		if err := message.Unpack(query); err != nil {
+			return nil, err
+		}
+		for _, additional := range message.Additionals {
+			if additional.Header.Type != dnsmessage.TypeOPT {
+				continue
+			}
+			for _, option := range additional.Body.(*dnsmessage.OPTResource).Options {
+				if option.Code == ednsOptionClientSubnet {
+					access.Lock()
+					subnets = append(subnets, option.Data)
+					access.Unlock()
+				}
+			}
+		}
+		return dnsAnswer(t, query, 60, net.IPv4(192, 0, 2, 1), net.ParseIP("2001:db8::1")), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return subnets
+}
+
+func TestEdnsClientSubnet(t *testing.T) {
+	defer resetOptions()
+	if subnets := clientSubnets(t, "ip"); len(subnets) != 0 {
+		t.Fatal("sent client subnets ", subnets, " while disabled")
+	}
+	for _, test := range []struct {
+		cidr   string
+		option []byte
+	}{
+		// family, source prefix length, scope prefix length and the address truncated to the prefix
+		{"198.51.100.7/24", []byte{0, 1, 24, 0, 198, 51, 100}},
+		{"198.51.100.7", []byte{0, 1, 24, 0, 198, 51, 100}},
+		{"198.51.100.255/20", []byte{0, 1, 20, 0, 198, 51, 96}},
+		{"2001:db8:1234:5678::1", []byte{0, 2, 56, 0, 0x20, 0x01, 0x0d, 0xb8, 0x12, 0x34, 0x56}},
+		{"0.0.0.0/0", []byte{0, 1, 0, 0}},
+	} {
+		if err := SetEdnsClientSubnet(test.cidr); err != nil {
+			t.Fatal(err)
+		}
+		subnets := clientSubnets(t, "ip")
+		if len(subnets) != 2 {
+			t.Fatal(test.cidr, ": ", len(subnets), " client subnets sent by the two queries")
+		}
+		for _, subnet := range subnets {
+			if !bytes.Equal(subnet, test.option) {
+				t.Fatal(test.cidr, ": sent ", subnet, ", expected ", test.option)
+			}
+		}
+	}
+
+	for _, cidr := range []string{"example.com", "198.51.100.0/33", "198.51.100.0/"} {
+		if err := SetEdnsClientSubnet(cidr); err == nil {
+			t.Fatal("accepted ", cidr)
+		}
+	}
+	if err := SetEdnsClientSubnet(""); err != nil {
+		t.Fatal(err)
+	}
+	if subnets := clientSubnets(t, "ip4"); len(subnets) != 0 {
+		t.Fatal("sent client subnets ", subnets, " after disabling")
+	}
+}
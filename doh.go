@@ -0,0 +1,101 @@
+package libcore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+)
+
+// dohResolver resolves domains with DNS over HTTPS (RFC 8484).
+type dohResolver struct {
+	url    string
+	client *http.Client
+}
+
+// NewDohResolver creates a resolver querying the DNS over HTTPS endpoint at link through
+// the protected dialer. If bootstrapIP is set, it is connected to instead of resolving
+// the host of link, which is otherwise resolved with the servers of SetBootstrapDNS.
+func NewDohResolver(link string, bootstrapIP string) (Resolver, error) {
+	dohUrl, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	if dohUrl.Scheme != "https" {
+		return nil, newError("unsupported doh url ", link)
+	}
+	if bootstrapIP != "" && net.ParseIP(bootstrapIP) == nil {
+		return nil, newError("invalid bootstrap ip ", bootstrapIP)
+	}
+	return &dohResolver{
+		url: dohUrl.String(),
+		client: &http.Client{
+			Transport: &http.Transport{
+				ForceAttemptHTTP2: true,
+				IdleConnTimeout:   90 * time.Second,
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					host, port, err := net.SplitHostPort(addr)
+					if err != nil {
+						return nil, err
+					}
+					if bootstrapIP != "" {
+						host = bootstrapIP
+					}
+					dest, err := v2rayNet.ParseDestination("tcp:" + net.JoinHostPort(host, port))
+					if err != nil {
+						return nil, err
+					}
+					conn, err := dialBootstrapped(ctx, dest)
+					if err != nil {
+						return nil, err
+					}
+					return trackResolverConn(conn), nil
+				},
+			},
+		},
+	}, nil
+}
+
+func (r *dohResolver) LookupIP(network string, domain string) ([]byte, error) {
+	ctx, cancel := withTimeout(context.Background(), loadDuration(&resolveTimeout))
+	defer cancel()
+	ips, err := r.lookupIP(ctx, network, domain)
+	if err != nil {
+		return nil, err
+	}
+	return encodeIPs(ips), nil
+}
+
+func (r *dohResolver) lookupIP(ctx context.Context, network string, domain string) ([]net.IP, error) {
+	ips, _, err := r.lookupIPTTL(ctx, network, domain)
+	return ips, err
+}
+
+func (r *dohResolver) lookupIPTTL(ctx context.Context, network string, domain string) ([]net.IP, time.Duration, error) {
+	return lookupWire(ctx, network, domain, r.exchange)
+}
+
+func (r *dohResolver) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	// a zero ID keeps the responses cacheable by HTTP caches, see RFC 8484 section 4.1
+	query[0], query[1] = 0, 0
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/dns-message")
+	request.Header.Set("Accept", "application/dns-message")
+	response, err := r.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, newError("unexpected doh response status ", response.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(response.Body, 65535))
+}
@@ -0,0 +1,127 @@
+package libcore
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dohServer is a DNS over HTTPS endpoint answering with canned addresses, keeping the
+// types of the questions it was asked.
+type dohServer struct {
+	*httptest.Server
+	access sync.Mutex
+	qtypes []dnsmessage.Type
+}
+
+func newDohServer(t *testing.T, ips ...net.IP) *dohServer {
+	server := &dohServer{}
+	server.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, err := io.ReadAll(r.Body)
+		if err != nil || r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var message dnsmessage.Message
+		if err = message.Unpack(query); err != nil || message.ID != 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		server.access.Lock()
+		server.qtypes = append(server.qtypes, message.Questions[0].Type)
+		server.access.Unlock()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(dnsAnswer(t, query, 300, ips...))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// resolver returns a resolver of the server, connecting to its address for the name of
+// its certificate.
+func (s *dohServer) resolver(t *testing.T) *dohResolver {
+	serverUrl, _ := url.Parse(s.URL)
+	resolver, err := NewDohResolver("https://example.com:"+serverUrl.Port()+"/dns-query", serverUrl.Hostname())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := resolver.(*dohResolver)
+	r.client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{RootCAs: s.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+	return r
+}
+
+func (s *dohServer) questions() []dnsmessage.Type {
+	s.access.Lock()
+	defer s.access.Unlock()
+	qtypes := s.qtypes
+	s.qtypes = nil
+	return qtypes
+}
+
+func TestDohResolver(t *testing.T) {
+	defer resetOptions()
+	server := newDohServer(t, net.IPv4(192, 0, 2, 1), net.ParseIP("2001:db8::1"))
+	resolver := server.resolver(t)
+
+	result, err := resolver.LookupIP("ip", "doh.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ips, err := decodeIPs(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 || !containsIP(ips, net.IPv4(192, 0, 2, 1)) || !containsIP(ips, net.ParseIP("2001:db8::1")) {
+		t.Fatal("unexpected answer ", ips)
+	}
+	if qtypes := server.questions(); len(qtypes) != 2 {
+		t.Fatal("unexpected questions ", qtypes)
+	}
+
+	for _, test := range []struct {
+		mode  int32
+		qtype dnsmessage.Type
+		ip    net.IP
+	}{
+		{IPv6ModeDisable, dnsmessage.TypeA, net.IPv4(192, 0, 2, 1)},
+		{IPv6ModeOnly, dnsmessage.TypeAAAA, net.ParseIP("2001:db8::1")},
+	} {
+		SetIPv6Mode(test.mode)
+		ips, ttl, err := resolver.lookupIPTTL(context.Background(), lookupNetwork(), "doh.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != 1 || !ips[0].Equal(test.ip) || ttl.Seconds() != 300 {
+			t.Fatal("unexpected answer ", ips, " with ttl ", ttl)
+		}
+		if qtypes := server.questions(); len(qtypes) != 1 || qtypes[0] != test.qtype {
+			t.Fatal("ipv6 mode ", test.mode, ": unexpected questions ", qtypes)
+		}
+	}
+}
+
+func TestDohResolverErrors(t *testing.T) {
+	for _, link := range []string{"http://1.1.1.1/dns-query", "https://1.1.1.1/%zz"} {
+		if _, err := NewDohResolver(link, ""); err == nil {
+			t.Fatal("accepted ", link)
+		}
+	}
+	if _, err := NewDohResolver("https://1.1.1.1/dns-query", "one.one"); err == nil {
+		t.Fatal("accepted a bootstrap domain")
+	}
+
+	server := newDohServer(t)
+	// an endpoint answering with an error status
+	server.Config.Handler = http.NotFoundHandler()
+	if _, err := server.resolver(t).LookupIP("ip4", "doh.test"); err == nil {
+		t.Fatal("no error from a failing endpoint")
+	}
+}
@@ -0,0 +1,215 @@
+package libcore
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+)
+
+// dotResolver resolves domains with DNS over TLS (RFC 7858), sharing one connection
+// between concurrent queries.
+type dotResolver struct {
+	address string
+	config  *tls.Config
+
+	access sync.Mutex
+	conn   *dotConn
+}
+
+// NewDotResolver creates a resolver querying the DNS over TLS server at server:port through
+// the protected dialer, port defaults to 853. The certificate is verified for serverName,
+// or server if empty. If bootstrapIP is set, it is connected to instead of resolving server,
+// which is otherwise resolved with the servers of SetBootstrapDNS.
+func NewDotResolver(server string, port int32, bootstrapIP string, serverName string) (Resolver, error) {
+	if server == "" {
+		return nil, newError("empty dot server")
+	}
+	if port <= 0 {
+		port = 853
+	}
+	if serverName == "" {
+		serverName = server
+	}
+	host := server
+	if bootstrapIP != "" {
+		if net.ParseIP(bootstrapIP) == nil {
+			return nil, newError("invalid bootstrap ip ", bootstrapIP)
+		}
+		host = bootstrapIP
+	}
+	return &dotResolver{
+		address: net.JoinHostPort(host, strconv.Itoa(int(port))),
+		config: &tls.Config{
+			ServerName: serverName,
+		},
+	}, nil
+}
+
+func (r *dotResolver) LookupIP(network string, domain string) ([]byte, error) {
+	ctx, cancel := withTimeout(context.Background(), loadDuration(&resolveTimeout))
+	defer cancel()
+	ips, err := r.lookupIP(ctx, network, domain)
+	if err != nil {
+		return nil, err
+	}
+	return encodeIPs(ips), nil
+}
+
+func (r *dotResolver) lookupIP(ctx context.Context, network string, domain string) ([]net.IP, error) {
+	ips, _, err := r.lookupIPTTL(ctx, network, domain)
+	return ips, err
+}
+
+func (r *dotResolver) lookupIPTTL(ctx context.Context, network string, domain string) ([]net.IP, time.Duration, error) {
+	return lookupWire(ctx, network, domain, r.exchange)
+}
+
+func (r *dotResolver) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	conn, reused, err := r.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	response, err := conn.exchange(ctx, query)
+	if err != nil && reused && ctx.Err() == nil {
+		// the server may have closed the idle connection, retry once on a new one
+		conn, _, err = r.getConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		response, err = conn.exchange(ctx, query)
+	}
+	return response, err
+}
+
+func (r *dotResolver) getConn(ctx context.Context) (*dotConn, bool, error) {
+	r.access.Lock()
+	defer r.access.Unlock()
+	if r.conn != nil {
+		select {
+		case <-r.conn.done:
+		default:
+			return r.conn, true, nil
+		}
+	}
+	destination, err := v2rayNet.ParseDestination("tcp:" + r.address)
+	if err != nil {
+		return nil, false, err
+	}
+	conn, err := dialBootstrapped(ctx, destination)
+	if err != nil {
+		return nil, false, err
+	}
+	conn = trackResolverConn(conn)
+	tlsConn := tls.Client(conn, r.config)
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, false, newError("dot handshake failed").Base(err)
+	}
+	r.conn = newDotConn(tlsConn)
+	return r.conn, false, nil
+}
+
+var errDotConnClosed = errors.New("dot connection closed")
+
+// dotConn multiplexes queries on a DNS over TLS connection by their ID.
+type dotConn struct {
+	conn        net.Conn
+	writeAccess sync.Mutex
+
+	access  sync.Mutex
+	pending map[uint16]chan []byte
+
+	closeOnce  sync.Once
+	done       chan struct{}
+	err        error
+	unregister func()
+}
+
+func newDotConn(conn net.Conn) *dotConn {
+	c := &dotConn{
+		conn:    conn,
+		pending: make(map[uint16]chan []byte),
+		done:    make(chan struct{}),
+	}
+	c.unregister = registerCleanup(func() {
+		c.close(errDotConnClosed)
+	})
+	go c.loop()
+	return c
+}
+
+func (c *dotConn) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	result := make(chan []byte, 1)
+	c.access.Lock()
+	id := binary.BigEndian.Uint16(query)
+	for c.pending[id] != nil {
+		id = uint16(rand.Uint32())
+	}
+	c.pending[id] = result
+	c.access.Unlock()
+	defer func() {
+		c.access.Lock()
+		delete(c.pending, id)
+		c.access.Unlock()
+	}()
+
+	message := make([]byte, len(query))
+	copy(message, query)
+	binary.BigEndian.PutUint16(message, id)
+	c.writeAccess.Lock()
+	err := writeStream(c.conn, message)
+	c.writeAccess.Unlock()
+	if err != nil {
+		c.close(err)
+		return nil, err
+	}
+
+	select {
+	case response := <-result:
+		return response, nil
+	case <-c.done:
+		return nil, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *dotConn) loop() {
+	for {
+		response, err := readStream(c.conn)
+		if err != nil {
+			c.close(err)
+			c.unregister()
+			return
+		}
+		if len(response) < 2 {
+			continue
+		}
+		c.access.Lock()
+		result := c.pending[binary.BigEndian.Uint16(response)]
+		c.access.Unlock()
+		if result != nil {
+			select {
+			case result <- response:
+			default:
+			}
+		}
+	}
+}
+
+func (c *dotConn) close(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		close(c.done)
+		c.conn.Close()
+	})
+}
@@ -0,0 +1,132 @@
+package libcore
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/v2fly/v2ray-core/v5/features/dns"
+)
+
+// dotServer is a DNS over TLS server answering with canned addresses. It reads the
+// queries in pairs and answers them in reverse, so that responses arrive out of order.
+type dotServer struct {
+	address     string
+	roots       *x509.CertPool
+	accepted    int32
+	serverNames chan string
+}
+
+func newDotServer(t *testing.T, ips ...net.IP) *dotServer {
+	// borrow the certificate of httptest, valid for example.com and 127.0.0.1
+	certificates := httptest.NewTLSServer(http.NotFoundHandler())
+	certificates.Close()
+	server := &dotServer{
+		roots:       x509.NewCertPool(),
+		serverNames: make(chan string, 16),
+	}
+	server.roots.AddCert(certificates.Certificate())
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: certificates.TLS.Certificates,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			server.serverNames <- hello.ServerName
+			return nil, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	server.address = listener.Addr().String()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&server.accepted, 1)
+			go func() {
+				defer conn.Close()
+				for {
+					first, err := readStream(conn)
+					if err != nil {
+						return
+					}
+					second, err := readStream(conn)
+					if err != nil {
+						return
+					}
+					writeStream(conn, dnsAnswer(t, second, 60, ips...))
+					writeStream(conn, dnsAnswer(t, first, 60, ips...))
+				}
+			}()
+		}
+	}()
+	return server
+}
+
+// resolver returns a resolver of the server verifying its certificate for serverName.
+func (s *dotServer) resolver(t *testing.T, serverName string) *dotResolver {
+	host, port, _ := net.SplitHostPort(s.address)
+	portNumber, _ := strconv.Atoi(port)
+	resolver, err := NewDotResolver("example.com", int32(portNumber), host, serverName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := resolver.(*dotResolver)
+	r.config.RootCAs = s.roots
+	return r
+}
+
+func TestDotResolver(t *testing.T) {
+	server := newDotServer(t, net.IPv4(192, 0, 2, 1), net.ParseIP("2001:db8::1"))
+	resolver := server.resolver(t, "")
+	defer Close()
+	for i := 0; i < 3; i++ {
+		// both families are queried at once, answered in reverse
+		ips, err := resolver.lookupIP(context.Background(), "ip", "dot.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != 2 || !containsIP(ips, net.IPv4(192, 0, 2, 1)) || !containsIP(ips, net.ParseIP("2001:db8::1")) {
+			t.Fatal("unexpected answer ", ips)
+		}
+	}
+	if n := atomic.LoadInt32(&server.accepted); n != 1 {
+		t.Fatal(n, " connections for the queries")
+	}
+	if serverName := <-server.serverNames; serverName != "example.com" {
+		t.Fatal("sent server name ", serverName)
+	}
+}
+
+func TestDotResolverServerName(t *testing.T) {
+	server := newDotServer(t, net.IPv4(192, 0, 2, 1))
+	defer Close()
+	if _, err := server.resolver(t, "wrong.test").lookupIP(context.Background(), "ip", "dot.test"); err == nil {
+		t.Fatal("accepted a certificate not valid for the server name")
+	}
+	if serverName := <-server.serverNames; serverName != "wrong.test" {
+		t.Fatal("sent server name ", serverName)
+	}
+	if _, err := server.resolver(t, "127.0.0.1").lookupIP(context.Background(), "ip", "dot.test"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDotResolverEmptyResponse(t *testing.T) {
+	server := newDotServer(t)
+	defer Close()
+	_, err := server.resolver(t, "").LookupIP("ip", "dot.test")
+	if err != dns.ErrEmptyResponse {
+		t.Fatal("unexpected error: ", err)
+	}
+}
@@ -7,7 +7,6 @@ require (
 	github.com/golang/protobuf v1.5.2
 	github.com/pion/stun v0.3.6-0.20211201014640-159901e761c9
 	github.com/sagernet/gomobile v0.0.0-20220214172500-89df302623c8
-	github.com/sagernet/libping v0.1.1
 	github.com/sagernet/sagerconnect v0.1.7
 	github.com/sirupsen/logrus v1.8.1
 	github.com/ulikunitz/xz v0.5.10
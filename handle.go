@@ -0,0 +1,88 @@
+package libcore
+
+import "sync"
+
+type connHandle struct {
+	conn       *Conn
+	unregister func()
+}
+
+var (
+	handleAccess sync.Mutex
+	handles      = make(map[int64]*connHandle)
+	lastHandle   int64
+)
+
+// DialProtectedHandle is DialProtected returning the connection as an integer handle for
+// ReadHandle, WriteHandle and CloseHandle, so the host app controls its lifetime instead
+// of the garbage collectors. Handles left open are closed by Close.
+func DialProtectedHandle(network string, address string, timeout int32) (int64, error) {
+	conn, err := DialProtected(network, address, timeout)
+	if err != nil {
+		return 0, err
+	}
+	return registerHandle(conn), nil
+}
+
+// AdoptFdHandle is AdoptFd returning the connection as a handle like DialProtectedHandle.
+func AdoptFdHandle(fd int32, network string) (int64, error) {
+	conn, err := AdoptFd(fd, network)
+	if err != nil {
+		return 0, err
+	}
+	return registerHandle(conn), nil
+}
+
+func registerHandle(conn *Conn) int64 {
+	handleAccess.Lock()
+	defer handleAccess.Unlock()
+	lastHandle++
+	handle := lastHandle
+	handles[handle] = &connHandle{
+		conn: conn,
+		unregister: registerCleanup(func() {
+			_ = CloseHandle(handle)
+		}),
+	}
+	return handle
+}
+
+func lookupHandle(handle int64) (*Conn, error) {
+	handleAccess.Lock()
+	defer handleAccess.Unlock()
+	entry, loaded := handles[handle]
+	if !loaded {
+		return nil, newError("unknown handle ", handle)
+	}
+	return entry.conn, nil
+}
+
+func ReadHandle(handle int64, b []byte) (int32, error) {
+	conn, err := lookupHandle(handle)
+	if err != nil {
+		return 0, err
+	}
+	return conn.Read(b)
+}
+
+func WriteHandle(handle int64, b []byte) (int32, error) {
+	conn, err := lookupHandle(handle)
+	if err != nil {
+		return 0, err
+	}
+	return conn.Write(b)
+}
+
+// CloseHandle closes the connection of handle and releases it, closing a handle already
+// released does nothing.
+func CloseHandle(handle int64) error {
+	handleAccess.Lock()
+	entry, loaded := handles[handle]
+	delete(handles, handle)
+	handleAccess.Unlock()
+	if !loaded {
+		return nil
+	}
+	entry.unregister()
+	return entry.conn.Close()
+}
@@ -0,0 +1,72 @@
+package libcore
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+)
+
+var (
+	hostsAccess sync.RWMutex
+	hosts       map[string][]net.IP
+)
+
+// SetHosts replaces the static domain mappings consulted by the default resolver before
+// any lookup, from a JSON object of domains to lists of IPs. Entries like *.example.com
+// match all subdomains, and an empty list makes the lookup fail with an empty response.
+func SetHosts(hostsJson string) error {
+	var entries map[string][]string
+	if hostsJson != "" {
+		err := json.Unmarshal([]byte(hostsJson), &entries)
+		if err != nil {
+			return newError("failed to parse hosts").Base(err)
+		}
+	}
+	newHosts := make(map[string][]net.IP, len(entries))
+	for domain, addresses := range entries {
+		ips := make([]net.IP, 0, len(addresses))
+		for _, address := range addresses {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				return newError("invalid ip ", address, " for ", domain)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			ips = append(ips, ip)
+		}
+		newHosts[normalizeDomain(domain)] = ips
+	}
+	hostsAccess.Lock()
+	hosts = newHosts
+	hostsAccess.Unlock()
+	return nil
+}
+
+// lookupHosts returns the mapping of domain, preferring exact entries over the closest wildcard.
+func lookupHosts(domain string) ([]net.IP, bool) {
+	hostsAccess.RLock()
+	defer hostsAccess.RUnlock()
+	if len(hosts) == 0 {
+		return nil, false
+	}
+	domain = normalizeDomain(domain)
+	if ips, found := hosts[domain]; found {
+		return ips, true
+	}
+	for {
+		index := strings.IndexByte(domain, '.')
+		if index < 0 {
+			return nil, false
+		}
+		domain = domain[index+1:]
+		if ips, found := hosts["*."+domain]; found {
+			return ips, true
+		}
+	}
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
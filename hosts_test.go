@@ -0,0 +1,74 @@
+package libcore
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/v2fly/v2ray-core/v5/features/dns"
+)
+
+func TestHosts(t *testing.T) {
+	defer resetOptions()
+	err := SetHosts(`{
+		"exact.example": ["192.0.2.1", "2001:db8::1"],
+		"*.example.com": ["192.0.2.2"],
+		"*.deep.example.com": ["192.0.2.3"],
+		"www.example.com.": ["192.0.2.4"],
+		"blocked.example": [],
+		"*.blocked.example": []
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for domain, expected := range map[string]string{
+		"exact.example":       "[192.0.2.1 2001:db8::1]",
+		"EXACT.example.":      "[192.0.2.1 2001:db8::1]",
+		"a.example.com":       "[192.0.2.2]",
+		"a.b.example.com":     "[192.0.2.2]",
+		"a.deep.example.com":  "[192.0.2.3]",
+		"deep.example.com":    "[192.0.2.2]",
+		"www.example.com":     "[192.0.2.4]",
+		"ads.blocked.example": "[]",
+		"blocked.example":     "[]",
+	} {
+		ips, found := lookupHosts(domain)
+		if !found || fmt.Sprint(ips) != expected {
+			t.Fatal(domain, " mapped to ", ips, ", expected ", expected)
+		}
+	}
+	for _, domain := range []string{"example.com", "other.example", "sub.exact.example"} {
+		if ips, found := lookupHosts(domain); found {
+			t.Fatal(domain, " mapped to ", ips)
+		}
+	}
+
+	ips, err := lookupDefault(context.Background(), "a.example.com")
+	if err != nil || fmt.Sprint(ips) != "[192.0.2.2]" {
+		t.Fatal("resolved ", ips, ": ", err)
+	}
+	if _, err = lookupDefault(context.Background(), "ads.blocked.example"); err != dns.ErrEmptyResponse {
+		t.Fatal("blackhole resolved: ", err)
+	}
+}
+
+func TestSetHostsInvalid(t *testing.T) {
+	defer resetOptions()
+	if err := SetHosts(`{"kept.example": ["192.0.2.1"]}`); err != nil {
+		t.Fatal(err)
+	}
+	for _, hostsJson := range []string{`{"a.example": "192.0.2.1"}`, `{"a.example": ["a.example"]}`, `[`} {
+		if err := SetHosts(hostsJson); err == nil {
+			t.Fatal("accepted ", hostsJson)
+		}
+	}
+	if _, found := lookupHosts("kept.example"); !found {
+		t.Fatal("invalid hosts replaced the mappings")
+	}
+	if err := SetHosts(""); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := lookupHosts("kept.example"); found {
+		t.Fatal("mappings not cleared")
+	}
+}
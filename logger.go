@@ -0,0 +1,132 @@
+package libcore
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LogHook receives the log entries of libcore, level is the logrus level
+// from 0 (panic) to 6 (trace).
+type LogHook interface {
+	WriteLog(level int32, tag string, message string)
+}
+
+var (
+	logHookAccess   sync.RWMutex
+	logHook         LogHook
+	logHookRegister sync.Once
+)
+
+type hostLogHook struct{}
+
+func (hook hostLogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (hook hostLogHook) Fire(e *logrus.Entry) error {
+	logHookAccess.RLock()
+	h := logHook
+	logHookAccess.RUnlock()
+	if h != nil {
+		h.WriteLog(int32(e.Level), "libcore", e.Message)
+	}
+	return nil
+}
+
+// SetLogHook forwards log entries to hook instead of stderr, nil restores stderr output.
+func SetLogHook(hook LogHook) {
+	logHookRegister.Do(func() {
+		logrus.AddHook(hostLogHook{})
+	})
+	logHookAccess.Lock()
+	logHook = hook
+	logHookAccess.Unlock()
+	if hook == nil {
+		logrus.SetOutput(os.Stderr)
+	} else {
+		logrus.SetOutput(io.Discard)
+	}
+}
+
+// SetLogLevel sets the logrus level from 0 (panic) to 6 (trace), out of range values are clamped.
+func SetLogLevel(level int32) {
+	if level < int32(logrus.PanicLevel) {
+		level = int32(logrus.PanicLevel)
+	} else if level > int32(logrus.TraceLevel) {
+		level = int32(logrus.TraceLevel)
+	}
+	logrus.SetLevel(logrus.Level(level))
+}
+
+func GetLogLevel() int32 {
+	return int32(logrus.GetLevel())
+}
+
+// The log output formats, set with SetLogFormat.
+const (
+	LogFormatText int32 = iota
+	LogFormatJSON
+)
+
+var (
+	logFormatAccess sync.Mutex
+	// textLogFormatter is the formatter of the platform replaced by SetLogFormat, the bare
+	// messages written to logcat on Android.
+	textLogFormatter logrus.Formatter
+)
+
+// SetLogFormat switches the log output between the text format of the platform and JSON
+// objects with timestamp, level and msg fields. The log hook receives the messages either
+// way.
+func SetLogFormat(format int32) error {
+	logFormatAccess.Lock()
+	defer logFormatAccess.Unlock()
+	if textLogFormatter == nil {
+		textLogFormatter = logrus.StandardLogger().Formatter
+	}
+	switch format {
+	case LogFormatText:
+		logrus.SetFormatter(textLogFormatter)
+	case LogFormatJSON:
+		logrus.SetFormatter(&logrus.JSONFormatter{
+			FieldMap: logrus.FieldMap{logrus.FieldKeyTime: "timestamp"},
+		})
+	default:
+		return newError("unknown log format ", format)
+	}
+	return nil
+}
+
+// configureLogging applies the initial log level and format from the LIBCORE_LOG_LEVEL
+// environment variable, a logrus level name or number, and LIBCORE_LOG_FORMAT, text or
+// json, so that logging can be tuned before any setter is reachable. Unset variables keep
+// the defaults.
+func configureLogging() {
+	if value := os.Getenv("LIBCORE_LOG_LEVEL"); value != "" {
+		if level, err := strconv.Atoi(value); err == nil {
+			SetLogLevel(int32(level))
+		} else if level, err := logrus.ParseLevel(value); err == nil {
+			logrus.SetLevel(level)
+		} else {
+			logrus.Warn("invalid LIBCORE_LOG_LEVEL ", value)
+		}
+	}
+	switch value := os.Getenv("LIBCORE_LOG_FORMAT"); strings.ToLower(value) {
+	case "":
+	case "text":
+		_ = SetLogFormat(LogFormatText)
+	case "json":
+		_ = SetLogFormat(LogFormatJSON)
+	default:
+		logrus.Warn("invalid LIBCORE_LOG_FORMAT ", value)
+	}
+}
+
+func init() {
+	configureLogging()
+}
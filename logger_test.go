@@ -0,0 +1,190 @@
+package libcore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+type messageFormatter struct{}
+
+func (messageFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	return []byte(entry.Message + "\n"), nil
+}
+
+// usePlatformFormatter stands in for the formatter set by the platform at init.
+func usePlatformFormatter(t *testing.T) *bytes.Buffer {
+	formatter := logrus.StandardLogger().Formatter
+	logFormatAccess.Lock()
+	saved := textLogFormatter
+	textLogFormatter = nil
+	logFormatAccess.Unlock()
+	logrus.SetFormatter(messageFormatter{})
+	var output bytes.Buffer
+	logrus.SetOutput(&output)
+	t.Cleanup(func() {
+		logFormatAccess.Lock()
+		textLogFormatter = saved
+		logFormatAccess.Unlock()
+		logrus.SetFormatter(formatter)
+		logrus.SetOutput(os.Stderr)
+	})
+	return &output
+}
+
+func TestSetLogFormatRestoresPlatformFormatter(t *testing.T) {
+	output := usePlatformFormatter(t)
+	if err := SetLogFormat(LogFormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	logrus.Warn("as json")
+	var entry map[string]interface{}
+	if err := json.Unmarshal(output.Bytes(), &entry); err != nil {
+		t.Fatal("not json: ", output.String())
+	}
+	if entry["msg"] != "as json" || entry["level"] != "warning" || entry["timestamp"] == nil {
+		t.Fatal("unexpected entry ", entry)
+	}
+
+	output.Reset()
+	if err := SetLogFormat(LogFormatText); err != nil {
+		t.Fatal(err)
+	}
+	logrus.Warn("as text")
+	if output.String() != "as text\n" {
+		t.Fatalf("text format replaced the platform formatter: %q", output.String())
+	}
+	if SetLogFormat(LogFormatJSON+1) == nil {
+		t.Fatal("unknown format accepted")
+	}
+}
+
+func TestConfigureLoggingFromEnvironment(t *testing.T) {
+	output := usePlatformFormatter(t)
+	level := logrus.GetLevel()
+	defer logrus.SetLevel(level)
+	t.Setenv("LIBCORE_LOG_LEVEL", "debug")
+	t.Setenv("LIBCORE_LOG_FORMAT", "TEXT")
+	configureLogging()
+	if logrus.GetLevel() != logrus.DebugLevel {
+		t.Fatal("unexpected level ", logrus.GetLevel())
+	}
+	logrus.Debug("plain")
+	if output.String() != "plain\n" {
+		t.Fatalf("unexpected output %q", output.String())
+	}
+
+	t.Setenv("LIBCORE_LOG_LEVEL", "2")
+	t.Setenv("LIBCORE_LOG_FORMAT", "json")
+	configureLogging()
+	if logrus.GetLevel() != logrus.ErrorLevel {
+		t.Fatal("unexpected level ", logrus.GetLevel())
+	}
+	if _, isJSON := logrus.StandardLogger().Formatter.(*logrus.JSONFormatter); !isJSON {
+		t.Fatal("json format not applied")
+	}
+}
+
+func TestConfigureLoggingDefaults(t *testing.T) {
+	usePlatformFormatter(t)
+	hook := useLogHook(t)
+	SetLogLevel(int32(logrus.WarnLevel))
+	formatter := logrus.StandardLogger().Formatter
+	// unset variables keep the defaults, as do invalid ones with a warning
+	for _, env := range [][2]string{{"", ""}, {"verbose", "xml"}} {
+		t.Setenv("LIBCORE_LOG_LEVEL", env[0])
+		t.Setenv("LIBCORE_LOG_FORMAT", env[1])
+		configureLogging()
+		if logrus.GetLevel() != logrus.WarnLevel || logrus.StandardLogger().Formatter != formatter {
+			t.Fatal("logging changed by ", env)
+		}
+	}
+	if len(hook.entries) != 2 || !strings.Contains(hook.entries[0], "invalid LIBCORE_LOG_LEVEL verbose") ||
+		!strings.Contains(hook.entries[1], "invalid LIBCORE_LOG_FORMAT xml") {
+		t.Fatal("unexpected warnings ", hook.entries)
+	}
+
+	// numbers out of range are clamped like SetLogLevel
+	t.Setenv("LIBCORE_LOG_LEVEL", "42")
+	configureLogging()
+	if logrus.GetLevel() != logrus.TraceLevel {
+		t.Fatal("unexpected level ", logrus.GetLevel())
+	}
+}
+
+type recordingLogHook struct {
+	access  sync.Mutex
+	entries []string
+}
+
+func (h *recordingLogHook) WriteLog(level int32, tag string, message string) {
+	h.access.Lock()
+	h.entries = append(h.entries, fmt.Sprint(level, " ", tag, " ", message))
+	h.access.Unlock()
+}
+
+// useLogHook forwards the logs to a recording hook for the duration of the test.
+func useLogHook(t *testing.T) *recordingLogHook {
+	hook := &recordingLogHook{}
+	level := logrus.GetLevel()
+	SetLogHook(hook)
+	t.Cleanup(func() {
+		SetLogHook(nil)
+		logrus.SetLevel(level)
+	})
+	return hook
+}
+
+func TestLogHookLevels(t *testing.T) {
+	hook := useLogHook(t)
+	SetLogLevel(int32(logrus.TraceLevel))
+	logrus.Error("error")
+	logrus.Warn("warning")
+	logrus.Info("info")
+	logrus.Debug("debug")
+	logrus.Trace("trace")
+	expected := []string{"2 libcore error", "3 libcore warning", "4 libcore info", "5 libcore debug", "6 libcore trace"}
+	if fmt.Sprint(hook.entries) != fmt.Sprint(expected) {
+		t.Fatal("unexpected entries ", hook.entries)
+	}
+	if logrus.StandardLogger().Out != io.Discard {
+		t.Fatal("logs still written to the output with a hook")
+	}
+	SetLogHook(nil)
+	logrus.Error("after")
+	if len(hook.entries) != len(expected) {
+		t.Fatal("removed hook received ", hook.entries[len(expected):])
+	}
+	if logrus.StandardLogger().Out != os.Stderr {
+		t.Fatal("stderr output not restored")
+	}
+}
+
+func TestSetLogLevel(t *testing.T) {
+	hook := useLogHook(t)
+	SetLogLevel(int32(logrus.WarnLevel))
+	if GetLogLevel() != int32(logrus.WarnLevel) {
+		t.Fatal("unexpected level ", GetLogLevel())
+	}
+	logrus.Debug("suppressed")
+	logrus.Info("suppressed")
+	logrus.Warn("kept")
+	if len(hook.entries) != 1 || hook.entries[0] != "3 libcore kept" {
+		t.Fatal("unexpected entries ", hook.entries)
+	}
+	SetLogLevel(-1)
+	if GetLogLevel() != int32(logrus.PanicLevel) {
+		t.Fatal("level not clamped to panic: ", GetLogLevel())
+	}
+	SetLogLevel(42)
+	if GetLogLevel() != int32(logrus.TraceLevel) {
+		t.Fatal("level not clamped to trace: ", GetLogLevel())
+	}
+}
@@ -0,0 +1,70 @@
+package libcore
+
+import (
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+const defaultLogRateLimit = 10
+
+// logRateLimit is the number of lines per second each rate limited log site may emit.
+var logRateLimit int32 = defaultLogRateLimit
+
+// SetLogRateLimit sets how many times per second each noisy dialer log line, such as
+// failed dials on a flapping network, may be logged. The lines beyond it are counted and
+// summarized on the next line logged. 0 disables the limit.
+func SetLogRateLimit(perSecond int32) {
+	if perSecond < 0 {
+		perSecond = 0
+	}
+	atomic.StoreInt32(&logRateLimit, perSecond)
+}
+
+// logLimiter rate limits a log site in windows of a second, with atomics only.
+type logLimiter struct {
+	// window is the Unix second of the current window, first for 64-bit alignment.
+	window     int64
+	emitted    int32
+	suppressed int32
+}
+
+var (
+	dialFailedLog  logLimiter
+	nextAddressLog logLimiter
+	dialRetryLog   logLimiter
+)
+
+// allow reports whether a line may be logged now, and how many lines were suppressed
+// since the last one if it may.
+func (l *logLimiter) allow() (bool, int32) {
+	limit := atomic.LoadInt32(&logRateLimit)
+	if limit == 0 {
+		return true, 0
+	}
+	var suppressed int32
+	now := clk.Now().Unix()
+	if window := atomic.LoadInt64(&l.window); window != now && atomic.CompareAndSwapInt64(&l.window, window, now) {
+		atomic.StoreInt32(&l.emitted, 0)
+		suppressed = atomic.SwapInt32(&l.suppressed, 0)
+	}
+	if atomic.AddInt32(&l.emitted, 1) > limit {
+		atomic.AddInt32(&l.suppressed, 1)
+		return false, 0
+	}
+	return true, suppressed
+}
+
+func (l *logLimiter) log(level logrus.Level, args ...interface{}) {
+	if !logrus.IsLevelEnabled(level) {
+		return
+	}
+	allowed, suppressed := l.allow()
+	if !allowed {
+		return
+	}
+	if suppressed > 0 {
+		args = append(args, " (x", suppressed, " suppressed)")
+	}
+	logrus.StandardLogger().Log(level, args...)
+}
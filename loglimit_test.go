@@ -0,0 +1,69 @@
+package libcore
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestLogRateLimit(t *testing.T) {
+	defer SetLogRateLimit(defaultLogRateLimit)
+	hook := useLogHook(t)
+	SetLogLevel(int32(logrus.WarnLevel))
+	fake := useFakeClock(t)
+	var limiter logLimiter
+
+	// failures from many goroutines within a second
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				limiter.log(logrus.WarnLevel, "dial system failed: connection refused")
+			}
+		}()
+	}
+	wg.Wait()
+	if n := len(hook.entries); n != defaultLogRateLimit {
+		t.Fatal(n, " lines logged, expected ", defaultLogRateLimit)
+	}
+
+	// the next window summarizes the suppressed lines
+	fake.Advance(time.Second)
+	limiter.log(logrus.WarnLevel, "dial system failed: connection refused")
+	if last := hook.entries[len(hook.entries)-1]; !strings.HasSuffix(last, "connection refused (x3990 suppressed)") {
+		t.Fatal("unexpected summary ", last)
+	}
+	limiter.log(logrus.WarnLevel, "dial system failed: connection refused")
+	if last := hook.entries[len(hook.entries)-1]; strings.Contains(last, "suppressed") {
+		t.Fatal("suppressed lines counted twice: ", last)
+	}
+
+	// lines of disabled levels are not counted
+	fake.Advance(time.Second)
+	for i := 0; i < 100; i++ {
+		limiter.log(logrus.DebugLevel, "trying next address")
+	}
+	limiter.log(logrus.WarnLevel, "dial system failed: connection refused")
+	if last := hook.entries[len(hook.entries)-1]; strings.Contains(last, "suppressed") {
+		t.Fatal("disabled lines counted: ", last)
+	}
+
+	SetLogRateLimit(0)
+	before := len(hook.entries)
+	for i := 0; i < 100; i++ {
+		limiter.log(logrus.WarnLevel, "dial system failed: connection refused")
+	}
+	if n := len(hook.entries) - before; n != 100 {
+		t.Fatal(n, " lines logged without a limit")
+	}
+	SetLogRateLimit(-1)
+	if limit := atomic.LoadInt32(&logRateLimit); limit != 0 {
+		t.Fatal("negative limit stored as ", limit)
+	}
+}
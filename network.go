@@ -0,0 +1,61 @@
+package libcore
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	resolverConnAccess  sync.Mutex
+	resolverConnEntries = make(map[*cleanupEntry]struct{})
+)
+
+// resolverConn is a persistent connection of a DoH or DoT resolver, closed by
+// OnNetworkChanged as it is likely stale on the new network.
+type resolverConn struct {
+	net.Conn
+	entry     *cleanupEntry
+	closeOnce sync.Once
+}
+
+func trackResolverConn(conn net.Conn) net.Conn {
+	c := &resolverConn{Conn: conn}
+	c.entry = &cleanupEntry{func() {
+		c.Conn.Close()
+	}}
+	resolverConnAccess.Lock()
+	resolverConnEntries[c.entry] = struct{}{}
+	resolverConnAccess.Unlock()
+	return c
+}
+
+func (c *resolverConn) Close() error {
+	c.closeOnce.Do(func() {
+		resolverConnAccess.Lock()
+		delete(resolverConnEntries, c.entry)
+		resolverConnAccess.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// OnNetworkChanged is to be called by the host app when the underlying network changes,
+// such as switching between Wi-Fi and cellular. It closes the persistent connections of
+// DoH and DoT resolvers, failing their lookups in flight, flushes the DNS caches and
+// forgets the dial history, all of which belong to the previous network.
+func OnNetworkChanged() {
+	resolverConnAccess.Lock()
+	entries := resolverConnEntries
+	resolverConnEntries = make(map[*cleanupEntry]struct{})
+	resolverConnAccess.Unlock()
+	for entry := range entries {
+		entry.closer()
+	}
+
+	FlushDNSCache()
+	bootstrapAccess.Lock()
+	bootstrapCache = make(map[string]bootstrapEntry)
+	bootstrapAccess.Unlock()
+	atomic.StoreUint32(&systemDNSPreferred, 0)
+	ClearDialHistory()
+}
@@ -0,0 +1,42 @@
+package libcore
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOnNetworkChanged(t *testing.T) {
+	server := newDotServer(t, net.IPv4(192, 0, 2, 1))
+	resolver := server.resolver(t, "")
+	defer Close()
+	if _, err := resolver.lookupIP(context.Background(), "ip", "dot.test"); err != nil {
+		t.Fatal(err)
+	}
+	resolver.access.Lock()
+	conn := resolver.conn
+	resolver.access.Unlock()
+
+	OnNetworkChanged()
+	select {
+	case <-conn.done:
+	case <-time.After(time.Second):
+		t.Fatal("resolver connection not closed")
+	}
+	resolverConnAccess.Lock()
+	tracked := len(resolverConnEntries)
+	resolverConnAccess.Unlock()
+	if tracked != 0 {
+		t.Fatal(tracked, " resolver connections still tracked")
+	}
+
+	// the next lookup connects again
+	if _, err := resolver.lookupIP(context.Background(), "ip", "dot.test"); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&server.accepted); n != 2 {
+		t.Fatal(n, " connections for the queries")
+	}
+}
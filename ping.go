@@ -0,0 +1,507 @@
+package libcore
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"libcore/comm"
+)
+
+const (
+	pingPayload        = "abcdefghijklmnopqrstuvwabcdefghi"
+	maxOutstandingPing = 4
+	pingID             = 0xDBB
+	// pingResendInterval is how often IcmpPing repeats its echo request until a reply
+	pingResendInterval = time.Second
+
+	// the largest payloads fitting a 1500 byte MTU with the IP and ICMP headers
+	maxPingPayload4 = 1500 - 20 - 8
+	maxPingPayload6 = 1500 - 40 - 8
+)
+
+// icmpPing sends an echo request with sequence number seq from source, if not nil, to ip and
+// returns the round trip time, errors are tagged with their kind by classifyPingError. The
+// request is sent again every resend until a reply arrives if resend is not 0, the round
+// trip time is then measured from the last request.
+func icmpPing(ctx context.Context, source net.IP, ip net.IP, seq int, payload []byte, timeout time.Duration, resend time.Duration) (time.Duration, error) {
+	rtt, err := icmpEcho(ctx, source, ip, seq, payload, timeout, resend)
+	return rtt, classifyPingError(err)
+}
+
+// icmpEcho does the echo exchange of icmpPing.
+func icmpEcho(ctx context.Context, source net.IP, ip net.IP, seq int, payload []byte, timeout time.Duration, resend time.Duration) (time.Duration, error) {
+	conn, raw, err := listenIcmp(ctx, source, ip)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	// the resend goroutine is waited for, it must not write once the ping returned
+	var resending sync.WaitGroup
+	defer resending.Wait()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	v6 := ip.To4() == nil
+	message := icmp.Message{
+		Body: &icmp.Echo{
+			ID:   pingID,
+			Seq:  seq & 0xffff,
+			Data: payload,
+		},
+	}
+	proto := 1
+	if !v6 {
+		message.Type = ipv4.ICMPTypeEcho
+	} else {
+		message.Type = ipv6.ICMPTypeEchoRequest
+		proto = 58
+	}
+	request, err := message.Marshal(nil)
+	if err != nil {
+		return 0, newError("make icmp message").Base(err)
+	}
+
+	timer := clk.AfterFunc(timeout, func() {
+		_ = conn.SetReadDeadline(aLongTimeAgo)
+	})
+	defer timer.Stop()
+	var destination net.Addr = &net.UDPAddr{IP: ip}
+	if raw {
+		destination = &net.IPAddr{IP: ip}
+	}
+	// lastSent is the time the last request was sent in nanoseconds of clk
+	lastSent := clk.Now().UnixNano()
+	_, err = conn.WriteTo(request, destination)
+	if err != nil {
+		return 0, newError("write icmp message").Base(err)
+	}
+	if resend > 0 {
+		resending.Add(1)
+		go func() {
+			defer resending.Done()
+			timer := clk.NewTimer(resend)
+			defer timer.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-timer.C():
+				}
+				atomic.StoreInt64(&lastSent, clk.Now().UnixNano())
+				_, err := conn.WriteTo(request, destination)
+				if err != nil {
+					logrus.Debug("failed to resend icmp message: ", err)
+				}
+				timer.Reset(resend)
+			}
+		}()
+	}
+
+	buffer := make([]byte, 1500+len(payload))
+	for {
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return 0, err
+			}
+			return 0, newError("read icmp message").Base(err)
+		}
+		packet := buffer[:n]
+		if raw && !v6 {
+			// raw IPv4 sockets receive the IP header too
+			if len(packet) < ipv4.HeaderLen {
+				continue
+			}
+			headerLen := int(packet[0]&0x0f) * 4
+			if headerLen > len(packet) {
+				continue
+			}
+			packet = packet[headerLen:]
+		}
+		reply, err := icmp.ParseMessage(proto, packet)
+		if err != nil {
+			continue
+		}
+		if reply.Type != ipv4.ICMPTypeEchoReply && reply.Type != ipv6.ICMPTypeEchoReply {
+			continue
+		}
+		// datagram sockets rewrite the identifier, raw ones receive the replies of every process
+		if echo, ok := reply.Body.(*icmp.Echo); ok && echo.Seq == seq&0xffff && (!raw || echo.ID == pingID) {
+			return clk.Now().Sub(time.Unix(0, atomic.LoadInt64(&lastSent))), nil
+		}
+	}
+}
+
+// ErrIPv6Disabled is returned when pinging an IPv6 address while IPv6 is disabled.
+var ErrIPv6Disabled = errors.New("ipv6 is disabled")
+
+// The kinds of ping failures, matched by the errors of pings with errors.Is.
+var (
+	ErrPingTimeout     = errors.New("ping timeout")
+	ErrPingUnreachable = errors.New("host unreachable")
+	ErrPingPermission  = errors.New("permission denied")
+)
+
+// The kinds returned by PingErrorKind.
+const (
+	PingErrorNone int32 = iota
+	PingErrorOther
+	PingErrorTimeout
+	PingErrorUnreachable
+	PingErrorPermission
+)
+
+// pingError keeps the cause of a failed ping while matching its kind with errors.Is.
+type pingError struct {
+	kind error
+	err  error
+}
+
+func (e *pingError) Error() string {
+	return e.err.Error()
+}
+
+func (e *pingError) Unwrap() error {
+	return e.err
+}
+
+func (e *pingError) Is(target error) bool {
+	return target == e.kind
+}
+
+// classifyPingError tags err with the kind of its underlying socket error, if known.
+func classifyPingError(err error) error {
+	var kind error
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		kind = ErrPingTimeout
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		kind = ErrPingUnreachable
+	case errors.Is(err, syscall.EPERM), errors.Is(err, syscall.EACCES):
+		kind = ErrPingPermission
+	default:
+		return err
+	}
+	return &pingError{kind, err}
+}
+
+// PingErrorKind returns the PingError kind of an error returned by the pings of libcore.
+func PingErrorKind(err error) int32 {
+	switch {
+	case err == nil:
+		return PingErrorNone
+	case errors.Is(err, ErrPingTimeout):
+		return PingErrorTimeout
+	case errors.Is(err, ErrPingUnreachable):
+		return PingErrorUnreachable
+	case errors.Is(err, ErrPingPermission):
+		return PingErrorPermission
+	default:
+		return PingErrorOther
+	}
+}
+
+// IcmpPing sends an echo request to address every second until a reply arrives, returning
+// -1 on timeout. Other failures match ErrPingUnreachable or ErrPingPermission when caused
+// by them, see PingErrorKind.
+func IcmpPing(address string, timeout int32) (int32, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return 0, newError("unable to parse ip ", address)
+	}
+	if ip.To4() == nil {
+		return Icmp6Ping(address, timeout)
+	}
+	return pingOnce(nil, ip, timeout)
+}
+
+// Icmp6Ping sends an ICMPv6 echo request to address, returning -1 on timeout like IcmpPing.
+func Icmp6Ping(address string, timeout int32) (int32, error) {
+	ip := net.ParseIP(address)
+	if ip == nil || ip.To4() != nil {
+		return 0, newError("unable to parse ipv6 address ", address)
+	}
+	if GetIPv6Mode() == comm.IPv6Disable {
+		return 0, ErrIPv6Disabled
+	}
+	return pingOnce(nil, ip, timeout)
+}
+
+// IcmpPingFrom sends an echo request to address from the local IP source, which must be of
+// the same family, to test the path of a specific interface. It returns -1 on timeout like
+// IcmpPing.
+func IcmpPingFrom(source string, address string, timeout int32) (int32, error) {
+	sourceIP := net.ParseIP(source)
+	if sourceIP == nil {
+		return 0, newError("unable to parse source ip ", source)
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return 0, newError("unable to parse ip ", address)
+	}
+	if (sourceIP.To4() == nil) != (ip.To4() == nil) {
+		return 0, newError("source ", source, " and ", address, " are of different families")
+	}
+	if ip.To4() == nil && GetIPv6Mode() == comm.IPv6Disable {
+		return 0, ErrIPv6Disabled
+	}
+	return pingOnce(sourceIP, ip, timeout)
+}
+
+func pingOnce(source net.IP, ip net.IP, timeout int32) (int32, error) {
+	rtt, err := icmpPing(context.Background(), source, ip, 1, []byte(pingPayload), time.Duration(timeout)*time.Millisecond, pingResendInterval)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return -1, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return int32(rtt.Milliseconds()), nil
+}
+
+// The methods of Ping.
+const (
+	PingMethodICMP int32 = iota
+	PingMethodTCP
+)
+
+// PingResult is the round trip time in milliseconds measured by Ping, -1 on timeout, and
+// the PingMethod used.
+type PingResult struct {
+	RTT    int32
+	Method int32
+}
+
+// Ping measures the latency to address by ICMP echo, falling back to connecting to port
+// over TCP when ICMP is not permitted, reported unreachable or times out, as networks
+// often drop ICMP.
+func Ping(address string, port int32, timeout int32) (*PingResult, error) {
+	ip, err := resolveHost(address)
+	if err != nil {
+		return nil, err
+	}
+	rtt, err := pingOnce(nil, ip, timeout)
+	if err == nil && rtt >= 0 {
+		return &PingResult{rtt, PingMethodICMP}, nil
+	}
+	if err == nil {
+		logrus.Debug("icmp ping ", address, " timed out, falling back to tcp")
+	} else if kind := PingErrorKind(err); kind != PingErrorPermission && kind != PingErrorUnreachable {
+		return nil, err
+	} else {
+		logrus.Debug("icmp ping ", address, " failed, falling back to tcp: ", err)
+	}
+	rtt, err = TcpPing(ip.String(), port, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &PingResult{rtt, PingMethodTCP}, nil
+}
+
+// The socket types of pings set with SetPingMode.
+const (
+	// PingModeAuto uses raw ICMP sockets, falling back to datagram ones when raw
+	// sockets are not permitted.
+	PingModeAuto int32 = iota
+	PingModeRaw
+	// PingModeDatagram uses the unprivileged ICMP datagram sockets.
+	PingModeDatagram
+)
+
+var pingMode = PingModeAuto
+
+// rawPingDenied is set once a raw ICMP socket was refused in PingModeAuto, so later
+// pings go straight to datagram sockets.
+var rawPingDenied uint32
+
+// SetPingMode sets the type of the ICMP sockets of pings, one of the PingMode constants.
+func SetPingMode(mode int32) error {
+	if mode < PingModeAuto || mode > PingModeDatagram {
+		return newError("invalid ping mode ", mode)
+	}
+	atomic.StoreInt32(&pingMode, mode)
+	atomic.StoreUint32(&rawPingDenied, 0)
+	return nil
+}
+
+// resolveHost parses address as an IP, or resolves it with the default dialer otherwise.
+func resolveHost(address string) (net.IP, error) {
+	ip := net.ParseIP(address)
+	mode := GetIPv6Mode()
+	if ip == nil {
+		ips, err := defaultDialer().lookup(context.Background(), address)
+		if err != nil {
+			return nil, err
+		}
+		ips = sortIPs(filterIPs(ips, mode), mode)
+		if len(ips) == 0 {
+			return nil, newError("no address of ", address, " is allowed by ipv6 mode ", mode)
+		}
+		ip = ips[0]
+	}
+	if ip.To4() == nil && mode == comm.IPv6Disable {
+		return nil, ErrIPv6Disabled
+	}
+	return ip, nil
+}
+
+// PingStats summarizes the replies of IcmpPingEx, with round trip times in milliseconds.
+type PingStats struct {
+	Sent     int32
+	Received int32
+	Lost     int32
+	Min      int32
+	Avg      int32
+	Max      int32
+	Mdev     int32
+}
+
+// IcmpPingEx sends count echo requests of payloadSize bytes to address a second apart like
+// ping -c, waiting up to timeout milliseconds for each reply.
+func IcmpPingEx(address string, count int32, payloadSize int32, timeout int32) (*PingStats, error) {
+	if count <= 0 {
+		return nil, newError("invalid count ", count)
+	}
+	ip, err := resolveHost(address)
+	if err != nil {
+		return nil, err
+	}
+	maxPayload := int32(maxPingPayload4)
+	if ip.To4() == nil {
+		maxPayload = maxPingPayload6
+	}
+	if payloadSize < 0 || payloadSize > maxPayload {
+		return nil, newError("payload size ", payloadSize, " out of range 0-", maxPayload)
+	}
+	payload := make([]byte, payloadSize)
+	for i := range payload {
+		payload[i] = pingPayload[i%len(pingPayload)]
+	}
+
+	stats := &PingStats{}
+	var sum, squareSum float64
+	for seq := 1; seq <= int(count); seq++ {
+		start := clk.Now()
+		stats.Sent++
+		rtt, err := icmpPing(context.Background(), nil, ip, seq, payload, time.Duration(timeout)*time.Millisecond, 0)
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, err
+		}
+		if err == nil {
+			ms := float64(rtt) / float64(time.Millisecond)
+			if stats.Received == 0 || int32(ms) < stats.Min {
+				stats.Min = int32(ms)
+			}
+			if int32(ms) > stats.Max {
+				stats.Max = int32(ms)
+			}
+			stats.Received++
+			sum += ms
+			squareSum += ms * ms
+		}
+		if seq < int(count) {
+			<-clk.After(time.Second - clk.Now().Sub(start))
+		}
+	}
+	stats.Lost = stats.Sent - stats.Received
+	if stats.Received > 0 {
+		avg := sum / float64(stats.Received)
+		stats.Avg = int32(avg)
+		stats.Mdev = int32(math.Sqrt(math.Max(squareSum/float64(stats.Received)-avg*avg, 0)))
+	}
+	return stats, nil
+}
+
+type PingHandler interface {
+	OnResult(seq int32, rtt int32, err string)
+}
+
+// PingSession sends echo requests on an interval until closed.
+type PingSession struct {
+	cancel     context.CancelFunc
+	unregister func()
+	wg         sync.WaitGroup
+}
+
+// StartPing pings address every interval milliseconds and reports each result to handler,
+// at most a few requests are kept outstanding if the network stalls.
+func StartPing(address string, interval int32, handler PingHandler) (*PingSession, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, newError("unable to parse ip ", address)
+	}
+	if interval <= 0 {
+		return nil, newError("invalid interval ", interval)
+	}
+	ctx, cancel := context.WithCancel(rootContext())
+	session := &PingSession{cancel: cancel}
+	session.unregister = registerCleanup(session.Close)
+	session.wg.Add(1)
+	go session.loop(ctx, ip, time.Duration(interval)*time.Millisecond, handler)
+	return session, nil
+}
+
+func (s *PingSession) loop(ctx context.Context, ip net.IP, interval time.Duration, handler PingHandler) {
+	defer s.wg.Done()
+	timeout := interval * maxOutstandingPing
+	outstanding := make(chan struct{}, maxOutstandingPing)
+	timer := clk.NewTimer(interval)
+	defer timer.Stop()
+	for seq := 1; ; seq++ {
+		select {
+		case outstanding <- struct{}{}:
+			s.wg.Add(1)
+			go func(seq int) {
+				defer s.wg.Done()
+				rtt, err := icmpPing(ctx, nil, ip, seq, []byte(pingPayload), timeout, 0)
+				<-outstanding
+				if ctx.Err() != nil {
+					return
+				}
+				if err != nil {
+					handler.OnResult(int32(seq), -1, err.Error())
+				} else {
+					handler.OnResult(int32(seq), int32(rtt.Milliseconds()), "")
+				}
+			}(seq)
+		default:
+			handler.OnResult(int32(seq), -1, "too many outstanding requests")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C():
+			timer.Reset(interval)
+		}
+	}
+}
+
+// Close stops the session and waits for the outstanding requests to finish.
+func (s *PingSession) Close() {
+	s.cancel()
+	s.unregister()
+	s.wg.Wait()
+}
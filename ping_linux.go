@@ -0,0 +1,70 @@
+//go:build linux || android
+
+package libcore
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// icmpSocket creates the sockets of pings, replaceable to simulate missing privileges.
+var icmpSocket = unix.Socket
+
+// listenIcmp creates an ICMP socket for ip protected by the default dialer and bound to
+// source if not nil, raw or datagram according to pingMode. raw reports a raw socket.
+func listenIcmp(ctx context.Context, source net.IP, ip net.IP) (conn net.PacketConn, raw bool, err error) {
+	af, proto := unix.AF_INET, unix.IPPROTO_ICMP
+	if ip.To4() == nil {
+		af, proto = unix.AF_INET6, unix.IPPROTO_ICMPV6
+	}
+	mode := atomic.LoadInt32(&pingMode)
+	var fd int
+	if mode == PingModeRaw || mode == PingModeAuto && atomic.LoadUint32(&rawPingDenied) == 0 {
+		fd, err = icmpSocket(af, unix.SOCK_RAW|unix.SOCK_CLOEXEC, proto)
+		if err == nil {
+			raw = true
+		} else if mode == PingModeRaw || !errors.Is(err, unix.EPERM) && !errors.Is(err, unix.EACCES) {
+			return nil, false, newError("create raw icmp socket").Base(err)
+		} else {
+			logrus.Debug("raw icmp socket denied, falling back to datagram sockets: ", err)
+			atomic.StoreUint32(&rawPingDenied, 1)
+		}
+	}
+	if !raw {
+		fd, err = icmpSocket(af, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, proto)
+		if err != nil {
+			return nil, false, newError("create icmp socket").Base(err)
+		}
+	}
+	if !protect(ctx, defaultDialer().protector, fd) {
+		unix.Close(fd)
+		return nil, false, errors.New("protect failed")
+	}
+	if source != nil {
+		var sockaddr unix.Sockaddr
+		if source4 := source.To4(); source4 != nil {
+			socketAddress := &unix.SockaddrInet4{}
+			copy(socketAddress.Addr[:], source4)
+			sockaddr = socketAddress
+		} else {
+			socketAddress := &unix.SockaddrInet6{}
+			copy(socketAddress.Addr[:], source)
+			sockaddr = socketAddress
+		}
+		err = unix.Bind(fd, sockaddr)
+		if err != nil {
+			unix.Close(fd)
+			return nil, false, newError("failed to bind icmp socket to ", source).Base(err)
+		}
+	}
+	file := os.NewFile(uintptr(fd), "icmp")
+	defer file.Close()
+	conn, err = net.FilePacketConn(file)
+	return conn, raw, err
+}
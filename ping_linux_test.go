@@ -0,0 +1,435 @@
+//go:build linux || android
+
+package libcore
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+)
+
+// dropIcmpReplies makes the ICMP sockets of pings discard everything they receive, as on
+// networks filtering echo replies.
+func dropIcmpReplies(t *testing.T) {
+	icmpSocket = func(domain int, typ int, proto int) (int, error) {
+		fd, err := unix.Socket(domain, typ, proto)
+		if err != nil {
+			return fd, err
+		}
+		drop := []unix.SockFilter{{Code: unix.BPF_RET | unix.BPF_K, K: 0}}
+		err = unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &unix.SockFprog{
+			Len:    uint16(len(drop)),
+			Filter: &drop[0],
+		})
+		if err != nil {
+			unix.Close(fd)
+			t.Skip("socket filters are not permitted: ", err)
+		}
+		return fd, nil
+	}
+	t.Cleanup(func() {
+		icmpSocket = unix.Socket
+	})
+}
+
+func TestPingFallsBackToTCPOnTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	dropIcmpReplies(t)
+	fake := useFakeClock(t)
+
+	type pingResult struct {
+		*PingResult
+		err error
+	}
+	results := make(chan pingResult, 1)
+	go func() {
+		result, err := Ping("127.0.0.1", int32(listener.Addr().(*net.TCPAddr).Port), 1000)
+		results <- pingResult{result, err}
+	}()
+	fake.WaitTimers(1)
+	fake.Advance(time.Second)
+	result := <-results
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+	if result.Method != PingMethodTCP || result.RTT < 0 {
+		t.Fatalf("unexpected result %+v", *result.PingResult)
+	}
+}
+
+func TestListenIcmpFallsBackToDatagram(t *testing.T) {
+	defer resetOptions()
+	var types []int
+	icmpSocket = func(domain int, typ int, proto int) (int, error) {
+		typ &^= unix.SOCK_CLOEXEC
+		types = append(types, typ)
+		if typ == unix.SOCK_RAW {
+			return -1, unix.EPERM
+		}
+		// a socket the kernel lets anyone create stands for the datagram ICMP socket
+		return unix.Socket(domain, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	}
+	defer func() {
+		icmpSocket = unix.Socket
+	}()
+
+	for i := 0; i < 2; i++ {
+		conn, raw, err := listenIcmp(context.Background(), nil, net.IPv4(127, 0, 0, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if raw {
+			t.Fatal("raw socket returned")
+		}
+	}
+	// the second ping skips the denied raw socket
+	if len(types) != 3 || types[0] != unix.SOCK_RAW || types[1] != unix.SOCK_DGRAM || types[2] != unix.SOCK_DGRAM {
+		t.Fatal("unexpected socket types ", types)
+	}
+
+	types = nil
+	_ = SetPingMode(PingModeRaw)
+	_, _, err := listenIcmp(context.Background(), nil, net.IPv4(127, 0, 0, 1))
+	if err == nil || len(types) != 1 {
+		t.Fatal("raw mode fell back to datagram sockets: ", types)
+	}
+	types = nil
+	_ = SetPingMode(PingModeDatagram)
+	conn, raw, err := listenIcmp(context.Background(), nil, net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if raw || len(types) != 1 || types[0] != unix.SOCK_DGRAM {
+		t.Fatal("unexpected socket types ", types)
+	}
+}
+
+// countEchoRequests counts the echo requests of pings to the loopback seen by a raw socket
+// until stop is closed.
+func countEchoRequests(t *testing.T, stop <-chan struct{}) <-chan int {
+	conn, err := net.ListenPacket("ip4:icmp", "127.0.0.1")
+	if err != nil {
+		t.Skip("raw sockets are not permitted: ", err)
+	}
+	count := make(chan int, 1)
+	go func() {
+		<-stop
+		conn.Close()
+	}()
+	go func() {
+		var n int
+		buffer := make([]byte, 1500)
+		for {
+			length, _, err := conn.ReadFrom(buffer)
+			if err != nil {
+				count <- n
+				return
+			}
+			message, err := icmp.ParseMessage(1, buffer[:length])
+			if err != nil || message.Type != ipv4.ICMPTypeEcho {
+				continue
+			}
+			if echo, ok := message.Body.(*icmp.Echo); ok && echo.ID == pingID {
+				n++
+			}
+		}
+	}()
+	return count
+}
+
+func TestIcmpPingResendsUntilTimeout(t *testing.T) {
+	defer resetOptions()
+	_ = SetPingMode(PingModeRaw)
+	stop := make(chan struct{})
+	count := countEchoRequests(t, stop)
+	dropIcmpReplies(t)
+	fake := useFakeClock(t)
+
+	results := make(chan int32, 1)
+	go func() {
+		rtt, err := IcmpPing("127.0.0.1", 3500)
+		if err != nil {
+			t.Error(err)
+		}
+		results <- rtt
+	}()
+	// the timeout and the resend timer
+	fake.WaitTimers(2)
+	for i := 0; i < 3; i++ {
+		fake.Advance(time.Second)
+		// let the resend go out before the next second
+		time.Sleep(20 * time.Millisecond)
+	}
+	fake.Advance(500 * time.Millisecond)
+	if rtt := <-results; rtt != -1 {
+		t.Fatal("unexpected rtt ", rtt)
+	}
+	close(stop)
+	if n := <-count; n != 4 {
+		t.Fatal("sent ", n, " echo requests, expected 4")
+	}
+}
+
+func TestTcpPing(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	defer resetOptions()
+	_ = SetHosts(`{"listener.test": ["127.0.0.1"]}`)
+	port := int32(listener.Addr().(*net.TCPAddr).Port)
+	for _, address := range []string{"127.0.0.1", "listener.test"} {
+		rtt, err := TcpPing(address, port, 1000)
+		if err != nil || rtt < 0 || rtt > 1000 {
+			t.Fatal("ping of ", address, ": ", rtt, ", ", err)
+		}
+	}
+	// without a timeout the connect timeout applies
+	for _, timeout := range []int32{0, -1} {
+		if rtt, err := TcpPing("127.0.0.1", port, timeout); err != nil || rtt < 0 {
+			t.Fatal("ping with timeout ", timeout, ": ", rtt, ", ", err)
+		}
+	}
+}
+
+func TestTcpPingBlackhole(t *testing.T) {
+	host, port, _ := net.SplitHostPort(blackhole(t))
+	portNumber, _ := strconv.Atoi(port)
+	fake := useFakeClock(t)
+	type pingResult struct {
+		rtt int32
+		err error
+	}
+	result := make(chan pingResult, 1)
+	go func() {
+		rtt, err := TcpPing(host, int32(portNumber), 1000)
+		result <- pingResult{rtt, err}
+	}()
+	fake.WaitTimers(2)
+	fake.Advance(time.Second)
+	if ping := <-result; ping.rtt != -1 || !errors.Is(ping.err, context.DeadlineExceeded) {
+		t.Fatal("unexpected result ", ping.rtt, ", ", ping.err)
+	}
+
+	// or the connect timeout without a timeout of the ping
+	defer resetOptions()
+	SetConnectTimeout(500)
+	go func() {
+		rtt, err := TcpPing(host, int32(portNumber), 0)
+		result <- pingResult{rtt, err}
+	}()
+	fake.WaitTimers(1)
+	fake.Advance(500 * time.Millisecond)
+	if ping := <-result; ping.rtt != -1 || !errors.Is(ping.err, context.DeadlineExceeded) {
+		t.Fatal("unexpected result without a timeout ", ping.rtt, ", ", ping.err)
+	}
+}
+
+type pingSessionResult struct {
+	seq int32
+	rtt int32
+	err string
+}
+
+type channelPingHandler chan pingSessionResult
+
+func (h channelPingHandler) OnResult(seq int32, rtt int32, err string) {
+	h <- pingSessionResult{seq, rtt, err}
+}
+
+func TestStartPing(t *testing.T) {
+	if _, err := StartPing("localhost", 1000, make(channelPingHandler)); err == nil {
+		t.Fatal("started a session to a domain")
+	}
+	if _, err := StartPing("127.0.0.1", 0, make(channelPingHandler)); err == nil {
+		t.Fatal("started a session without an interval")
+	}
+
+	fake := useFakeClock(t)
+	goroutines := runtime.NumGoroutine()
+	results := make(channelPingHandler, 16)
+	session, err := StartPing("127.0.0.1", 1000, results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seq := int32(1); seq <= 3; seq++ {
+		if seq > 1 {
+			select {
+			case result := <-results:
+				t.Fatalf("result before the interval %+v", result)
+			case <-time.After(50 * time.Millisecond):
+			}
+			// the timer of the interval, the one of the previous ping is stopped
+			fake.WaitTimers(1)
+			fake.Advance(time.Second)
+		}
+		result := <-results
+		if result.seq != seq || result.err != "" || result.rtt < 0 {
+			t.Fatalf("unexpected result %+v, expected seq %d", result, seq)
+		}
+	}
+	session.Close()
+	waitGoroutines(t, goroutines)
+	fake.Advance(time.Minute)
+	select {
+	case result := <-results:
+		t.Fatalf("result after close %+v", result)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPingSessionCloseWithOutstandingRequests(t *testing.T) {
+	dropIcmpReplies(t)
+	fake := useFakeClock(t)
+	goroutines := runtime.NumGoroutine()
+	results := make(channelPingHandler, 16)
+	session, err := StartPing("127.0.0.1", 1000, results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < maxOutstandingPing; i++ {
+		// the interval and the timeouts of the requests sent
+		fake.WaitTimers(1 + i)
+		fake.Advance(time.Second)
+	}
+	fake.WaitTimers(1 + maxOutstandingPing)
+	// closing aborts the requests waiting for their replies
+	session.Close()
+	waitGoroutines(t, goroutines)
+	select {
+	case result := <-results:
+		t.Fatalf("result of an aborted request %+v", result)
+	default:
+	}
+}
+
+func TestIcmp6Ping(t *testing.T) {
+	defer resetOptions()
+	rtt, err := Icmp6Ping("::1", 1000)
+	if err != nil {
+		if errors.Is(err, ErrPingPermission) {
+			t.Skip(err)
+		}
+		t.Fatal(err)
+	}
+	if rtt < 0 {
+		t.Fatal("timed out pinging ::1")
+	}
+	// IcmpPing dispatches IPv6 addresses
+	if rtt, err = IcmpPing("::1", 1000); err != nil || rtt < 0 {
+		t.Fatal("IcmpPing ::1: ", rtt, ", ", err)
+	}
+	for _, address := range []string{"127.0.0.1", "::ffff:127.0.0.1", "localhost"} {
+		if _, err = Icmp6Ping(address, 1000); err == nil {
+			t.Fatal("Icmp6Ping accepted ", address)
+		}
+	}
+
+	SetIPv6Mode(IPv6ModeDisable)
+	for _, ping := range []func(string, int32) (int32, error){IcmpPing, Icmp6Ping} {
+		if _, err = ping("::1", 1000); err != ErrIPv6Disabled {
+			t.Fatal("unexpected error with ipv6 disabled: ", err)
+		}
+	}
+	// IPv4 literals are not affected
+	if rtt, err = IcmpPing("::ffff:127.0.0.1", 1000); err != nil || rtt < 0 {
+		t.Fatal("IcmpPing ::ffff:127.0.0.1: ", rtt, ", ", err)
+	}
+}
+
+func TestIcmpPingEx(t *testing.T) {
+	stats, err := IcmpPingEx("127.0.0.1", 3, 1000, 1000)
+	if err != nil {
+		if errors.Is(err, ErrPingPermission) {
+			t.Skip(err)
+		}
+		t.Fatal(err)
+	}
+	if stats.Sent != 3 || stats.Received != 3 || stats.Lost != 0 {
+		t.Fatalf("unexpected counts %+v", *stats)
+	}
+	if stats.Min < 0 || stats.Min > stats.Avg || stats.Avg > stats.Max || stats.Max > 1000 || stats.Mdev < 0 || stats.Mdev > stats.Max {
+		t.Fatalf("implausible round trip times %+v", *stats)
+	}
+
+	for _, test := range []struct {
+		address            string
+		count, payloadSize int32
+	}{
+		{"127.0.0.1", 0, 56},
+		{"127.0.0.1", 1, -1},
+		{"127.0.0.1", 1, maxPingPayload4 + 1},
+		{"::1", 1, maxPingPayload6 + 1},
+	} {
+		if _, err = IcmpPingEx(test.address, test.count, test.payloadSize, 1000); err == nil {
+			t.Fatal("pinged ", test.address, " with count ", test.count, " and payload size ", test.payloadSize)
+		}
+	}
+}
+
+func TestIcmpPingExLost(t *testing.T) {
+	dropIcmpReplies(t)
+	stats, err := IcmpPingEx("127.0.0.1", 2, 56, 100)
+	if err != nil {
+		if errors.Is(err, ErrPingPermission) {
+			t.Skip(err)
+		}
+		t.Fatal(err)
+	}
+	if stats.Sent != 2 || stats.Received != 0 || stats.Lost != 2 || stats.Max != 0 {
+		t.Fatalf("unexpected stats %+v", *stats)
+	}
+}
+
+func TestIcmpPingFrom(t *testing.T) {
+	defer resetOptions()
+	for _, test := range [][2]string{
+		{"loopback", "127.0.0.1"},
+		{"127.0.0.1", "localhost"},
+		{"127.0.0.1", "::1"},
+		{"::1", "127.0.0.1"},
+	} {
+		if _, err := IcmpPingFrom(test[0], test[1], 1000); err == nil {
+			t.Fatal("pinged ", test[1], " from ", test[0])
+		}
+	}
+
+	rtt, err := IcmpPingFrom("127.0.0.1", "127.0.0.1", 1000)
+	if err != nil {
+		if errors.Is(err, ErrPingPermission) {
+			t.Skip(err)
+		}
+		t.Fatal(err)
+	}
+	if rtt < 0 {
+		t.Fatal("timed out pinging 127.0.0.1 from 127.0.0.1")
+	}
+	// the source must be a local address
+	if _, err = IcmpPingFrom("192.0.2.1", "127.0.0.1", 1000); err == nil {
+		t.Fatal("pinged from an address not assigned to the host")
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !android
+
+package libcore
+
+import (
+	"context"
+	"net"
+)
+
+func listenIcmp(ctx context.Context, source net.IP, ip net.IP) (net.PacketConn, bool, error) {
+	return nil, false, errUnsupportedPlatform
+}
@@ -0,0 +1,52 @@
+package libcore
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestPingErrorKind(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		kind int32
+	}{
+		{nil, PingErrorNone},
+		{errors.New("no route"), PingErrorOther},
+		{&net.OpError{Op: "read", Net: "ip4:icmp", Err: os.ErrDeadlineExceeded}, PingErrorTimeout},
+		{os.NewSyscallError("sendto", syscall.EHOSTUNREACH), PingErrorUnreachable},
+		{os.NewSyscallError("sendto", syscall.ENETUNREACH), PingErrorUnreachable},
+		{os.NewSyscallError("socket", syscall.EPERM), PingErrorPermission},
+		{os.NewSyscallError("socket", syscall.EACCES), PingErrorPermission},
+		{syscall.ECONNREFUSED, PingErrorOther},
+	} {
+		err := classifyPingError(test.err)
+		if kind := PingErrorKind(err); kind != test.kind {
+			t.Fatal(test.err, ": kind ", kind, ", expected ", test.kind)
+		}
+		if test.err == nil {
+			continue
+		}
+		// the cause is kept, and the kind survives wrapping
+		if !errors.Is(err, test.err) || err.Error() != test.err.Error() {
+			t.Fatal(test.err, ": cause lost in ", err)
+		}
+		if kind := PingErrorKind(newError("ping failed").Base(err)); kind != test.kind {
+			t.Fatal(test.err, ": kind ", kind, " once wrapped, expected ", test.kind)
+		}
+	}
+	for _, test := range []struct {
+		err  error
+		kind int32
+	}{
+		{ErrPingTimeout, PingErrorTimeout},
+		{ErrPingUnreachable, PingErrorUnreachable},
+		{ErrPingPermission, PingErrorPermission},
+	} {
+		if kind := PingErrorKind(test.err); kind != test.kind {
+			t.Fatal(test.err, ": kind ", kind, ", expected ", test.kind)
+		}
+	}
+}
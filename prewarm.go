@@ -0,0 +1,43 @@
+package libcore
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// PrewarmDNS resolves the comma separated domains concurrently with the resolver the
+// outbounds of v2ray-core dial with, the DNS of the running Tun2ray or the resolver of
+// RegisterDialer, so that its cache already holds their answers when the first connections
+// are made. Lookups still pending after timeout milliseconds are abandoned and failures
+// are only logged. It returns the number of domains resolved.
+func PrewarmDNS(domainsCsv string, timeout int32) int32 {
+	ctx, cancel := withTimeout(rootContext(), time.Duration(timeout)*time.Millisecond)
+	defer cancel()
+	dialer := systemDialer()
+	seen := make(map[string]bool)
+	var resolved int32
+	var wg sync.WaitGroup
+	for _, domain := range strings.Split(domainsCsv, ",") {
+		domain = normalizeDomain(strings.TrimSpace(domain))
+		if domain == "" || seen[domain] || net.ParseIP(domain) != nil {
+			continue
+		}
+		seen[domain] = true
+		wg.Add(1)
+		go func(domain string) {
+			defer wg.Done()
+			if _, err := dialer.lookup(ctx, domain); err != nil {
+				logrus.Debug("failed to prewarm dns for ", domain, ": ", err)
+				return
+			}
+			atomic.AddInt32(&resolved, 1)
+		}(domain)
+	}
+	wg.Wait()
+	return resolved
+}
@@ -0,0 +1,64 @@
+package libcore
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+)
+
+// countingResolver answers every domain with 192.0.2.1 except the failing one, counting
+// the lookups of each domain.
+type countingResolver struct {
+	access  sync.Mutex
+	lookups map[string]int
+	failing string
+}
+
+func (r *countingResolver) LookupIP(network string, domain string) ([]byte, error) {
+	r.access.Lock()
+	r.lookups[domain]++
+	r.access.Unlock()
+	if domain == r.failing {
+		return nil, errors.New("no such host")
+	}
+	return encodeIPs([]net.IP{net.IPv4(192, 0, 2, 1)}), nil
+}
+
+func (r *countingResolver) count(domain string) int {
+	r.access.Lock()
+	defer r.access.Unlock()
+	return r.lookups[domain]
+}
+
+func TestPrewarmDNSPopulatesRegisteredCache(t *testing.T) {
+	inner := &countingResolver{lookups: make(map[string]int), failing: "broken.example"}
+	cached, err := NewCachedResolver(inner, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	RegisterDialer(nil, cached)
+	defer UnregisterDialer()
+
+	resolved := PrewarmDNS(" a.example,b.example., A.example,,192.0.2.7,broken.example", 1000)
+	if resolved != 2 {
+		t.Fatal("resolved ", resolved, " domains, expected 2")
+	}
+	for _, domain := range []string{"a.example", "b.example", "broken.example"} {
+		if n := inner.count(domain); n != 1 {
+			t.Fatal(domain, " looked up ", n, " times")
+		}
+	}
+	if n := inner.count("192.0.2.7"); n != 0 {
+		t.Fatal("ip literal looked up")
+	}
+
+	// the dialers of v2ray-core resolve through the same cache
+	ips, err := systemDialer().lookup(rootContext(), "a.example")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Fatal("unexpected answer ", ips, err)
+	}
+	if n := inner.count("a.example"); n != 1 {
+		t.Fatal("prewarmed domain looked up again")
+	}
+}
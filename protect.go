@@ -3,22 +3,54 @@ package libcore
 import (
 	"context"
 	"errors"
-	"fmt"
 	"net"
-	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
 	"github.com/v2fly/v2ray-core/v5/features/dns"
 	"github.com/v2fly/v2ray-core/v5/transport/internet"
-	"golang.org/x/sys/unix"
+	"libcore/comm"
 )
 
 type Protector interface {
 	Protect(fd int32) bool
 }
 
+// ContextProtector is a Protector able to give up once the dial is cancelled or
+// times out, it is preferred over Protect when implemented.
+type ContextProtector interface {
+	Protector
+	ProtectContext(ctx context.Context, fd int32) bool
+}
+
+// protect protects fd, trying again as configured by SetProtectRetry while ctx allows.
+func protect(ctx context.Context, protector Protector, fd int) bool {
+	for attempt := 1; ; attempt++ {
+		var protected bool
+		if contextProtector, ok := protector.(ContextProtector); ok {
+			protected = contextProtector.ProtectContext(ctx, int32(fd))
+		} else {
+			protected = protector.Protect(int32(fd))
+		}
+		if protected || attempt >= int(atomic.LoadInt32(&protectRetryAttempts)) || ctx.Err() != nil {
+			return protected
+		}
+		delay := loadDuration(&protectRetryDelay)
+		logrus.Debug("protect failed, retrying in ", delay)
+		timer := clk.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C():
+		}
+	}
+}
+
 var noopProtectorInstance = &noopProtector{}
 
 type noopProtector struct{}
@@ -27,131 +59,733 @@ func (n *noopProtector) Protect(int32) bool {
 	return true
 }
 
+// NoopProtector returns a Protector accepting every socket without protecting it, for
+// when no VPN is running.
+func NoopProtector() Protector {
+	return noopProtectorInstance
+}
+
+// RecordingProtector accepts every socket and records their fds, for tests of code
+// dialing through libcore without a VpnService.
+type RecordingProtector struct {
+	access sync.Mutex
+	fds    []int32
+}
+
+func NewRecordingProtector() *RecordingProtector {
+	return &RecordingProtector{}
+}
+
+func (p *RecordingProtector) Protect(fd int32) bool {
+	p.access.Lock()
+	p.fds = append(p.fds, fd)
+	p.access.Unlock()
+	return true
+}
+
+// Count returns the number of Protect calls recorded.
+func (p *RecordingProtector) Count() int32 {
+	p.access.Lock()
+	defer p.access.Unlock()
+	return int32(len(p.fds))
+}
+
+// Fd returns the fd passed to the index-th Protect call, or -1 if out of range.
+func (p *RecordingProtector) Fd(index int32) int32 {
+	p.access.Lock()
+	defer p.access.Unlock()
+	if index < 0 || int(index) >= len(p.fds) {
+		return -1
+	}
+	return p.fds[index]
+}
+
+// Protected reports whether fd was passed to Protect.
+func (p *RecordingProtector) Protected(fd int32) bool {
+	p.access.Lock()
+	defer p.access.Unlock()
+	for _, protected := range p.fds {
+		if protected == fd {
+			return true
+		}
+	}
+	return false
+}
+
+// Reset forgets the recorded calls.
+func (p *RecordingProtector) Reset() {
+	p.access.Lock()
+	p.fds = nil
+	p.access.Unlock()
+}
+
+// DialObserver is notified of the steps of protected dials, for debugging the network.
+type DialObserver interface {
+	// OnResolve is called after resolving domain to the comma separated ips, whether it failed or not.
+	OnResolve(domain string, ips string, ms int32)
+	OnConnectStart(addr string)
+	// OnConnectDone is called when connecting to addr finished, err is empty on success.
+	OnConnectDone(addr string, ms int32, err string)
+}
+
+// ConnectObserver is optionally implemented by a DialObserver to learn the address each
+// successful protected dial ended up connected to, letting sticky protocols pin it.
+type ConnectObserver interface {
+	// OnConnected is called with the domain dialed, empty for IP destinations, and the IP
+	// connected to.
+	OnConnected(domain string, ip string)
+}
+
+var (
+	dialObserverAccess sync.RWMutex
+	dialObserver       DialObserver
+)
+
+// SetDialObserver sets the observer of protected dials, nil disables observing.
+func SetDialObserver(observer DialObserver) {
+	dialObserverAccess.Lock()
+	dialObserver = observer
+	dialObserverAccess.Unlock()
+}
+
+func loadDialObserver() DialObserver {
+	dialObserverAccess.RLock()
+	defer dialObserverAccess.RUnlock()
+	return dialObserver
+}
+
+// defaultFallbackDelay is the delay recommended by RFC 8305.
+const defaultFallbackDelay = 250 * time.Millisecond
+
+// fallbackDelay is the delay before the fallback address family is dialed.
+var fallbackDelay = defaultFallbackDelay
+
+// SetFallbackDelay sets the delay in milliseconds between the attempts of the preferred
+// address family and the fallback one, 250 by default. It applies to the dials started
+// afterwards.
+func SetFallbackDelay(delay int32) error {
+	if delay < 0 {
+		return newError("invalid fallback delay ", delay)
+	}
+	storeDuration(&fallbackDelay, time.Duration(delay)*time.Millisecond)
+	return nil
+}
+
 type protectedDialer struct {
 	protector Protector
-	resolver  func(ctx context.Context, domain string) ([]net.IP, error)
+	resolver  resolverFunc
+	// direct skips the SOCKS5 UDP relay, for the connections to the proxy itself
+	direct bool
+	// quiet dials are left out of the last dial statistics, the dial log and the observer,
+	// for the checks of SelfTest
+	quiet bool
+}
+
+// observer returns the dial observer, nil for quiet dials.
+func (dialer protectedDialer) observer() DialObserver {
+	if dialer.quiet {
+		return nil
+	}
+	return loadDialObserver()
+}
+
+// defaultDialerValue holds the *protectedDialer of defaultDialer, replaced by Tun2ray.
+var defaultDialerValue atomic.Value
+
+func init() {
+	// assigned here since lookupDefault dials through defaultDialer itself
+	setDefaultDialer(&protectedDialer{
+		protector: noopProtectorInstance,
+		resolver:  lookupDefault,
+	})
+}
+
+// defaultDialer returns the dialer of the connections made outside of v2ray-core, such as
+// TcpPing.
+func defaultDialer() *protectedDialer {
+	return defaultDialerValue.Load().(*protectedDialer)
+}
+
+func setDefaultDialer(dialer *protectedDialer) {
+	defaultDialerValue.Store(dialer)
+}
+
+// systemDialerValue holds the *protectedDialer v2ray-core dials its outbounds with, nil
+// while it uses its own.
+var systemDialerValue atomic.Value
+
+// useSystemDialer makes v2ray-core dial with dialer, nil restores its own dialer.
+func useSystemDialer(dialer *protectedDialer) {
+	if dialer == nil {
+		internet.UseAlternativeSystemDialer(nil)
+	} else {
+		internet.UseAlternativeSystemDialer(dialer)
+	}
+	systemDialerValue.Store(dialer)
+}
+
+// systemDialer returns the dialer of the outbounds of v2ray-core, or the default dialer if
+// none is registered.
+func systemDialer() *protectedDialer {
+	if dialer, _ := systemDialerValue.Load().(*protectedDialer); dialer != nil {
+		return dialer
+	}
+	return defaultDialer()
+}
+
+// ProtectedDialer is a dialer whose sockets are protected from the VPN.
+type ProtectedDialer struct {
+	protectedDialer
+}
+
+// NewProtectedDialer creates a dialer protecting its sockets with protector and resolving
+// domains with resolver, nil values fall back to no protection and the system resolver.
+func NewProtectedDialer(protector Protector, resolver Resolver) *ProtectedDialer {
+	if protector == nil {
+		protector = noopProtectorInstance
+	}
+	dialer := &ProtectedDialer{protectedDialer{
+		protector: protector,
+		resolver:  lookupDefault,
+	}}
+	if resolver != nil {
+		dialer.resolver = newResolverFunc(resolver)
+	}
+	return dialer
+}
+
+// DialConn is DialProtected with the protector and resolver of the dialer, the way the host
+// app dials with it since Dial takes types of v2ray-core.
+func (d *ProtectedDialer) DialConn(network string, address string, timeout int32) (*Conn, error) {
+	return dialConn(&d.protectedDialer, network, address, timeout)
+}
+
+var (
+	registerAccess    sync.Mutex
+	unregisterCleanup func()
+)
+
+// RegisterDialer makes v2ray-core dial the connections of its outbounds with a protected
+// dialer created like NewProtectedDialer, for embedders not using Tun2ray. It stays
+// registered until UnregisterDialer or Close.
+func RegisterDialer(protector Protector, resolver Resolver) {
+	registerAccess.Lock()
+	defer registerAccess.Unlock()
+	useSystemDialer(&NewProtectedDialer(protector, resolver).protectedDialer)
+	if unregisterCleanup == nil {
+		unregisterCleanup = registerCleanup(UnregisterDialer)
+	}
+}
+
+// UnregisterDialer restores the default dialer of v2ray-core.
+func UnregisterDialer() {
+	registerAccess.Lock()
+	defer registerAccess.Unlock()
+	useSystemDialer(nil)
+	if unregisterCleanup != nil {
+		unregisterCleanup()
+		unregisterCleanup = nil
+	}
 }
 
 func (dialer protectedDialer) Dial(ctx context.Context, source v2rayNet.Address, destination v2rayNet.Destination, sockopt *internet.SocketConfig) (conn net.Conn, err error) {
 	if destination.Network == v2rayNet.Network_Unknown || destination.Address == nil {
-		panic("connect to invalid destination")
+		return nil, errors.New("invalid destination")
+	}
+	dialStart := clk.Now()
+	defer func() {
+		if !dialer.quiet {
+			logDial(destination, dialStart, conn, err)
+		}
+	}()
+	if destination.Network == v2rayNet.Network_UNIX {
+		conn, err = dialer.dialUnix(ctx, destination)
+		if err != nil {
+			return nil, &ConnectError{ErrorKindConnect, err}
+		}
+		return conn, nil
 	}
-
 	var ips []net.IP
+	mode := GetIPv6Mode()
+	observer := dialer.observer()
 	if destination.Address.Family().IsDomain() {
-		ips, err = dialer.resolver(ctx, destination.Address.Domain())
-		if err == nil && len(ips) == 0 {
-			err = dns.ErrEmptyResponse
+		var start time.Time
+		if observer != nil {
+			start = clk.Now()
+		}
+		ips, err = dialer.lookup(ctx, destination.Address.Domain())
+		if observer != nil {
+			addresses := make([]string, 0, len(ips))
+			for _, ip := range ips {
+				addresses = append(addresses, ip.String())
+			}
+			observer.OnResolve(destination.Address.Domain(), strings.Join(addresses, ","), int32(clk.Now().Sub(start).Milliseconds()))
 		}
 		if err != nil {
-			return nil, err
+			return nil, &ResolveError{ErrorKindResolve, destination.Address.Domain(), err}
+		}
+		mode = sockoptIPv6Mode(sockopt, mode)
+		ips = filterIPs(ips, mode)
+		if len(ips) == 0 {
+			err = newError("no address is allowed by ipv6 mode ", mode)
+			return nil, &ResolveError{ErrorKindResolve, destination.Address.Domain(), err}
+		}
+		if loadBool(&filterBogons) {
+			ips = dropBogons(destination.Address.Domain(), ips)
+			if len(ips) == 0 {
+				return nil, &ResolveError{ErrorKindResolve, destination.Address.Domain(), dns.ErrEmptyResponse}
+			}
 		}
 	} else {
 		ips = append(ips, destination.Address.IP())
 	}
+	ips = filterBlocked(ips, destination.Port.Value())
+	if len(ips) == 0 {
+		return nil, ErrBlocked
+	}
+
+	if destination.Network == v2rayNet.Network_UDP && loadBool(&socksUDP) && !dialer.direct {
+		if socksAddress := loadString(&upstreamSocksAddress); socksAddress != "" {
+			// domains are resolved here so that the proxy relays to an address allowed by the
+			// dial filter
+			target := v2rayNet.UDPDestination(v2rayNet.IPAddress(sortIPs(ips, mode)[0]), destination.Port)
+			conn, err = dialer.dialSocksUDP(ctx, socksAddress, target)
+			if _, isSocksError := err.(*socksError); !isSocksError {
+				return conn, err
+			}
+			logrus.Warn("failed to relay udp through socks ", socksAddress, ", falling back to direct: ", err)
+		}
+	}
+
+	if deadline := loadDuration(&dialDeadline); deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = withTimeout(ctx, deadline)
+		defer cancel()
+	}
 
+	ips = sortIPs(ips, mode)
+	if limit := int(atomic.LoadInt32(&maxDialCandidates)); limit > 0 && len(ips) > limit {
+		// sorted addresses interleave the families, so both are kept
+		ips = ips[:limit]
+	}
+	switch atomic.LoadInt32(&dialStrategy) {
+	case DialStrategySequential:
+		var errs dialError
+		conn, errs = dialer.dialSerial(ctx, source, destination, sockopt, ips)
+		err = errs.join()
+	case DialStrategyParallelAll:
+		conn, err = dialer.dialAll(ctx, source, destination, sockopt, ips)
+	default:
+		conn, err = dialer.dialPreferredFamily(ctx, source, destination, sockopt, ips)
+	}
+	if err != nil {
+		return nil, &ConnectError{ErrorKindConnect, err}
+	}
+	if observer, ok := observer.(ConnectObserver); ok {
+		var domain string
+		if destination.Address.Family().IsDomain() {
+			domain = destination.Address.Domain()
+		}
+		if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+			observer.OnConnected(domain, host)
+		}
+	}
+	return conn, nil
+}
+
+// dialPreferredFamily dials the addresses of the family of ips[0] first, racing the other
+// family after fallbackDelay as described in RFC 8305.
+func (dialer protectedDialer) dialPreferredFamily(ctx context.Context, source v2rayNet.Address, destination v2rayNet.Destination, sockopt *internet.SocketConfig, ips []net.IP) (conn net.Conn, err error) {
+	var primaries, fallbacks []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (ips[0].To4() != nil) {
+			primaries = append(primaries, ip)
+		} else {
+			fallbacks = append(fallbacks, ip)
+		}
+	}
+	if len(fallbacks) == 0 {
+		conn, errs := dialer.dialSerial(ctx, source, destination, sockopt, primaries)
+		return conn, errs.join()
+	}
+
+	// remember the domains with broken IPv6 to avoid waiting for it on every dial
+	var domain string
+	if destination.Address.Family().IsDomain() && destination.Network == v2rayNet.Network_TCP {
+		domain = destination.Address.Domain()
+	}
+	primaryIPv6 := primaries[0].To4() == nil
+	if primaryIPv6 && domain != "" && ipv6RecentlyFailed(domain) {
+		logrus.Debug("ipv6 of ", domain, " failed recently, trying ipv4 first")
+		primaries, fallbacks = fallbacks, primaries
+		domain = ""
+	}
+	conn, err = dialer.dialParallel(ctx, source, destination, sockopt, primaries, fallbacks)
+	if domain != "" && err == nil {
+		if remoteAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			if remoteAddr.IP.To4() == nil {
+				recordIPv6Success(domain)
+			} else if primaryIPv6 {
+				recordIPv6Failure(domain)
+			}
+		}
+	}
+	return conn, err
+}
+
+func (dialer protectedDialer) dialSerial(ctx context.Context, source v2rayNet.Address, destination v2rayNet.Destination, sockopt *internet.SocketConfig, ips []net.IP) (net.Conn, dialError) {
+	var errs dialError
 	for i, ip := range ips {
 		if i > 0 {
-			if err == nil {
+			dialFailedLog.log(logrus.WarnLevel, "dial system failed: ", errs[i-1])
+			if ctx.Err() != nil {
 				break
-			} else {
-				logrus.Warn("dial system failed: ", err)
 			}
-			logrus.Debug("trying next address: ", ip.String())
+			nextAddressLog.log(logrus.DebugLevel, "trying next address: ", ip.String())
 		}
 		destination.Address = v2rayNet.IPAddress(ip)
-		conn, err = dialer.dial(ctx, source, destination, sockopt)
+		conn, err := dialer.dialRetry(ctx, source, destination, sockopt)
+		if err == nil {
+			dialer.recordDialFamily(ip)
+			return conn, nil
+		}
+		errs = append(errs, &addressError{destination.NetAddr(), err})
 	}
 
-	return conn, err
+	return nil, errs
 }
 
-func (dialer protectedDialer) dial(ctx context.Context, source v2rayNet.Address, destination v2rayNet.Destination, sockopt *internet.SocketConfig) (conn net.Conn, err error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// dialAll dials all ips concurrently, returning the first connection established and
+// closing the others.
+func (dialer protectedDialer) dialAll(ctx context.Context, source v2rayNet.Address, destination v2rayNet.Destination, sockopt *internet.SocketConfig, ips []net.IP) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	destIp := destination.Address.IP()
-	ipv6 := len(destIp) != net.IPv4len
-	fd, err := getFd(destination.Network, ipv6)
-	if err != nil {
-		return nil, err
+	type dialResult struct {
+		net.Conn
+		ip  net.IP
+		err *addressError
 	}
-
-	if !dialer.protector.Protect(int32(fd)) {
-		unix.Close(fd)
-		return nil, errors.New("protect failed")
+	results := make(chan dialResult, len(ips))
+	for _, ip := range ips {
+		destination.Address = v2rayNet.IPAddress(ip)
+		go func(ip net.IP, destination v2rayNet.Destination) {
+			conn, err := dialer.dialRetry(ctx, source, destination, sockopt)
+			if err != nil {
+				results <- dialResult{err: &addressError{destination.NetAddr(), err}}
+			} else {
+				results <- dialResult{Conn: conn, ip: ip}
+			}
+		}(ip, destination)
 	}
+	var errs dialError
+	for i := range ips {
+		res := <-results
+		if res.Conn == nil {
+			errs = append(errs, res.err)
+			continue
+		}
+		go func(pending int) {
+			for ; pending > 0; pending-- {
+				if res := <-results; res.Conn != nil {
+					res.Conn.Close()
+				}
+			}
+		}(len(ips) - i - 1)
+		dialer.recordDialFamily(res.ip)
+		return res.Conn, nil
+	}
+	return nil, errs.join()
+}
 
-	if sockopt != nil {
-		internet.ApplySockopt(sockopt, destination, uintptr(fd), ctx)
+func (dialer protectedDialer) recordDialFamily(ip net.IP) {
+	if dialer.quiet {
+		return
 	}
+	if ip.To4() != nil {
+		atomic.StoreUint32(&lastDialFamily, 4)
+	} else {
+		atomic.StoreUint32(&lastDialFamily, 6)
+	}
+}
 
-	var sockaddr unix.Sockaddr
-	if !ipv6 {
-		socketAddress := &unix.SockaddrInet4{
-			Port: int(destination.Port),
+// dialRetry dials destination, retrying transient failures as configured by SetDialRetry
+// with linear backoff while ctx allows.
+func (dialer protectedDialer) dialRetry(ctx context.Context, source v2rayNet.Address, destination v2rayNet.Destination, sockopt *internet.SocketConfig) (net.Conn, error) {
+	observer := dialer.observer()
+	for attempt := 1; ; attempt++ {
+		var start time.Time
+		if observer != nil {
+			observer.OnConnectStart(destination.NetAddr())
+			start = clk.Now()
 		}
-		copy(socketAddress.Addr[:], destIp)
-		sockaddr = socketAddress
-	} else {
-		socketAddress := &unix.SockaddrInet6{
-			Port: int(destination.Port),
+		conn, err := dialer.dial(ctx, source, destination, sockopt)
+		if observer != nil {
+			var errStr string
+			if err != nil {
+				errStr = err.Error()
+			}
+			observer.OnConnectDone(destination.NetAddr(), int32(clk.Now().Sub(start).Milliseconds()), errStr)
+		}
+		if err == nil || attempt > int(atomic.LoadInt32(&dialRetryAttempts)) || ctx.Err() != nil || !isTransientDialError(err) {
+			return conn, err
+		}
+		backoff := time.Duration(attempt) * loadDuration(&dialRetryBackoff)
+		if deadline, ok := ctx.Deadline(); ok && deadline.Sub(clk.Now()) < backoff {
+			return nil, err
+		}
+		dialRetryLog.log(logrus.DebugLevel, "dial ", destination.NetAddr(), " failed, retrying in ", backoff, ": ", err)
+		timer := clk.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C():
 		}
-		copy(socketAddress.Addr[:], destIp)
-		sockaddr = socketAddress
 	}
+}
 
-	err = unix.Connect(fd, sockaddr)
-	if err != nil {
-		unix.Close(fd)
-		return nil, err
+// dialParallel races the primary and fallback address families as described in RFC 8305,
+// starting the fallback attempts after fallbackDelay or as soon as the primaries fail.
+func (dialer protectedDialer) dialParallel(ctx context.Context, source v2rayNet.Address, destination v2rayNet.Destination, sockopt *internet.SocketConfig, primaries []net.IP, fallbacks []net.IP) (net.Conn, error) {
+	type dialResult struct {
+		net.Conn
+		errs    dialError
+		primary bool
+		done    bool
 	}
+	results := make(chan dialResult)
+	returned := make(chan struct{})
+	defer close(returned)
 
-	file := os.NewFile(uintptr(fd), "socket")
-	if file == nil {
-		return nil, errors.New("failed to connect to fd")
+	startRacer := func(ctx context.Context, primary bool) {
+		ips := primaries
+		if !primary {
+			ips = fallbacks
+		}
+		conn, errs := dialer.dialSerial(ctx, source, destination, sockopt, ips)
+		select {
+		case results <- dialResult{Conn: conn, errs: errs, primary: primary, done: true}:
+		case <-returned:
+			if conn != nil {
+				conn.Close()
+			}
+		}
 	}
-	defer file.Close()
 
-	switch destination.Network {
-	case v2rayNet.Network_UDP:
-		pc, err := net.FilePacketConn(file)
-		if err == nil {
-			destAddr, err := net.ResolveUDPAddr("udp", destination.NetAddr())
-			if err != nil {
-				return nil, err
+	var primary, fallback dialResult
+
+	primaryCtx, primaryCancel := context.WithCancel(ctx)
+	defer primaryCancel()
+	go startRacer(primaryCtx, true)
+
+	fallbackTimer := clk.NewTimer(loadDuration(&fallbackDelay))
+	defer fallbackTimer.Stop()
+
+	for {
+		select {
+		case <-fallbackTimer.C():
+			fallbackCtx, fallbackCancel := context.WithCancel(ctx)
+			defer fallbackCancel()
+			go startRacer(fallbackCtx, false)
+		case res := <-results:
+			if res.Conn != nil {
+				return res.Conn, nil
+			}
+			if res.primary {
+				primary = res
+			} else {
+				fallback = res
+			}
+			if primary.done && fallback.done {
+				return nil, append(primary.errs, fallback.errs...).join()
 			}
-			conn = &internet.PacketConnWrapper{
-				Conn: pc,
-				Dest: destAddr,
+			if res.primary && fallbackTimer.Stop() {
+				fallbackTimer.Reset(0)
 			}
 		}
-	default:
-		conn, err = net.FileConn(file)
 	}
+}
 
-	if err != nil {
-		return nil, err
+const (
+	ErrorKindResolve = "resolve"
+	ErrorKindConnect = "connect"
+)
+
+// ResolveError is returned by protected dials failing to resolve the destination.
+type ResolveError struct {
+	// Kind is ErrorKindResolve, telling the errors apart over gomobile.
+	Kind   string
+	Domain string
+	err    error
+}
+
+func (e *ResolveError) Error() string {
+	return "resolve " + e.Domain + ": " + e.err.Error()
+}
+
+func (e *ResolveError) Unwrap() error {
+	return e.err
+}
+
+// ConnectError is returned by protected dials failing to connect to any resolved address.
+type ConnectError struct {
+	// Kind is ErrorKindConnect, telling the errors apart over gomobile.
+	Kind string
+	err  error
+}
+
+func (e *ConnectError) Error() string {
+	return e.err.Error()
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.err
+}
+
+// addressError is the failure of dialing a single address.
+type addressError struct {
+	address string
+	err     error
+}
+
+func (e *addressError) Error() string {
+	return e.address + ": " + e.err.Error()
+}
+
+func (e *addressError) Unwrap() error {
+	return e.err
+}
+
+// dialError lists the failures of all addresses attempted by a dial.
+type dialError []*addressError
+
+func (e dialError) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
 	}
+	return "dial failed: " + strings.Join(messages, "; ")
+}
 
-	return conn, nil
+// Is and As match any of the failures, the module targets Go 1.18 where errors does not
+// unwrap to multiple errors.
+func (e dialError) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
 }
 
-func getFd(network v2rayNet.Network, ipv6 bool) (fd int, err error) {
-	var af int
-	if !ipv6 {
-		af = unix.AF_INET
-	} else {
-		af = unix.AF_INET6
-	}
-	switch network {
-	case v2rayNet.Network_TCP:
-		fd, err = unix.Socket(af, unix.SOCK_STREAM, unix.IPPROTO_TCP)
-	case v2rayNet.Network_UDP:
-		fd, err = unix.Socket(af, unix.SOCK_DGRAM, unix.IPPROTO_UDP)
-	case v2rayNet.Network_UNIX:
-		fd, err = unix.Socket(af, unix.SOCK_STREAM, 0)
+func (e dialError) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// join returns nil if nothing failed and the failure of the address if only one was attempted.
+func (e dialError) join() error {
+	switch len(e) {
+	case 0:
+		return nil
+	case 1:
+		return e[0]
 	default:
-		err = fmt.Errorf("unknow network")
+		return e
+	}
+}
+
+// lookup resolves domain with the resolver of dialer, giving up after the resolve timeout
+// even if the resolver ignores ctx.
+func (dialer protectedDialer) lookup(ctx context.Context, domain string) ([]net.IP, error) {
+	ctx, cancel := withTimeout(ctx, loadDuration(&resolveTimeout))
+	defer cancel()
+	type lookupResult struct {
+		ips []net.IP
+		err error
+	}
+	result := make(chan lookupResult, 1)
+	go func() {
+		ips, err := dialer.resolver(ctx, domain)
+		result <- lookupResult{ips, err}
+	}()
+	select {
+	case result := <-result:
+		if result.err == nil && len(result.ips) == 0 {
+			return nil, dns.ErrEmptyResponse
+		}
+		return result.ips, result.err
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, newError("dns timeout resolving ", domain)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// sockoptIPv6Mode returns the IPv6 mode matching the domain strategy of sockopt, mode
+// if it has none.
+func sockoptIPv6Mode(sockopt *internet.SocketConfig, mode int32) int32 {
+	if sockopt == nil {
+		return mode
+	}
+	switch sockopt.DomainStrategy {
+	case internet.DomainStrategy_USE_IP:
+		// both families, keeping the preference of mode
+		if mode == comm.IPv6Disable || mode == comm.IPv6Only {
+			return comm.IPv6Enable
+		}
+		return mode
+	case internet.DomainStrategy_USE_IP4:
+		return comm.IPv6Disable
+	case internet.DomainStrategy_USE_IP6:
+		return comm.IPv6Only
+	default:
+		return mode
+	}
+}
+
+// filterIPs drops the addresses of the family disabled by the IPv6 mode.
+func filterIPs(ips []net.IP, mode int32) []net.IP {
+	if mode != comm.IPv6Disable && mode != comm.IPv6Only {
+		return ips
+	}
+	filtered := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (mode == comm.IPv6Disable) {
+			filtered = append(filtered, ip)
+		}
+	}
+	return filtered
+}
+
+// sortIPs interleaves IPv4 and IPv6 addresses, starting with the family preferred by the
+// IPv6 mode.
+func sortIPs(ips []net.IP, mode int32) []net.IP {
+	var ip4, ip6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			ip4 = append(ip4, ip)
+		} else {
+			ip6 = append(ip6, ip)
+		}
+	}
+	primaries, fallbacks := ip4, ip6
+	if mode == comm.IPv6Prefer || mode == comm.IPv6Only {
+		primaries, fallbacks = ip6, ip4
+	}
+	sorted := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(primaries) || i < len(fallbacks); i++ {
+		if i < len(primaries) {
+			sorted = append(sorted, primaries[i])
+		}
+		if i < len(fallbacks) {
+			sorted = append(sorted, fallbacks[i])
+		}
 	}
-	return
+	return sorted
 }
@@ -0,0 +1,508 @@
+//go:build linux || android
+
+package libcore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/transport/internet"
+	"golang.org/x/sys/unix"
+)
+
+// SOL_MPTCP and MPTCP_INFO from linux/mptcp.h, missing in x/sys/unix
+const (
+	solMptcp  = 284
+	mptcpInfo = 1
+)
+
+// dialSocket creates the sockets of dials and listeners, replaceable to simulate exhausted
+// descriptors.
+var dialSocket = unix.Socket
+
+// newSocket creates a socket, collecting garbage and retrying once if the process or
+// system ran out of descriptors, to reclaim the ones of unreachable files not finalized yet.
+func newSocket(domain int, typ int, proto int) (int, error) {
+	fd, err := dialSocket(domain, typ, proto)
+	if err == unix.EMFILE || err == unix.ENFILE {
+		logrus.Warn("out of file descriptors, retrying after garbage collection: ", err)
+		runtime.GC()
+		fd, err = dialSocket(domain, typ, proto)
+	}
+	return fd, err
+}
+
+// SetFdSoftLimit raises the soft limit of open file descriptors of the process to n,
+// bounded by the hard limit. It never lowers the limit.
+func SetFdSoftLimit(n int32) error {
+	var limit unix.Rlimit
+	err := unix.Getrlimit(unix.RLIMIT_NOFILE, &limit)
+	if err != nil {
+		return newError("failed to get fd limit").Base(err)
+	}
+	wanted := uint64(n)
+	if wanted > limit.Max {
+		logrus.Warn("fd soft limit ", n, " exceeds the hard limit ", limit.Max)
+		wanted = limit.Max
+	}
+	if n <= 0 || wanted <= limit.Cur {
+		return nil
+	}
+	limit.Cur = wanted
+	err = unix.Setrlimit(unix.RLIMIT_NOFILE, &limit)
+	if err != nil {
+		return newError("failed to set fd limit").Base(err)
+	}
+	return nil
+}
+
+func isTransientDialError(err error) bool {
+	return errors.Is(err, unix.EHOSTUNREACH) ||
+		errors.Is(err, unix.ENETUNREACH) ||
+		errors.Is(err, unix.ETIMEDOUT) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+func (dialer protectedDialer) dial(ctx context.Context, source v2rayNet.Address, destination v2rayNet.Destination, sockopt *internet.SocketConfig) (conn net.Conn, err error) {
+	// internet.SocketConfig has no dial timeout, outbounds needing a shorter one than
+	// connectTimeout set a deadline on ctx, which is kept by WithTimeout
+	ctx, cancel := withConnectTimeout(ctx)
+	defer cancel()
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	destIp := destination.Address.IP()
+	ipv6 := len(destIp) != net.IPv4len
+	bindInterface := loadString(&bindInterfaceName)
+	mptcp := loadBool(&multipathTCP)
+	// destinations carry no zone, link-local addresses are scoped to the bound interface
+	var zone string
+	if ipv6 && (destIp.IsLinkLocalUnicast() || destIp.IsLinkLocalMulticast()) {
+		zone = bindInterface
+	}
+	fd, err := getFd(destination.Network, ipv6, mptcp)
+	if err != nil {
+		return nil, err
+	}
+
+	if bindInterface != "" {
+		err = unix.BindToDevice(fd, bindInterface)
+		if err != nil {
+			unix.Close(fd)
+			return nil, newError("failed to bind socket to interface ", bindInterface).Base(err)
+		}
+	}
+
+	if !protect(ctx, dialer.protector, fd) {
+		unix.Close(fd)
+		return nil, errors.New("protect failed")
+	}
+
+	if mark := atomic.LoadInt32(&socketMark); mark != 0 {
+		err = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, int(mark))
+		if err == unix.EPERM {
+			logrus.Warn("failed to set socket mark ", mark, ": ", err)
+		} else if err != nil {
+			unix.Close(fd)
+			return nil, err
+		}
+	}
+
+	if size := atomic.LoadInt32(&socketSendBuffer); size > 0 {
+		setSocketBuffer(fd, unix.SO_SNDBUF, size)
+	}
+	if size := atomic.LoadInt32(&udpReadBuffer); destination.Network == v2rayNet.Network_UDP && size > 0 {
+		setSocketBuffer(fd, unix.SO_RCVBUF, size)
+	} else if size = atomic.LoadInt32(&socketReceiveBuffer); size > 0 {
+		setSocketBuffer(fd, unix.SO_RCVBUF, size)
+	}
+
+	if class := atomic.LoadInt32(&dscp); class != 0 {
+		if !ipv6 {
+			err = unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TOS, int(class)<<2)
+		} else {
+			err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, int(class)<<2)
+		}
+		if err != nil {
+			unix.Close(fd)
+			return nil, newError("failed to set dscp ", class).Base(err)
+		}
+	}
+
+	if destination.Network == v2rayNet.Network_TCP {
+		err = applyTcpOptions(fd)
+		if err != nil {
+			unix.Close(fd)
+			return nil, err
+		}
+	}
+
+	if sockopt != nil {
+		err = internet.ApplySockopt(sockopt, destination, uintptr(fd), ctx)
+		if err != nil {
+			if loadBool(&strictSockopt) {
+				unix.Close(fd)
+				return nil, newError("failed to apply socket options").Base(err)
+			}
+			logrus.Warn("failed to apply socket options: ", err)
+		}
+	}
+
+	if source != nil && source.Family().IsIP() && !source.IP().IsUnspecified() {
+		err = bindSource(fd, source.IP(), ipv6)
+		if err != nil {
+			unix.Close(fd)
+			return nil, err
+		}
+	}
+
+	var sockaddr unix.Sockaddr
+	if !ipv6 {
+		socketAddress := &unix.SockaddrInet4{
+			Port: int(destination.Port),
+		}
+		copy(socketAddress.Addr[:], destIp)
+		sockaddr = socketAddress
+	} else {
+		socketAddress := &unix.SockaddrInet6{
+			Port: int(destination.Port),
+		}
+		copy(socketAddress.Addr[:], destIp)
+		if zone != "" {
+			iface, err := net.InterfaceByName(zone)
+			if err != nil {
+				unix.Close(fd)
+				return nil, newError("failed to find zone ", zone).Base(err)
+			}
+			socketAddress.ZoneId = uint32(iface.Index)
+		}
+		sockaddr = socketAddress
+	}
+
+	// unconnected UDP sockets receive from any peer, the kernel binds them on the first send
+	var rtt time.Duration
+	connected := destination.Network != v2rayNet.Network_UDP || loadBool(&udpConnected)
+	if connected {
+		start := clk.Now()
+		err = connectContext(ctx, fd, sockaddr)
+		if err != nil {
+			unix.Close(fd)
+			return nil, err
+		}
+		if destination.Network == v2rayNet.Network_TCP {
+			rtt = clk.Now().Sub(start)
+		}
+	}
+	if !dialer.quiet {
+		var localAddr string
+		if connected {
+			localAddr = localAddress(fd)
+		}
+		atomic.StoreInt64(&lastDialRTT, int64(rtt))
+		setLastLocalAddr(localAddr)
+
+		if destination.Network == v2rayNet.Network_TCP {
+			var usedMultipathTCP uint32
+			if mptcp && mptcpNegotiated(fd) {
+				usedMultipathTCP = 1
+			}
+			atomic.StoreUint32(&lastDialUsedMultipathTCP, usedMultipathTCP)
+		}
+	}
+
+	file := os.NewFile(uintptr(fd), "socket")
+	if file == nil {
+		return nil, errors.New("failed to connect to fd")
+	}
+	defer file.Close()
+
+	switch destination.Network {
+	case v2rayNet.Network_UDP:
+		pc, err := net.FilePacketConn(file)
+		if err != nil {
+			return nil, err
+		}
+		packetConn := newDialerPacketConn(pc)
+		destAddr := &net.UDPAddr{
+			IP:   destIp,
+			Port: int(destination.Port),
+			Zone: zone,
+		}
+		if interval := loadDuration(&udpKeepAliveInterval); interval > 0 {
+			packetConn.startKeepAlive(destAddr, interval)
+		}
+		conn = &internet.PacketConnWrapper{
+			Conn: packetConn,
+			Dest: destAddr,
+		}
+	default:
+		conn, err = net.FileConn(file)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// net.FileConn always enables TCP_NODELAY, and since Go 1.23 keepalive with the defaults
+	// of the net package, so they can only be changed afterwards
+	if tcpConn, isTcp := conn.(*net.TCPConn); isTcp {
+		if !loadBool(&tcpNoDelay) {
+			err = tcpConn.SetNoDelay(false)
+		}
+		if err == nil {
+			err = restoreKeepAlive(tcpConn)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if destination.Network != v2rayNet.Network_UDP {
+		conn = newDialerConn(conn)
+	}
+
+	return conn, nil
+}
+
+// setSocketBuffer sets the buffer size option of fd, warning if the kernel clamps it.
+func setSocketBuffer(fd int, option int, size int32) {
+	err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, option, int(size))
+	if err != nil {
+		logrus.Warn("failed to set socket buffer size ", size, ": ", err)
+		return
+	}
+	// the kernel doubles the requested size for bookkeeping overhead
+	actual, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, option)
+	if err == nil && actual < int(size) {
+		logrus.Warn("socket buffer size clamped to ", actual, ", requested ", size)
+	}
+}
+
+// applyTcpOptions applies the package level TCP options to fd.
+func applyTcpOptions(fd int) error {
+	err := setKeepAlive(fd)
+	if err != nil {
+		return err
+	}
+	if loadBool(&tcpFastOpen) {
+		// the handshake is deferred to the first write, carrying its data with the SYN
+		err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+		if err != nil {
+			logrus.Debug("tcp fast open is not supported: ", err)
+		}
+	}
+	return nil
+}
+
+// setKeepAlive enables keepalive on fd with the package level options, if any is set.
+func setKeepAlive(fd int) error {
+	idle := atomic.LoadInt32(&tcpKeepAliveIdle)
+	interval := atomic.LoadInt32(&tcpKeepAliveInterval)
+	count := atomic.LoadInt32(&tcpKeepAliveCount)
+	if idle <= 0 && interval <= 0 && count <= 0 {
+		return nil
+	}
+	err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1)
+	if err != nil {
+		return newError("failed to enable keepalive").Base(err)
+	}
+	for _, option := range []struct {
+		name  int
+		value int32
+	}{
+		{unix.TCP_KEEPIDLE, idle},
+		{unix.TCP_KEEPINTVL, interval},
+		{unix.TCP_KEEPCNT, count},
+	} {
+		if option.value <= 0 {
+			continue
+		}
+		err = unix.SetsockoptInt(fd, unix.IPPROTO_TCP, option.name, int(option.value))
+		if err != nil {
+			return newError("failed to set keepalive option ", option.name).Base(err)
+		}
+	}
+	return nil
+}
+
+// restoreKeepAlive sets the keepalive options of conn again after net.FileConn replaced them.
+func restoreKeepAlive(conn *net.TCPConn) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	controlErr := rawConn.Control(func(fd uintptr) {
+		err = setKeepAlive(int(fd))
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return err
+}
+
+// bindSource binds fd to the source ip if it matches the family of the socket.
+func bindSource(fd int, ip net.IP, ipv6 bool) error {
+	var sockaddr unix.Sockaddr
+	if ip4 := ip.To4(); ip4 != nil {
+		if ipv6 {
+			logrus.Debug("ignored ipv4 source ", ip, " for ipv6 destination")
+			return nil
+		}
+		socketAddress := &unix.SockaddrInet4{}
+		copy(socketAddress.Addr[:], ip4)
+		sockaddr = socketAddress
+	} else {
+		if !ipv6 {
+			logrus.Debug("ignored ipv6 source ", ip, " for ipv4 destination")
+			return nil
+		}
+		socketAddress := &unix.SockaddrInet6{}
+		copy(socketAddress.Addr[:], ip)
+		sockaddr = socketAddress
+	}
+	err := unix.Bind(fd, sockaddr)
+	if err != nil {
+		return newError("failed to bind socket to ", ip).Base(err)
+	}
+	return nil
+}
+
+// dialUnix connects to the unix socket at the path of destination, a path starting with @
+// or NUL being in the abstract namespace as used by Android daemons. The socket is not
+// protected as it never leaves the device.
+func (dialer protectedDialer) dialUnix(ctx context.Context, destination v2rayNet.Destination) (net.Conn, error) {
+	ctx, cancel := withConnectTimeout(ctx)
+	defer cancel()
+	name := destination.Address.String()
+	// x/sys/unix maps a leading @ to the abstract namespace, without a trailing NUL
+	if strings.HasPrefix(name, "\x00") {
+		name = "@" + name[1:]
+	}
+	fd, err := getFd(destination.Network, false, false)
+	if err != nil {
+		return nil, err
+	}
+	err = connectContext(ctx, fd, &unix.SockaddrUnix{Name: name})
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	file := os.NewFile(uintptr(fd), "socket")
+	if file == nil {
+		return nil, errors.New("failed to connect to fd")
+	}
+	defer file.Close()
+	conn, err := net.FileConn(file)
+	if err != nil {
+		return nil, err
+	}
+	return newDialerConn(conn), nil
+}
+
+// connectContext connects the non-blocking socket, giving up once ctx is done.
+func connectContext(ctx context.Context, fd int, sockaddr unix.Sockaddr) error {
+	err := unix.SetNonblock(fd, true)
+	if err != nil {
+		return err
+	}
+	err = unix.Connect(fd, sockaddr)
+	if err != unix.EINPROGRESS && err != unix.EINTR {
+		return err
+	}
+	pollFds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLOUT}}
+	for {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		timeout := 100 * time.Millisecond
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = deadline.Sub(clk.Now())
+			if timeout < 0 {
+				timeout = 0
+			} else if timeout > 100*time.Millisecond {
+				timeout = 100 * time.Millisecond
+			}
+		}
+		n, err := unix.Poll(pollFds, int(timeout.Milliseconds()))
+		if err == unix.EINTR || err == nil && n == 0 {
+			continue
+		} else if err != nil {
+			return err
+		}
+		soErr, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+		if err != nil {
+			return err
+		}
+		if soErr != 0 {
+			return unix.Errno(soErr)
+		}
+		return nil
+	}
+}
+
+// localAddress returns the address fd is bound to, empty if unknown.
+func localAddress(fd int) string {
+	sockaddr, err := unix.Getsockname(fd)
+	if err != nil {
+		return ""
+	}
+	switch sockaddr := sockaddr.(type) {
+	case *unix.SockaddrInet4:
+		return net.JoinHostPort(net.IP(sockaddr.Addr[:]).String(), strconv.Itoa(sockaddr.Port))
+	case *unix.SockaddrInet6:
+		host := net.IP(sockaddr.Addr[:]).String()
+		if sockaddr.ZoneId != 0 {
+			if iface, err := net.InterfaceByIndex(int(sockaddr.ZoneId)); err == nil {
+				host += "%" + iface.Name
+			}
+		}
+		return net.JoinHostPort(host, strconv.Itoa(sockaddr.Port))
+	default:
+		return ""
+	}
+}
+
+// mptcpNegotiated reports whether the connected socket fd is an MPTCP socket that did not
+// fall back to plain TCP.
+func mptcpNegotiated(fd int) bool {
+	_, err := unix.GetsockoptInt(fd, solMptcp, mptcpInfo)
+	return err == nil
+}
+
+func getFd(network v2rayNet.Network, ipv6 bool, mptcp bool) (fd int, err error) {
+	var af int
+	if !ipv6 {
+		af = unix.AF_INET
+	} else {
+		af = unix.AF_INET6
+	}
+	switch network {
+	case v2rayNet.Network_TCP:
+		if mptcp {
+			fd, err = newSocket(af, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, unix.IPPROTO_MPTCP)
+			if err != unix.EPROTONOSUPPORT && err != unix.ENOPROTOOPT {
+				return
+			}
+			logrus.Debug("mptcp is not supported, falling back to tcp: ", err)
+		}
+		fd, err = newSocket(af, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, unix.IPPROTO_TCP)
+	case v2rayNet.Network_UDP:
+		fd, err = newSocket(af, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.IPPROTO_UDP)
+	case v2rayNet.Network_UNIX:
+		fd, err = newSocket(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	default:
+		err = fmt.Errorf("unknow network")
+	}
+	return
+}
@@ -0,0 +1,1499 @@
+//go:build linux || android
+
+package libcore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/transport/internet"
+	"golang.org/x/sys/unix"
+)
+
+// blackhole returns the address of a listener whose accept queue is full, so that new
+// connections to it never complete.
+func blackhole(t *testing.T) string {
+	address, _ := drainableBlackhole(t)
+	return address
+}
+
+// drainableBlackhole returns the address of a blackhole and a function emptying its accept
+// queue, letting the next connections complete.
+func drainableBlackhole(t *testing.T) (address string, drain func()) {
+	return blackholeAt(t, [4]byte{127, 0, 0, 1}, 0)
+}
+
+// blackholeAt is drainableBlackhole listening on ip and port, a random one if zero.
+func blackholeAt(t *testing.T, ip [4]byte, port int) (address string, drain func()) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		unix.Close(fd)
+	})
+	err = unix.Bind(fd, &unix.SockaddrInet4{Addr: ip, Port: port})
+	if err == nil {
+		err = unix.Listen(fd, 0)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	sockaddr, err := unix.Getsockname(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port = sockaddr.(*unix.SockaddrInet4).Port
+	for i := 0; i < 2; i++ {
+		filler, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_NONBLOCK, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			unix.Close(filler)
+		})
+		_ = unix.Connect(filler, sockaddr)
+	}
+	drain = func() {
+		for i := 0; i < 2; i++ {
+			accepted, _, err := unix.Accept(fd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			unix.Close(accepted)
+		}
+	}
+	return net.JoinHostPort(net.IP(ip[:]).String(), strconv.Itoa(port)), drain
+}
+
+func TestDialProtectedTimeoutFakeClock(t *testing.T) {
+	address := blackhole(t)
+	fake := useFakeClock(t)
+	result := make(chan error, 1)
+	go func() {
+		conn, err := DialProtected("tcp", address, 3000)
+		if err == nil {
+			conn.Close()
+		}
+		result <- err
+	}()
+	// the timers of the dial timeout and the connect timeout
+	fake.WaitTimers(2)
+	select {
+	case err := <-result:
+		t.Fatal("dial finished before the timeout: ", err)
+	default:
+	}
+	fake.Advance(3 * time.Second)
+	err := <-result
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("unexpected error: ", err)
+	}
+}
+
+func TestSettersRaceWithDials(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	defer resetOptions()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := int32(0); ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			SetConnectTimeout(1000 + i%2)
+			SetTcpKeepAlive(i%2, 0, 0)
+			SetTcpNoDelay(i%2 == 0)
+			SetSocketBuffers(0, 65536*(i%2))
+			SetDialObserver(nil)
+			SetIPv6Mode(IPv6ModeEnable + i%2)
+			SetBindInterface("")
+			_ = SetFallbackDelay(i % 300)
+			_ = SetDSCP(i % 2)
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		conn, err := DialProtected("tcp", listener.Addr().String(), 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestDialErrorListsAddresses(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	defer resetOptions()
+
+	dialer := protectedDialer{
+		protector: noopProtectorInstance,
+		resolver: func(ctx context.Context, domain string) ([]net.IP, error) {
+			return []net.IP{net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2)}, nil
+		},
+	}
+	destination := v2rayNet.TCPDestination(v2rayNet.DomainAddress("refused.test"), v2rayNet.Port(port))
+	for _, strategy := range []int32{DialStrategyPreferredFamilyFirst, DialStrategySequential, DialStrategyParallelAll} {
+		_ = SetDialStrategy(strategy)
+		_, err = dialer.Dial(context.Background(), nil, destination, nil)
+		if !errors.Is(err, unix.ECONNREFUSED) {
+			t.Fatal("unexpected error ", err)
+		}
+		for _, ip := range []string{"127.0.0.1", "127.0.0.2"} {
+			if address := net.JoinHostPort(ip, strconv.Itoa(port)); !strings.Contains(err.Error(), address) {
+				t.Fatal("strategy ", strategy, ": ", address, " missing from ", err)
+			}
+		}
+	}
+
+	_, err = dialer.Dial(context.Background(), nil, v2rayNet.TCPDestination(v2rayNet.LocalHostIP, v2rayNet.Port(port)), nil)
+	if address := "127.0.0.1:" + strconv.Itoa(port); err == nil || !strings.Contains(err.Error(), address) {
+		t.Fatal(address, " missing from ", err)
+	}
+}
+
+func TestLastDialRTTMicros(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	start := time.Now()
+	conn, err := DialProtected("tcp", listener.Addr().String(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	conn.Close()
+	if rtt := LastDialRTTMicros(); rtt <= 0 || time.Duration(rtt)*time.Microsecond > elapsed {
+		t.Fatal("implausible rtt ", rtt, "us of a dial taking ", elapsed)
+	}
+
+	udp, err := DialProtected("udp", "127.0.0.1:53", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp.Close()
+	if rtt := LastDialRTTMicros(); rtt != 0 {
+		t.Fatal("rtt ", rtt, "us of a udp dial")
+	}
+}
+
+// dialAsync dials address with the default dialer in the background.
+func dialAsync(ctx context.Context, address string) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		destination, err := v2rayNet.ParseDestination("tcp:" + address)
+		if err != nil {
+			result <- err
+			return
+		}
+		conn, err := defaultDialer().Dial(ctx, nil, destination, nil)
+		if err == nil {
+			conn.Close()
+		}
+		result <- err
+	}()
+	return result
+}
+
+func TestDialCanceledMidDial(t *testing.T) {
+	address := blackhole(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	result := dialAsync(ctx, address)
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-result:
+		t.Fatal("dial finished before the cancellation: ", err)
+	default:
+	}
+	cancel()
+	select {
+	case err := <-result:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatal("unexpected error: ", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dial not aborted by the cancellation")
+	}
+}
+
+func TestDialDefaultConnectTimeout(t *testing.T) {
+	defer resetOptions()
+	SetConnectTimeout(-1)
+	address := blackhole(t)
+	fake := useFakeClock(t)
+	result := dialAsync(context.Background(), address)
+	fake.WaitTimers(1)
+	fake.Advance(defaultConnectTimeout - time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-result:
+		t.Fatal("dial finished before the default timeout: ", err)
+	default:
+	}
+	fake.Advance(time.Millisecond)
+	if err := <-result; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("unexpected error: ", err)
+	}
+}
+
+func TestDialParentCancelClosesSocket(t *testing.T) {
+	address := blackhole(t)
+	before := openFDs()
+	parent, cancel := context.WithCancel(context.Background())
+	ctx, cancelChild := context.WithTimeout(parent, time.Minute)
+	defer cancelChild()
+	result := dialAsync(ctx, address)
+	time.Sleep(50 * time.Millisecond)
+	if during := openFDs(); during != before+1 {
+		t.Fatal(during, " fds during the dial, ", before, " before")
+	}
+	cancel()
+	if err := <-result; !errors.Is(err, context.Canceled) {
+		t.Fatal("unexpected error: ", err)
+	}
+	if after := openFDs(); after != before {
+		t.Fatal(after, " fds after the canceled dial, ", before, " before")
+	}
+}
+
+func TestDialDoesNotLeakFDs(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := v2rayNet.Port(listener.Addr().(*net.TCPAddr).Port)
+	dialer := defaultDialer()
+	before := openFDs()
+	for _, destination := range []v2rayNet.Destination{
+		v2rayNet.TCPDestination(v2rayNet.LocalHostIP, port),
+		v2rayNet.UDPDestination(v2rayNet.LocalHostIP, port),
+	} {
+		conn, err := dialer.Dial(context.Background(), nil, destination, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if after := openFDs(); after != before {
+			t.Fatal(after, " fds after closing the ", destination.Network, " dial, ", before, " before")
+		}
+		// binding a source address not assigned to the host fails after the socket is created
+		_, err = dialer.Dial(context.Background(), v2rayNet.IPAddress(net.IPv4(192, 0, 2, 55)), destination, nil)
+		if !errors.Is(err, unix.EADDRNOTAVAIL) {
+			t.Fatal("unexpected error: ", err)
+		}
+		if after := openFDs(); after != before {
+			t.Fatal(after, " fds after the failed ", destination.Network, " dial, ", before, " before")
+		}
+	}
+}
+
+// linkLocalAddress returns an IPv6 link-local address of the host and its interface.
+func linkLocalAddress(t *testing.T) (net.IP, string) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range interfaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast() {
+				return ipNet.IP, iface.Name
+			}
+		}
+	}
+	t.Skip("no ipv6 link-local address")
+	return nil, ""
+}
+
+func TestDialLinkLocalUDP(t *testing.T) {
+	defer resetOptions()
+	ip, name := linkLocalAddress(t)
+	listener, err := net.ListenUDP("udp6", &net.UDPAddr{IP: ip, Zone: name})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer listener.Close()
+	go func() {
+		buffer := make([]byte, 64)
+		for {
+			n, from, err := listener.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			listener.WriteTo(buffer[:n], from)
+		}
+	}()
+	SetBindInterface(name)
+	destination := v2rayNet.UDPDestination(v2rayNet.IPAddress(ip), v2rayNet.Port(listener.LocalAddr().(*net.UDPAddr).Port))
+	for _, connected := range []bool{true, false} {
+		SetUDPConnected(connected)
+		conn, err := defaultDialer().Dial(context.Background(), nil, destination, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		remote, ok := conn.RemoteAddr().(*net.UDPAddr)
+		if !ok || !remote.IP.Equal(ip) || remote.Zone != name || remote.Port != int(destination.Port) {
+			t.Fatal("unexpected remote address ", conn.RemoteAddr())
+		}
+		if _, err = conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		reply := make([]byte, 64)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(reply)
+		if err != nil || string(reply[:n]) != "ping" {
+			t.Fatalf("read %q: %v", reply[:n], err)
+		}
+		conn.Close()
+	}
+}
+
+// echoUnix dials name with dialer, checking that the unix listener of listen echoes.
+func echoUnix(t *testing.T, dialer protectedDialer, listen string, name string) {
+	t.Helper()
+	listener, err := net.Listen("unix", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	conn, err := dialer.Dial(context.Background(), nil, v2rayNet.UnixDestination(v2rayNet.DomainAddress(name)), nil)
+	if err != nil {
+		t.Fatalf("dial %q: %v", name, err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("unix")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 4)
+	if _, err = io.ReadFull(conn, reply); err != nil || string(reply) != "unix" {
+		t.Fatalf("%q: read %q, %v", name, reply, err)
+	}
+}
+
+func TestDialUnix(t *testing.T) {
+	// protecting unix sockets would fail the dials
+	dialer := protectedDialer{protector: failingProtector{}, resolver: lookupDefault}
+	path := filepath.Join(t.TempDir(), "socket")
+	echoUnix(t, dialer, path, path)
+
+	_, err := dialer.Dial(context.Background(), nil, v2rayNet.UnixDestination(v2rayNet.DomainAddress(filepath.Join(t.TempDir(), "missing"))), nil)
+	var connectErr *ConnectError
+	if !errors.As(err, &connectErr) || !errors.Is(err, unix.ENOENT) {
+		t.Fatal("unexpected error: ", err)
+	}
+}
+
+func TestDialAbstractUnix(t *testing.T) {
+	abstract := "libcore-test-" + strconv.Itoa(os.Getpid())
+	dialer := protectedDialer{protector: failingProtector{}, resolver: lookupDefault}
+	// both prefixes name the abstract namespace, without creating a file
+	echoUnix(t, dialer, "@"+abstract, "@"+abstract)
+	echoUnix(t, dialer, "@"+abstract+"-nul", "\x00"+abstract+"-nul")
+	if _, err := os.Stat("@" + abstract); !os.IsNotExist(err) {
+		t.Fatal("abstract listener created a file: ", err)
+	}
+	_, err := dialer.Dial(context.Background(), nil, v2rayNet.UnixDestination(v2rayNet.DomainAddress("@"+abstract+"-missing")), nil)
+	if !errors.Is(err, unix.ECONNREFUSED) {
+		t.Fatal("unexpected error: ", err)
+	}
+}
+
+func TestDialRetry(t *testing.T) {
+	defer resetOptions()
+	SetConnectTimeout(1000)
+	SetDialRetry(2, 300)
+	address, drain := drainableBlackhole(t)
+	observer := &countingObserver{}
+	SetDialObserver(observer)
+	fake := useFakeClock(t)
+
+	// the first connect times out, the retry succeeds once the queue has room
+	result := dialAsync(context.Background(), address)
+	fake.WaitTimers(1)
+	fake.Advance(time.Second)
+	// the backoff timer
+	fake.WaitTimers(1)
+	drain()
+	fake.Advance(300 * time.Millisecond)
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	// the start and the end of each attempt
+	if calls := atomic.LoadInt32(&observer.calls); calls != 4 {
+		t.Fatal(calls/2, " attempts, expected 2")
+	}
+}
+
+func TestDialRetryGivesUp(t *testing.T) {
+	defer resetOptions()
+	SetConnectTimeout(1000)
+	SetDialRetry(2, 300)
+	observer := &countingObserver{}
+	SetDialObserver(observer)
+	fake := useFakeClock(t)
+
+	// at most attempts retries, with a linear backoff
+	result := dialAsync(context.Background(), blackhole(t))
+	for _, backoff := range []time.Duration{300 * time.Millisecond, 600 * time.Millisecond} {
+		fake.WaitTimers(1)
+		fake.Advance(time.Second)
+		fake.WaitTimers(1)
+		fake.Advance(backoff - time.Millisecond)
+		time.Sleep(20 * time.Millisecond)
+		if calls := atomic.LoadInt32(&observer.calls); calls%2 != 0 {
+			t.Fatal("retried before the backoff of ", backoff)
+		}
+		fake.Advance(time.Millisecond)
+	}
+	fake.WaitTimers(1)
+	fake.Advance(time.Second)
+	if err := <-result; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("unexpected error: ", err)
+	}
+	if calls := atomic.LoadInt32(&observer.calls); calls != 6 {
+		t.Fatal(calls/2, " attempts, expected 3")
+	}
+
+	// refused connections are not retried
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := listener.Addr().String()
+	listener.Close()
+	atomic.StoreInt32(&observer.calls, 0)
+	if err = <-dialAsync(context.Background(), closed); !errors.Is(err, unix.ECONNREFUSED) {
+		t.Fatal("unexpected error: ", err)
+	}
+	if calls := atomic.LoadInt32(&observer.calls); calls != 2 {
+		t.Fatal(calls/2, " attempts of a refused connection")
+	}
+}
+
+func TestDialRetryRespectsDeadline(t *testing.T) {
+	defer resetOptions()
+	SetConnectTimeout(1000)
+	SetDialRetry(2, 5000)
+	observer := &countingObserver{}
+	SetDialObserver(observer)
+	fake := useFakeClock(t)
+	ctx, cancel := withTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	// the deadline comes before the end of the backoff, the dial gives up without waiting
+	result := dialAsync(ctx, blackhole(t))
+	fake.WaitTimers(2)
+	fake.Advance(time.Second)
+	if err := <-result; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("unexpected error: ", err)
+	}
+	if calls := atomic.LoadInt32(&observer.calls); calls != 2 {
+		t.Fatal(calls/2, " attempts, expected 1")
+	}
+}
+
+func TestRecordingProtector(t *testing.T) {
+	defer setDefaultDialer(defaultDialer())
+	protector := NewRecordingProtector()
+	setDefaultDialer(&protectedDialer{protector: protector, resolver: lookupDefault})
+	// the fds are those of the sockets before net.FileConn duplicated them
+	for i, network := range []v2rayNet.Network{v2rayNet.Network_TCP, v2rayNet.Network_UDP} {
+		dialLoopback(t, network)
+		fd := protector.Fd(int32(i))
+		if protector.Count() != int32(i+1) || fd < 0 || !protector.Protected(fd) {
+			t.Fatal(network, ": fd ", fd, " not recorded, ", protector.Count(), " calls")
+		}
+	}
+	if protector.Fd(-1) != -1 || protector.Fd(2) != -1 {
+		t.Fatal("fd out of range returned")
+	}
+	protector.Reset()
+	if protector.Count() != 0 || protector.Fd(0) != -1 {
+		t.Fatal("calls not reset")
+	}
+
+	if !NoopProtector().Protect(-1) {
+		t.Fatal("noop protector refused a fd")
+	}
+	setDefaultDialer(&protectedDialer{protector: NoopProtector(), resolver: lookupDefault})
+	dialLoopback(t, v2rayNet.Network_TCP)
+}
+
+// slowProtector protects sockets only once release is closed, giving up with the context.
+type slowProtector struct {
+	release chan struct{}
+	plain   int32
+}
+
+func (p *slowProtector) Protect(fd int32) bool {
+	atomic.AddInt32(&p.plain, 1)
+	return true
+}
+
+func (p *slowProtector) ProtectContext(ctx context.Context, fd int32) bool {
+	select {
+	case <-p.release:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func TestContextProtectorCanceled(t *testing.T) {
+	defer setDefaultDialer(defaultDialer())
+	protector := &slowProtector{release: make(chan struct{})}
+	setDefaultDialer(&protectedDialer{protector: protector, resolver: lookupDefault})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	before := openFDs()
+	ctx, cancel := context.WithCancel(context.Background())
+	result := dialAsync(ctx, listener.Addr().String())
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-result:
+		t.Fatal("dial finished before the protector: ", err)
+	default:
+	}
+	cancel()
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Fatal("dial succeeded without protection")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("protect not aborted by the cancellation")
+	}
+	if after := openFDs(); after != before {
+		t.Fatal(after, " fds after the canceled protect, ", before, " before")
+	}
+
+	close(protector.release)
+	if err = <-dialAsync(context.Background(), listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&protector.plain) != 0 {
+		t.Fatal("Protect called instead of ProtectContext")
+	}
+}
+
+// flakyProtector fails the first failures calls to Protect.
+type flakyProtector struct {
+	failures int32
+	calls    int32
+}
+
+func (p *flakyProtector) Protect(fd int32) bool {
+	return atomic.AddInt32(&p.calls, 1) > p.failures
+}
+
+func TestProtectRetry(t *testing.T) {
+	defer resetOptions()
+	defer setDefaultDialer(defaultDialer())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	fake := useFakeClock(t)
+
+	SetProtectRetry(3, 100)
+	protector := &flakyProtector{failures: 2}
+	setDefaultDialer(&protectedDialer{protector: protector, resolver: lookupDefault})
+	result := dialAsync(context.Background(), listener.Addr().String())
+	for i := 0; i < 2; i++ {
+		// the connect timeout and the retry delay
+		fake.WaitTimers(2)
+		fake.Advance(100 * time.Millisecond)
+	}
+	if err = <-result; err != nil {
+		t.Fatal(err)
+	}
+	if calls := atomic.LoadInt32(&protector.calls); calls != 3 {
+		t.Fatal(calls, " protect calls, expected 3")
+	}
+
+	// the socket is closed once all attempts failed
+	SetProtectRetry(2, 100)
+	protector = &flakyProtector{failures: 2}
+	setDefaultDialer(&protectedDialer{protector: protector, resolver: lookupDefault})
+	before := openFDs()
+	result = dialAsync(context.Background(), listener.Addr().String())
+	fake.WaitTimers(2)
+	fake.Advance(100 * time.Millisecond)
+	if err = <-result; err == nil {
+		t.Fatal("dial succeeded without protection")
+	}
+	if calls := atomic.LoadInt32(&protector.calls); calls != 2 {
+		t.Fatal(calls, " protect calls, expected 2")
+	}
+	if after := openFDs(); after != before {
+		t.Fatal(after, " fds after the failed protect, ", before, " before")
+	}
+}
+
+func TestDialDeadline(t *testing.T) {
+	defer resetOptions()
+	address := blackhole(t)
+	_, port, _ := net.SplitHostPort(address)
+	portNumber, _ := strconv.Atoi(port)
+	ips := []net.IP{net.IPv4(127, 0, 0, 1)}
+	for i := byte(2); i <= 8; i++ {
+		blackholeAt(t, [4]byte{127, 0, 0, i}, portNumber)
+		ips = append(ips, net.IPv4(127, 0, 0, i))
+	}
+	dialer := protectedDialer{
+		protector: noopProtectorInstance,
+		resolver: func(ctx context.Context, domain string) ([]net.IP, error) {
+			return ips, nil
+		},
+	}
+	destination := v2rayNet.TCPDestination(v2rayNet.DomainAddress("deadline.test"), v2rayNet.Port(portNumber))
+	_ = SetDialStrategy(DialStrategySequential)
+	SetConnectTimeout(10000)
+	SetDialDeadline(200)
+
+	start := time.Now()
+	_, err := dialer.Dial(context.Background(), nil, destination, nil)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatal("dial took ", elapsed, " with a deadline of 200ms")
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("unexpected error ", err)
+	}
+	if !strings.Contains(err.Error(), address) || strings.Contains(err.Error(), "127.0.0.8") {
+		t.Fatal("unexpected addresses tried: ", err)
+	}
+
+	for _, deadline := range []int32{0, -1} {
+		SetDialDeadline(deadline)
+		if loaded := loadDuration(&dialDeadline); loaded != 0 {
+			t.Fatal("deadline ", loaded, " after setting ", deadline)
+		}
+	}
+}
+
+// recordingDialObserver records the calls of a dial observer as strings.
+type recordingDialObserver struct {
+	access sync.Mutex
+	events []string
+}
+
+func (o *recordingDialObserver) record(event string) {
+	o.access.Lock()
+	o.events = append(o.events, event)
+	o.access.Unlock()
+}
+
+func (o *recordingDialObserver) OnResolve(domain string, ips string, ms int32) {
+	if ms < 0 {
+		o.record(fmt.Sprint("resolve took ", ms))
+	}
+	o.record("resolve " + domain + " " + ips)
+}
+
+func (o *recordingDialObserver) OnConnectStart(addr string) {
+	o.record("start " + addr)
+}
+
+func (o *recordingDialObserver) OnConnectDone(addr string, ms int32, err string) {
+	if ms < 0 {
+		o.record(fmt.Sprint("connect took ", ms))
+	}
+	o.record(fmt.Sprint("done ", addr, " ", err != ""))
+}
+
+func (o *recordingDialObserver) take() []string {
+	o.access.Lock()
+	defer o.access.Unlock()
+	events := o.events
+	o.events = nil
+	return events
+}
+
+func TestDialObserver(t *testing.T) {
+	defer resetOptions()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	if err = SetHosts(`{"observer.test": ["127.0.0.1"], "blocked.test": []}`); err != nil {
+		t.Fatal(err)
+	}
+	observer := &recordingDialObserver{}
+	SetDialObserver(observer)
+	_, port, _ := net.SplitHostPort(address)
+
+	if err = <-dialAsync(context.Background(), "observer.test:"+port); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"resolve observer.test 127.0.0.1", "start " + address, "done " + address + " false"}
+	if events := observer.take(); fmt.Sprint(events) != fmt.Sprint(expected) {
+		t.Fatal("observed ", events, ", expected ", expected)
+	}
+
+	// a failed resolve and a failed connect
+	if err = <-dialAsync(context.Background(), "blocked.test:"+port); err == nil {
+		t.Fatal("dialed a domain without addresses")
+	}
+	listener.Close()
+	if err = <-dialAsync(context.Background(), address); err == nil {
+		t.Fatal("dialed a closed listener")
+	}
+	expected = []string{"resolve blocked.test ", "start " + address, "done " + address + " true"}
+	if events := observer.take(); fmt.Sprint(events) != fmt.Sprint(expected) {
+		t.Fatal("observed ", events, ", expected ", expected)
+	}
+
+	SetDialObserver(nil)
+	<-dialAsync(context.Background(), address)
+	if events := observer.take(); len(events) != 0 {
+		t.Fatal("observed ", events, " after removing the observer")
+	}
+}
+
+func TestLastDialFamily(t *testing.T) {
+	defer resetOptions()
+	if err := SetHosts(`{"family.test": ["::1", "127.0.0.1"]}`); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		listen, family string
+	}{
+		// the preferred family is refused, the other one wins
+		{"[::1]:0", "v6"},
+		{"127.0.0.1:0", "v4"},
+	} {
+		listener, err := net.Listen("tcp", test.listen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := listener.Addr().(*net.TCPAddr).Port
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+			}
+		}()
+		if test.family == "v4" {
+			SetIPv6Mode(IPv6ModePrefer)
+		} else {
+			SetIPv6Mode(IPv6ModeEnable)
+		}
+		err = <-dialAsync(context.Background(), "family.test:"+strconv.Itoa(port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if family := LastDialFamily(); family != test.family {
+			t.Fatal("last dial family ", family, ", expected ", test.family)
+		}
+
+		// failed dials keep the family
+		listener.Close()
+		if err = <-dialAsync(context.Background(), "family.test:"+strconv.Itoa(port)); err == nil {
+			t.Fatal("dialed a closed listener")
+		}
+		if family := LastDialFamily(); family != test.family {
+			t.Fatal("last dial family ", family, " after a failed dial")
+		}
+	}
+}
+
+// acceptingListener listens on address and sends the connections it accepts to the
+// returned channel, closing those left at the end of the test.
+func acceptingListener(t *testing.T, address string) (net.Listener, <-chan net.Conn) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan net.Conn, 16)
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		listener.Close()
+		<-done
+		close(accepted)
+		for conn := range accepted {
+			conn.Close()
+		}
+	})
+	go func() {
+		defer close(done)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	return listener, accepted
+}
+
+func TestDialStrategies(t *testing.T) {
+	defer resetOptions()
+	SetConnectTimeout(200)
+	listener, _ := acceptingListener(t, "127.0.0.1:0")
+	port := listener.Addr().(*net.TCPAddr).Port
+	blackholeAt(t, [4]byte{127, 0, 0, 2}, port)
+	// nothing listens on 127.0.0.3
+	ips := []net.IP{net.IPv4(127, 0, 0, 3), net.IPv4(127, 0, 0, 2), net.IPv4(127, 0, 0, 1)}
+	dialer := protectedDialer{
+		protector: noopProtectorInstance,
+		resolver: func(ctx context.Context, domain string) ([]net.IP, error) {
+			return ips, nil
+		},
+	}
+	destination := v2rayNet.TCPDestination(v2rayNet.DomainAddress("strategy.test"), v2rayNet.Port(port))
+	for _, strategy := range []int32{DialStrategyPreferredFamilyFirst, DialStrategySequential, DialStrategyParallelAll} {
+		if err := SetDialStrategy(strategy); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := dialer.Dial(context.Background(), nil, destination, nil)
+		if err != nil {
+			t.Fatal("strategy ", strategy, ": ", err)
+		}
+		conn.Close()
+		if conn.RemoteAddr().String() != listener.Addr().String() {
+			t.Fatal("strategy ", strategy, ": connected to ", conn.RemoteAddr())
+		}
+	}
+	if err := SetDialStrategy(DialStrategyParallelAll + 1); err == nil {
+		t.Fatal("accepted an unknown strategy")
+	}
+}
+
+func TestDialStrategiesCloseLosers(t *testing.T) {
+	defer resetOptions()
+	first, firstAccepted := acceptingListener(t, "127.0.0.1:0")
+	port := strconv.Itoa(first.Addr().(*net.TCPAddr).Port)
+	_, secondAccepted := acceptingListener(t, "127.0.0.4:"+port)
+	_, ipv6Accepted := acceptingListener(t, "[::1]:"+port)
+	SetFallbackDelay(0)
+	for _, test := range []struct {
+		strategy int32
+		ips      []net.IP
+		accepted [2]<-chan net.Conn
+	}{
+		{DialStrategyParallelAll, []net.IP{net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 4)}, [2]<-chan net.Conn{firstAccepted, secondAccepted}},
+		{DialStrategyPreferredFamilyFirst, []net.IP{net.IPv6loopback, net.IPv4(127, 0, 0, 1)}, [2]<-chan net.Conn{ipv6Accepted, firstAccepted}},
+	} {
+		_ = SetDialStrategy(test.strategy)
+		dialer := protectedDialer{
+			protector: noopProtectorInstance,
+			resolver: func(ctx context.Context, domain string) ([]net.IP, error) {
+				return test.ips, nil
+			},
+		}
+		portNumber, _ := strconv.Atoi(port)
+		destination := v2rayNet.TCPDestination(v2rayNet.DomainAddress("losers.test"), v2rayNet.Port(portNumber))
+		conn, err := dialer.Dial(context.Background(), nil, destination, nil)
+		if err != nil {
+			t.Fatal("strategy ", test.strategy, ": ", err)
+		}
+		// the connections losing the race are closed, the winner stays open
+		for _, accepted := range test.accepted {
+			var peer net.Conn
+			select {
+			case peer = <-accepted:
+			case <-time.After(time.Second):
+				// the loser was canceled before connecting
+				continue
+			}
+			peer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			_, err := peer.Read(make([]byte, 1))
+			peer.Close()
+			if peer.RemoteAddr().String() == conn.LocalAddr().String() {
+				if !errors.Is(err, os.ErrDeadlineExceeded) {
+					t.Fatal("strategy ", test.strategy, ": winner closed: ", err)
+				}
+			} else if err != io.EOF {
+				t.Fatal("strategy ", test.strategy, ": loser ", peer.RemoteAddr(), " not closed: ", err)
+			}
+		}
+		conn.Close()
+	}
+}
+
+func TestDialErrorKinds(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := v2rayNet.Port(listener.Addr().(*net.TCPAddr).Port)
+	listener.Close()
+	errNoSuchHost := errors.New("no such host")
+	dialer := protectedDialer{
+		protector: noopProtectorInstance,
+		resolver: func(ctx context.Context, domain string) ([]net.IP, error) {
+			if domain == "missing.test" {
+				return nil, errNoSuchHost
+			}
+			return []net.IP{net.IPv4(127, 0, 0, 1)}, nil
+		},
+	}
+	var resolveErr *ResolveError
+	var connectErr *ConnectError
+
+	_, err = dialer.Dial(context.Background(), nil, v2rayNet.TCPDestination(v2rayNet.DomainAddress("missing.test"), port), nil)
+	if !errors.As(err, &resolveErr) || errors.As(err, &connectErr) {
+		t.Fatal("dns failure: unexpected error ", err)
+	}
+	if resolveErr.Kind != ErrorKindResolve || resolveErr.Domain != "missing.test" || !errors.Is(err, errNoSuchHost) {
+		t.Fatalf("dns failure: unexpected error %+v", *resolveErr)
+	}
+
+	for _, address := range []v2rayNet.Address{v2rayNet.DomainAddress("refused.test"), v2rayNet.LocalHostIP} {
+		_, err = dialer.Dial(context.Background(), nil, v2rayNet.TCPDestination(address, port), nil)
+		if !errors.As(err, &connectErr) || errors.As(err, &resolveErr) {
+			t.Fatal(address, ": unexpected error ", err)
+		}
+		if connectErr.Kind != ErrorKindConnect || !errors.Is(err, unix.ECONNREFUSED) {
+			t.Fatal(address, ": unexpected error ", err)
+		}
+	}
+}
+
+func TestDialWithoutConnectTimeout(t *testing.T) {
+	defer resetOptions()
+	SetConnectTimeout(0)
+	address := blackhole(t)
+	fake := useFakeClock(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	result := dialAsync(ctx, address)
+	// no timeout is left to expire, only the caller can abort the dial
+	time.Sleep(50 * time.Millisecond)
+	fake.Advance(time.Hour)
+	select {
+	case err := <-result:
+		t.Fatal("dial finished without a timeout: ", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	fake.access.Lock()
+	timers := len(fake.timers)
+	fake.access.Unlock()
+	if timers != 0 {
+		t.Fatal(timers, " timers pending without a timeout")
+	}
+	cancel()
+	select {
+	case err := <-result:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatal("unexpected error: ", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dial not aborted by the cancellation")
+	}
+}
+
+func TestDialUDPUnconnected(t *testing.T) {
+	defer resetOptions()
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	other, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	destination := v2rayNet.UDPDestination(v2rayNet.LocalHostIP, v2rayNet.Port(peer.LocalAddr().(*net.UDPAddr).Port))
+	buffer := make([]byte, 64)
+	for _, connected := range []bool{true, false} {
+		SetUDPConnected(connected)
+		conn, err := defaultDialer().Dial(context.Background(), nil, destination, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = conn.Write([]byte("punch")); err != nil {
+			t.Fatal(err)
+		}
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		n, local, err := peer.ReadFrom(buffer)
+		if err != nil || string(buffer[:n]) != "punch" {
+			t.Fatalf("read %q: %v", buffer[:n], err)
+		}
+		// a peer other than the destination sends to the mapping
+		if _, err = other.WriteTo([]byte("hello"), local); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = peer.WriteTo([]byte("reply"), local); err != nil {
+			t.Fatal(err)
+		}
+		packetConn := conn.(*internet.PacketConnWrapper).Conn
+		packetConn.SetReadDeadline(time.Now().Add(time.Second))
+		n, from, err := packetConn.ReadFrom(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if connected {
+			// connected sockets only receive from the destination
+			if string(buffer[:n]) != "reply" || from.String() != peer.LocalAddr().String() {
+				t.Fatalf("connected socket received %q from %s", buffer[:n], from)
+			}
+		} else if string(buffer[:n]) != "hello" || from.String() != other.LocalAddr().String() {
+			t.Fatalf("unconnected socket received %q from %s", buffer[:n], from)
+		}
+		conn.Close()
+	}
+}
+
+// connectedObserver records the addresses successful dials ended up connected to.
+type connectedObserver struct {
+	recordingDialObserver
+}
+
+func (o *connectedObserver) OnConnected(domain string, ip string) {
+	o.record("connected " + domain + " " + ip)
+}
+
+func TestConnectObserver(t *testing.T) {
+	defer resetOptions()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	// the unreachable address is tried first
+	if err = SetHosts(`{"sticky.test": ["127.0.0.3", "127.0.0.1"]}`); err != nil {
+		t.Fatal(err)
+	}
+	_ = SetDialStrategy(DialStrategySequential)
+	observer := &connectedObserver{}
+	SetDialObserver(observer)
+
+	for _, test := range []struct{ address, expected string }{
+		{"sticky.test:" + port, "connected sticky.test 127.0.0.1"},
+		{listener.Addr().String(), "connected  127.0.0.1"},
+	} {
+		if err = <-dialAsync(context.Background(), test.address); err != nil {
+			t.Fatal(err)
+		}
+		events := observer.take()
+		if len(events) == 0 || events[len(events)-1] != test.expected {
+			t.Fatal(test.address, ": observed ", events, ", expected ", test.expected)
+		}
+	}
+	// failed dials are not reported
+	listener.Close()
+	<-dialAsync(context.Background(), "sticky.test:"+port)
+	for _, event := range observer.take() {
+		if strings.HasPrefix(event, "connected") {
+			t.Fatal("reported a failed dial: ", event)
+		}
+	}
+}
+
+// attemptsObserver sends the addresses dials start and finish connecting to.
+type attemptsObserver struct {
+	recordingDialObserver
+	starts, dones chan string
+}
+
+func (o *attemptsObserver) OnConnectStart(addr string) {
+	o.starts <- addr
+}
+
+func (o *attemptsObserver) OnConnectDone(addr string, ms int32, err string) {
+	o.dones <- addr
+}
+
+func TestFallbackDelay(t *testing.T) {
+	defer resetOptions()
+	// the IPv4 attempt never completes, the IPv6 listener accepts
+	address, _ := drainableBlackhole(t)
+	_, port, _ := net.SplitHostPort(address)
+	listener, err := net.Listen("tcp", "[::1]:"+port)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	if err = SetHosts(`{"fallback.test": ["127.0.0.1", "::1"]}`); err != nil {
+		t.Fatal(err)
+	}
+	observer := &attemptsObserver{starts: make(chan string, 4), dones: make(chan string, 4)}
+	SetDialObserver(observer)
+	fake := useFakeClock(t)
+
+	for _, delay := range []time.Duration{100 * time.Millisecond, 300 * time.Millisecond} {
+		if err = SetFallbackDelay(int32(delay / time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+		result := dialAsync(context.Background(), "fallback.test:"+port)
+		if start := <-observer.starts; start != address {
+			t.Fatal("started with ", start)
+		}
+		// the connect timeout and the fallback delay
+		fake.WaitTimers(2)
+		fake.Advance(delay - time.Millisecond)
+		select {
+		case start := <-observer.starts:
+			t.Fatal("fallback ", start, " started before the delay of ", delay)
+		case <-time.After(20 * time.Millisecond):
+		}
+		fake.Advance(time.Millisecond)
+		if start := <-observer.starts; start != "[::1]:"+port {
+			t.Fatal("fallback started with ", start)
+		}
+		if err = <-result; err != nil {
+			t.Fatal(err)
+		}
+		// the losing attempt is canceled
+		<-observer.dones
+		<-observer.dones
+	}
+	if err = SetFallbackDelay(-1); err == nil {
+		t.Fatal("accepted a negative fallback delay")
+	}
+}
+
+func TestMaxDialCandidates(t *testing.T) {
+	defer resetOptions()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	var ips []net.IP
+	for i := 0; i < 20; i++ {
+		ips = append(ips, net.IPv4(127, 0, 1, byte(i+1)))
+	}
+	dialer := protectedDialer{
+		protector: noopProtectorInstance,
+		resolver: func(ctx context.Context, domain string) ([]net.IP, error) {
+			return ips, nil
+		},
+	}
+	destination := v2rayNet.TCPDestination(v2rayNet.DomainAddress("candidates.test"), v2rayNet.Port(port))
+	observer := &recordingDialObserver{}
+	SetDialObserver(observer)
+	if err = SetDialStrategy(DialStrategySequential); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		limit, attempted int32
+	}{
+		{defaultMaxDialCandidates, defaultMaxDialCandidates},
+		{3, 3},
+		{0, 20},
+	} {
+		SetMaxDialCandidates(test.limit)
+		if _, err = dialer.Dial(context.Background(), nil, destination, nil); err == nil {
+			t.Fatal("dialed a closed port")
+		}
+		var started []string
+		for _, event := range observer.take() {
+			if strings.HasPrefix(event, "start ") {
+				started = append(started, strings.TrimPrefix(event, "start "))
+			}
+		}
+		if len(started) != int(test.attempted) {
+			t.Fatal("limit ", test.limit, ": attempted ", started)
+		}
+		for i, address := range started {
+			if expected := net.JoinHostPort(ips[i].String(), strconv.Itoa(port)); address != expected {
+				t.Fatal("limit ", test.limit, ": attempted ", address, ", expected ", expected)
+			}
+		}
+	}
+}
+
+func TestDialDomainStrategy(t *testing.T) {
+	defer resetOptions()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	dialer := protectedDialer{
+		protector: noopProtectorInstance,
+		resolver: func(ctx context.Context, domain string) ([]net.IP, error) {
+			return []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}, nil
+		},
+	}
+	destination := v2rayNet.TCPDestination(v2rayNet.DomainAddress("strategy.test"), v2rayNet.Port(port))
+	observer := &recordingDialObserver{}
+	SetDialObserver(observer)
+	if err = SetDialStrategy(DialStrategySequential); err != nil {
+		t.Fatal(err)
+	}
+	ip4 := "start " + net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	ip6 := "start " + net.JoinHostPort("::1", strconv.Itoa(port))
+	for _, test := range []struct {
+		mode     int32
+		sockopt  *internet.SocketConfig
+		attempts []string
+	}{
+		{IPv6ModeEnable, nil, []string{ip4, ip6}},
+		{IPv6ModeOnly, &internet.SocketConfig{DomainStrategy: internet.DomainStrategy_AS_IS}, []string{ip6}},
+		// both families, in the order of the ipv6 mode
+		{IPv6ModeDisable, &internet.SocketConfig{DomainStrategy: internet.DomainStrategy_USE_IP}, []string{ip4, ip6}},
+		{IPv6ModePrefer, &internet.SocketConfig{DomainStrategy: internet.DomainStrategy_USE_IP}, []string{ip6, ip4}},
+		{IPv6ModeOnly, &internet.SocketConfig{DomainStrategy: internet.DomainStrategy_USE_IP4}, []string{ip4}},
+		{IPv6ModeDisable, &internet.SocketConfig{DomainStrategy: internet.DomainStrategy_USE_IP6}, []string{ip6}},
+	} {
+		SetIPv6Mode(test.mode)
+		if _, err = dialer.Dial(context.Background(), nil, destination, test.sockopt); err == nil {
+			t.Fatal("dialed a closed port")
+		}
+		var attempts []string
+		for _, event := range observer.take() {
+			if strings.HasPrefix(event, "start ") {
+				attempts = append(attempts, event)
+			}
+		}
+		if fmt.Sprint(attempts) != fmt.Sprint(test.attempts) {
+			t.Fatalf("mode %d, sockopt %+v: %v, expected %v", test.mode, test.sockopt, attempts, test.attempts)
+		}
+	}
+}
+
+func TestRegisterDialer(t *testing.T) {
+	defer UnregisterDialer()
+	listener, accepted := acceptingListener(t, "127.0.0.1:0")
+	destination := v2rayNet.TCPDestination(v2rayNet.LocalHostIP, v2rayNet.Port(listener.Addr().(*net.TCPAddr).Port))
+	protector := NewRecordingProtector()
+	RegisterDialer(protector, nil)
+	// outbounds of v2ray-core dial through DialSystem
+	conn, err := internet.DialSystem(context.Background(), destination, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	<-accepted
+	if protector.Count() != 1 {
+		t.Fatal(protector.Count(), " sockets protected by the registered dialer")
+	}
+	if systemDialer().protector != protector {
+		t.Fatal("system dialer not registered")
+	}
+
+	UnregisterDialer()
+	if conn, err = internet.DialSystem(context.Background(), destination, nil); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	<-accepted
+	if protector.Count() != 1 {
+		t.Fatal("registered dialer used after UnregisterDialer")
+	}
+	if systemDialer() != defaultDialer() {
+		t.Fatal("system dialer still registered")
+	}
+}
+
+func TestLastLocalAddr(t *testing.T) {
+	defer resetOptions()
+	for _, address := range []string{"127.0.0.1:0", "[::1]:0"} {
+		listener, accepted := acceptingListener(t, address)
+		if err := <-dialAsync(context.Background(), listener.Addr().String()); err != nil {
+			t.Fatal(err)
+		}
+		peer := <-accepted
+		localAddr := LastLocalAddr()
+		if localAddr != peer.RemoteAddr().String() {
+			t.Fatal("reported local address ", localAddr, ", accepted from ", peer.RemoteAddr())
+		}
+		if _, port, _ := net.SplitHostPort(localAddr); port == "0" || port == "" {
+			t.Fatal("reported no local port in ", localAddr)
+		}
+	}
+
+	// connected udp sockets are bound by connect, unconnected ones on their first send
+	destination := v2rayNet.UDPDestination(v2rayNet.LocalHostIP, 53)
+	conn, err := defaultDialer().Dial(context.Background(), nil, destination, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if localAddr := LastLocalAddr(); localAddr != conn.LocalAddr().String() {
+		t.Fatal("reported local address ", localAddr, " of a udp socket bound to ", conn.LocalAddr())
+	}
+	SetUDPConnected(false)
+	if conn, err = defaultDialer().Dial(context.Background(), nil, destination, nil); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if localAddr := LastLocalAddr(); localAddr != "" {
+		t.Fatal("reported local address ", localAddr, " of an unconnected udp socket")
+	}
+}
+
+func TestDialOutOfDescriptors(t *testing.T) {
+	defer resetOptions()
+	defer func() {
+		dialSocket = unix.Socket
+	}()
+	hook := useLogHook(t)
+	SetLogLevel(int32(logrus.WarnLevel))
+	listener, _ := acceptingListener(t, "127.0.0.1:0")
+	var calls, failures int32
+	dialSocket = func(domain int, typ int, proto int) (int, error) {
+		calls++
+		if calls <= failures {
+			return -1, unix.EMFILE
+		}
+		return unix.Socket(domain, typ, proto)
+	}
+
+	// descriptors reclaimed by the garbage collection
+	failures = 1
+	if err := <-dialAsync(context.Background(), listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 || len(hook.entries) != 1 || !strings.Contains(hook.entries[0], "out of file descriptors") {
+		t.Fatal(calls, " sockets created, logged ", hook.entries)
+	}
+
+	// or retried only once
+	calls, failures = 0, 3
+	if err := <-dialAsync(context.Background(), listener.Addr().String()); !errors.Is(err, unix.EMFILE) {
+		t.Fatal("unexpected error out of descriptors: ", err)
+	}
+	if calls != 2 {
+		t.Fatal(calls, " sockets created out of descriptors")
+	}
+}
+
+func TestSetFdSoftLimit(t *testing.T) {
+	var limit unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &limit); err != nil {
+		t.Fatal(err)
+	}
+	original := limit
+	defer unix.Setrlimit(unix.RLIMIT_NOFILE, &original)
+	if limit.Max > 1<<20 {
+		t.Skip("hard fd limit too high: ", limit.Max)
+	}
+	getSoftLimit := func() uint64 {
+		if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &limit); err != nil {
+			t.Fatal(err)
+		}
+		return limit.Cur
+	}
+	lowered := unix.Rlimit{Cur: original.Max / 2, Max: original.Max}
+	if err := unix.Setrlimit(unix.RLIMIT_NOFILE, &lowered); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		n    int32
+		soft uint64
+	}{
+		{0, lowered.Cur},
+		// never lowered
+		{int32(lowered.Cur) - 1, lowered.Cur},
+		{int32(lowered.Cur) + 1, lowered.Cur + 1},
+		// nor raised beyond the hard limit
+		{int32(original.Max) + 1, original.Max},
+	} {
+		if err := SetFdSoftLimit(test.n); err != nil {
+			t.Fatal(err)
+		}
+		if soft := getSoftLimit(); soft != test.soft {
+			t.Fatal("soft limit ", soft, " after setting ", test.n, ", expected ", test.soft)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+//go:build !linux && !android
+
+package libcore
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/transport/internet"
+)
+
+// errUnsupportedPlatform is returned by the socket operations of libcore outside Linux.
+var errUnsupportedPlatform = errors.New("unsupported platform")
+
+func isTransientDialError(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+func (dialer protectedDialer) dial(ctx context.Context, source v2rayNet.Address, destination v2rayNet.Destination, sockopt *internet.SocketConfig) (net.Conn, error) {
+	return nil, errUnsupportedPlatform
+}
+
+func (dialer protectedDialer) dialUnix(ctx context.Context, destination v2rayNet.Destination) (net.Conn, error) {
+	return nil, errUnsupportedPlatform
+}
+
+// SetFdSoftLimit raises the soft limit of open file descriptors, only supported on Linux.
+func SetFdSoftLimit(n int32) error {
+	return errUnsupportedPlatform
+}
@@ -0,0 +1,147 @@
+package libcore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+)
+
+func TestDialErrorJoin(t *testing.T) {
+	if err := dialError(nil).join(); err != nil {
+		t.Fatal("join of no failures: ", err)
+	}
+	refused := &addressError{"127.0.0.1:80", syscall.ECONNREFUSED}
+	err := dialError{refused}.join()
+	if err.Error() != "127.0.0.1:80: "+syscall.ECONNREFUSED.Error() {
+		t.Fatal("unexpected error ", err)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatal("errors.Is failed on ", err)
+	}
+
+	err = dialError{refused, {"[::1]:80", syscall.ETIMEDOUT}}.join()
+	for _, address := range []string{"127.0.0.1:80", "[::1]:80"} {
+		if !strings.Contains(err.Error(), address) {
+			t.Fatal(address, " missing from ", err)
+		}
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) || !errors.Is(err, syscall.ETIMEDOUT) {
+		t.Fatal("errors.Is failed on ", err)
+	}
+	var addressErr *addressError
+	if !errors.As(err, &addressErr) || addressErr != refused {
+		t.Fatal("errors.As failed on ", err)
+	}
+}
+
+func TestIPv6ModeFiltering(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("1.1.1.1").To4(),
+		net.ParseIP("2606:4700::1111"),
+		net.ParseIP("8.8.8.8").To4(),
+		net.ParseIP("2001:4860::8888"),
+	}
+	for mode, expected := range map[int32]string{
+		IPv6ModeDisable: "[1.1.1.1 8.8.8.8]",
+		IPv6ModeEnable:  "[1.1.1.1 2606:4700::1111 8.8.8.8 2001:4860::8888]",
+		IPv6ModePrefer:  "[2606:4700::1111 1.1.1.1 2001:4860::8888 8.8.8.8]",
+		IPv6ModeOnly:    "[2606:4700::1111 2001:4860::8888]",
+	} {
+		if sorted := fmt.Sprint(sortIPs(filterIPs(ips, mode), mode)); sorted != expected {
+			t.Errorf("mode %d: %s, expected %s", mode, sorted, expected)
+		}
+	}
+}
+
+func TestIPv6ModeLeavingNoAddress(t *testing.T) {
+	defer resetOptions()
+	for _, test := range []struct {
+		mode int32
+		ip   string
+	}{
+		{IPv6ModeDisable, "2606:4700::1111"},
+		{IPv6ModeOnly, "1.1.1.1"},
+	} {
+		SetIPv6Mode(test.mode)
+		dialer := protectedDialer{
+			protector: noopProtectorInstance,
+			resolver: func(ctx context.Context, domain string) ([]net.IP, error) {
+				return []net.IP{net.ParseIP(test.ip)}, nil
+			},
+		}
+		destination := v2rayNet.TCPDestination(v2rayNet.DomainAddress("mode.test"), 443)
+		_, err := dialer.Dial(context.Background(), nil, destination, nil)
+		var resolveErr *ResolveError
+		if !errors.As(err, &resolveErr) || resolveErr.Domain != "mode.test" {
+			t.Fatal("mode ", test.mode, ": unexpected error ", err)
+		}
+	}
+}
+
+func TestResolveTimeout(t *testing.T) {
+	defer resetOptions()
+	fake := useFakeClock(t)
+	// a resolver ignoring its context, returning only once the test ends
+	hung := make(chan struct{})
+	defer close(hung)
+	dialer := protectedDialer{
+		protector: noopProtectorInstance,
+		resolver: func(ctx context.Context, domain string) ([]net.IP, error) {
+			<-hung
+			return nil, errors.New("hung resolver returned")
+		},
+	}
+	destination := v2rayNet.TCPDestination(v2rayNet.DomainAddress("hung.example"), 80)
+	for _, test := range []struct {
+		timeout int32
+		wait    time.Duration
+	}{
+		{0, 5 * time.Second},
+		{200, 200 * time.Millisecond},
+	} {
+		SetResolveTimeout(test.timeout)
+		result := make(chan error, 1)
+		go func() {
+			conn, err := dialer.Dial(context.Background(), nil, destination, nil)
+			if err == nil {
+				conn.Close()
+			}
+			result <- err
+		}()
+		fake.WaitTimers(1)
+		fake.Advance(test.wait - time.Millisecond)
+		select {
+		case err := <-result:
+			t.Fatal("resolve returned before the timeout: ", err)
+		case <-time.After(20 * time.Millisecond):
+		}
+		fake.Advance(time.Millisecond)
+		err := <-result
+		var resolveErr *ResolveError
+		if !errors.As(err, &resolveErr) || resolveErr.Domain != "hung.example" || !strings.Contains(err.Error(), "dns timeout") {
+			t.Fatal("unexpected error: ", err)
+		}
+	}
+}
+
+func TestDialInvalidDestination(t *testing.T) {
+	dialer := protectedDialer{protector: noopProtectorInstance, resolver: lookupDefault}
+	for _, destination := range []v2rayNet.Destination{
+		{},
+		{Network: v2rayNet.Network_TCP},
+		{Address: v2rayNet.IPAddress(net.IPv4(127, 0, 0, 1)), Port: 80},
+	} {
+		conn, err := dialer.Dial(context.Background(), nil, destination, nil)
+		if err == nil {
+			conn.Close()
+			t.Fatalf("dialed %#v", destination)
+		}
+	}
+}
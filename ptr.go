@@ -0,0 +1,122 @@
+package libcore
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/features/dns"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// LookupPTR returns the first name ip reverse resolves to, querying the DNS server of
+// libcore through the protected dialer within timeout milliseconds.
+func LookupPTR(ip string, timeout int32) (string, error) {
+	address := net.ParseIP(ip)
+	if address == nil {
+		return "", newError("unable to parse ip ", ip)
+	}
+	ctx, cancel := withTimeout(context.Background(), time.Duration(timeout)*time.Millisecond)
+	defer cancel()
+	return lookupPTR(ctx, address, func(ctx context.Context, query []byte) ([]byte, error) {
+		return exchangePlain(ctx, v2rayNet.UDPDestination(dnsAddress, 53), query)
+	})
+}
+
+func lookupPTR(ctx context.Context, ip net.IP, exchange exchangeFunc) (string, error) {
+	query, err := packQuery(reverseName(ip), dnsmessage.TypePTR)
+	if err != nil {
+		return "", err
+	}
+	response, err := exchange(ctx, query)
+	if err != nil {
+		return "", err
+	}
+	return parsePTR(response)
+}
+
+// reverseName returns the in-addr.arpa or ip6.arpa name of ip.
+func reverseName(ip net.IP) string {
+	var builder strings.Builder
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := len(ip4) - 1; i >= 0; i-- {
+			builder.WriteString(strconv.Itoa(int(ip4[i])))
+			builder.WriteByte('.')
+		}
+		builder.WriteString("in-addr.arpa.")
+		return builder.String()
+	}
+	const hexDigits = "0123456789abcdef"
+	for i := len(ip) - 1; i >= 0; i-- {
+		builder.WriteByte(hexDigits[ip[i]&0xf])
+		builder.WriteByte('.')
+		builder.WriteByte(hexDigits[ip[i]>>4])
+		builder.WriteByte('.')
+	}
+	builder.WriteString("ip6.arpa.")
+	return builder.String()
+}
+
+// exchangeUDP sends query to the DNS server at destination over a protected UDP socket.
+func exchangeUDP(ctx context.Context, destination v2rayNet.Destination, query []byte) ([]byte, error) {
+	conn, err := defaultDialer().Dial(ctx, nil, destination, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer watchDeadline(ctx, conn)()
+	_, err = conn.Write(query)
+	if err != nil {
+		return nil, err
+	}
+	buffer := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		// skip stray responses to other queries
+		if n >= 2 && binary.BigEndian.Uint16(buffer) == binary.BigEndian.Uint16(query) {
+			return buffer[:n], nil
+		}
+	}
+}
+
+func parsePTR(response []byte) (string, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil {
+		return "", newError("failed to parse DNS response").Base(err)
+	}
+	if header.RCode != dnsmessage.RCodeSuccess {
+		return "", dns.RCodeError(header.RCode)
+	}
+	err = parser.SkipAllQuestions()
+	if err != nil {
+		return "", newError("failed to skip questions in DNS response").Base(err)
+	}
+	for {
+		answerHeader, err := parser.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			return "", dns.ErrEmptyResponse
+		} else if err != nil {
+			return "", newError("failed to parse answer section").Base(err)
+		}
+		if answerHeader.Type != dnsmessage.TypePTR {
+			err = parser.SkipAnswer()
+			if err != nil {
+				return "", newError("failed to skip answer").Base(err)
+			}
+			continue
+		}
+		answer, err := parser.PTRResource()
+		if err != nil {
+			return "", newError("failed to parse PTR record").Base(err)
+		}
+		return strings.TrimSuffix(answer.PTR.String(), "."), nil
+	}
+}
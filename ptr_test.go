@@ -0,0 +1,76 @@
+package libcore
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/v2fly/v2ray-core/v5/features/dns"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ptrExchange answers PTR queries for name with ptr, refusing the names it does not know.
+func ptrExchange(t *testing.T, name string, ptr string) exchangeFunc {
+	return func(ctx context.Context, query []byte) ([]byte, error) {
+		var request dnsmessage.Message
+		if err := request.Unpack(query); err != nil {
+			return nil, err
+		}
+		question := request.Questions[0]
+		response := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: request.ID, Response: true},
+			Questions: request.Questions,
+		}
+		if question.Type != dnsmessage.TypePTR || question.Name.String() != name {
+			response.RCode = dnsmessage.RCodeNameError
+		} else if ptr != "" {
+			header := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 60}
+			response.Answers = []dnsmessage.Resource{
+				// answers of other types are skipped
+				{Header: header, Body: &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("alias.example.")}},
+				{Header: header, Body: &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(ptr)}},
+			}
+		}
+		answer, err := response.Pack()
+		if err != nil {
+			t.Error(err)
+		}
+		return answer, err
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	for ip, expected := range map[string]string{
+		"192.0.2.1":          "1.2.0.192.in-addr.arpa.",
+		"::ffff:192.0.2.1":   "1.2.0.192.in-addr.arpa.",
+		"2001:db8::567:89ab": "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.",
+	} {
+		if name := reverseName(net.ParseIP(ip)); name != expected {
+			t.Fatal(ip, " reversed to ", name, ", expected ", expected)
+		}
+	}
+}
+
+func TestLookupPTR(t *testing.T) {
+	exchange := ptrExchange(t, "1.2.0.192.in-addr.arpa.", "host.example.")
+	name, err := lookupPTR(context.Background(), net.IPv4(192, 0, 2, 1), exchange)
+	if err != nil || name != "host.example" {
+		t.Fatal("resolved ", name, ": ", err)
+	}
+	exchange = ptrExchange(t, reverseName(net.ParseIP("2001:db8::1")), "host6.example.")
+	name, err = lookupPTR(context.Background(), net.ParseIP("2001:db8::1"), exchange)
+	if err != nil || name != "host6.example" {
+		t.Fatal("resolved ", name, ": ", err)
+	}
+
+	if _, err = lookupPTR(context.Background(), net.IPv4(192, 0, 2, 2), exchange); err != dns.RCodeError(dnsmessage.RCodeNameError) {
+		t.Fatal("unexpected error for an unknown name: ", err)
+	}
+	exchange = ptrExchange(t, "1.2.0.192.in-addr.arpa.", "")
+	if _, err = lookupPTR(context.Background(), net.IPv4(192, 0, 2, 1), exchange); err != dns.ErrEmptyResponse {
+		t.Fatal("unexpected error without answers: ", err)
+	}
+	if _, err = LookupPTR("192.0.2", 1000); err == nil {
+		t.Fatal("looked up an invalid ip")
+	}
+}
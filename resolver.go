@@ -0,0 +1,192 @@
+package libcore
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/Dreamacro/clash/transport/socks5"
+	"github.com/sirupsen/logrus"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/features/dns"
+	"github.com/v2fly/v2ray-core/v5/features/dns/localdns"
+	"libcore/comm"
+)
+
+// Resolver resolves domains for protected dials.
+//
+// network is one of "ip", "ip4" or "ip6", and the result is the concatenation of
+// the resolved addresses in 16-byte form, with IPv4 addresses IPv4-mapped.
+type Resolver interface {
+	LookupIP(network string, domain string) ([]byte, error)
+}
+
+// TimeoutResolver is a Resolver able to honor the time left to the dial, it is
+// preferred over LookupIP when implemented. timeout is in milliseconds.
+type TimeoutResolver interface {
+	Resolver
+	LookupIPTimeout(network string, domain string, timeout int32) ([]byte, error)
+}
+
+// lookupResolver queries resolver, passing the time left until the deadline of ctx to a
+// TimeoutResolver.
+func lookupResolver(ctx context.Context, resolver Resolver, network string, domain string) ([]net.IP, error) {
+	var result []byte
+	var err error
+	if timeoutResolver, ok := resolver.(TimeoutResolver); ok {
+		timeout := loadDuration(&resolveTimeout)
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = deadline.Sub(clk.Now())
+		}
+		if timeout <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+		milliseconds := timeout.Milliseconds()
+		if milliseconds == 0 {
+			milliseconds = 1
+		}
+		result, err = timeoutResolver.LookupIPTimeout(network, domain, int32(milliseconds))
+	} else {
+		result, err = resolver.LookupIP(network, domain)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeIPs(result)
+}
+
+type resolverFunc func(ctx context.Context, domain string) ([]net.IP, error)
+
+// contextResolver is implemented by the resolvers of libcore, letting dials pass their
+// context and skip the byte form of Resolver.
+type contextResolver interface {
+	lookupIP(ctx context.Context, network string, domain string) ([]net.IP, error)
+}
+
+// ttlResolver is implemented by the resolvers knowing the TTL of their answers.
+type ttlResolver interface {
+	lookupIPTTL(ctx context.Context, network string, domain string) ([]net.IP, time.Duration, error)
+}
+
+var upstreamSocksAddress atomic.Value
+
+// SetUpstreamSocks makes the default resolver query DNS over TCP through the SOCKS5 proxy
+// at address:port, and UDP dials relay through it if SetSocksUDP is enabled. address must be
+// an IP literal and empty disables the proxy.
+func SetUpstreamSocks(address string, port int32) error {
+	if address == "" {
+		upstreamSocksAddress.Store("")
+		return nil
+	}
+	if net.ParseIP(address) == nil {
+		return newError("invalid socks address ", address)
+	}
+	upstreamSocksAddress.Store(net.JoinHostPort(address, strconv.Itoa(int(port))))
+	return nil
+}
+
+func lookupDefault(ctx context.Context, domain string) ([]net.IP, error) {
+	if ips, found := lookupHosts(domain); found {
+		if len(ips) == 0 {
+			return nil, dns.ErrEmptyResponse
+		}
+		return ips, nil
+	}
+	if socksAddress := loadString(&upstreamSocksAddress); socksAddress != "" {
+		ips, _, err := lookupWire(ctx, lookupNetwork(), domain, func(ctx context.Context, query []byte) ([]byte, error) {
+			conn, err := dialSocks(ctx, socksAddress)
+			if err != nil {
+				return nil, &socksError{err}
+			}
+			defer conn.Close()
+			defer watchDeadline(ctx, conn)()
+			return exchangeStream(conn, query)
+		})
+		if _, isSocksError := err.(*socksError); !isSocksError {
+			return ips, err
+		}
+		logrus.Warn("failed to query dns through socks ", socksAddress, ", falling back to direct: ", err)
+	}
+	ips, _, err := localdns.Client().LookupDefault(ctx, domain)
+	return ips, err
+}
+
+// socksError is a failure to reach the DNS server through the upstream SOCKS5 proxy.
+type socksError struct {
+	err error
+}
+
+func (e *socksError) Error() string {
+	return e.err.Error()
+}
+
+func (e *socksError) Unwrap() error {
+	return e.err
+}
+
+// dialSocks connects to the DNS server through the SOCKS5 proxy at socksAddress.
+func dialSocks(ctx context.Context, socksAddress string) (net.Conn, error) {
+	destination, err := v2rayNet.ParseDestination("tcp:" + socksAddress)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := defaultDialer().Dial(ctx, nil, destination, nil)
+	if err != nil {
+		return nil, err
+	}
+	stop := watchDeadline(ctx, conn)
+	_, err = socksHandshake(conn, socks5.ParseAddr(net.JoinHostPort(dnsAddress.String(), "53")), socks5.CmdConnect)
+	stop()
+	if err != nil {
+		conn.Close()
+		return nil, newError("socks handshake failed").Base(err)
+	}
+	return conn, nil
+}
+
+func newResolverFunc(resolver Resolver) resolverFunc {
+	if resolver, ok := resolver.(contextResolver); ok {
+		return func(ctx context.Context, domain string) ([]net.IP, error) {
+			return resolver.lookupIP(ctx, lookupNetwork(), domain)
+		}
+	}
+	return func(ctx context.Context, domain string) ([]net.IP, error) {
+		return lookupResolver(ctx, resolver, lookupNetwork(), domain)
+	}
+}
+
+func lookupNetwork() string {
+	switch GetIPv6Mode() {
+	case comm.IPv6Disable:
+		return "ip4"
+	case comm.IPv6Only:
+		return "ip6"
+	default:
+		return "ip"
+	}
+}
+
+func decodeIPs(result []byte) ([]net.IP, error) {
+	if len(result)%net.IPv6len != 0 {
+		return nil, newError("invalid lookup result length ", len(result))
+	}
+	ips := make([]net.IP, 0, len(result)/net.IPv6len)
+	for i := 0; i < len(result); i += net.IPv6len {
+		ip := net.IP(result[i : i+net.IPv6len])
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+func encodeIPs(ips []net.IP) []byte {
+	result := make([]byte, 0, len(ips)*net.IPv6len)
+	for _, ip := range ips {
+		result = append(result, ip.To16()...)
+	}
+	return result
+}
@@ -0,0 +1,242 @@
+package libcore
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsAnswer answers a wire format query with the addresses of ips of the queried family.
+func dnsAnswer(t *testing.T, query []byte, ttl uint32, ips ...net.IP) []byte {
+	var request dnsmessage.Message
+	if err := request.Unpack(query); err != nil {
+		t.Error(err)
+		return nil
+	}
+	question := request.Questions[0]
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 request.ID,
+		Response:           true,
+		RecursionDesired:   true,
+		RecursionAvailable: true,
+	})
+	builder.EnableCompression()
+	_ = builder.StartQuestions()
+	_ = builder.Question(question)
+	_ = builder.StartAnswers()
+	header := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: ttl}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil && question.Type == dnsmessage.TypeA {
+			var a dnsmessage.AResource
+			copy(a.A[:], ip4)
+			_ = builder.AResource(header, a)
+		} else if ip4 == nil && question.Type == dnsmessage.TypeAAAA {
+			var aaaa dnsmessage.AAAAResource
+			copy(aaaa.AAAA[:], ip)
+			_ = builder.AAAAResource(header, aaaa)
+		}
+	}
+	response, err := builder.Finish()
+	if err != nil {
+		t.Error(err)
+	}
+	return response
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, candidate := range ips {
+		if candidate.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveDNSStream answers the length framed queries of conn with ips until it is closed.
+func serveDNSStream(t *testing.T, conn net.Conn, ips ...net.IP) {
+	for {
+		query, err := readStream(conn)
+		if err != nil {
+			return
+		}
+		if err = writeStream(conn, dnsAnswer(t, query, 60, ips...)); err != nil {
+			return
+		}
+	}
+}
+
+// socksDNSProxy is a minimal SOCKS5 proxy answering CONNECT requests with reply, then
+// serving DNS over TCP itself with ips. It reports the targets of the requests.
+func socksDNSProxy(t *testing.T, reply byte, ips ...net.IP) (address string, port int32, targets <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	seen := make(chan string, 16)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				greeting := make([]byte, 3)
+				if _, err := io.ReadFull(conn, greeting); err != nil {
+					return
+				}
+				conn.Write([]byte{5, 0})
+				// VER, CMD, RSV followed by an IPv4 address and port
+				request := make([]byte, 10)
+				if _, err := io.ReadFull(conn, request); err != nil {
+					return
+				}
+				seen <- net.JoinHostPort(net.IP(request[4:8]).String(), strconv.Itoa(int(request[8])<<8|int(request[9])))
+				conn.Write([]byte{5, reply, 0, 1, 0, 0, 0, 0, 0, 0})
+				if reply == 0 {
+					serveDNSStream(t, conn, ips...)
+				}
+			}()
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), int32(addr.Port), seen
+}
+
+func TestUpstreamSocksResolver(t *testing.T) {
+	defer resetOptions()
+	address, port, targets := socksDNSProxy(t, 0, net.IPv4(192, 0, 2, 1), net.ParseIP("2001:db8::1"))
+	if err := SetUpstreamSocks(address, port); err != nil {
+		t.Fatal(err)
+	}
+	ips, err := lookupDefault(context.Background(), "socks.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 || !containsIP(ips, net.IPv4(192, 0, 2, 1)) || !containsIP(ips, net.ParseIP("2001:db8::1")) {
+		t.Fatal("unexpected answer ", ips)
+	}
+	// a connection for each family, to the DNS server
+	for i := 0; i < 2; i++ {
+		if target := <-targets; target != net.JoinHostPort(dnsAddress.String(), "53") {
+			t.Fatal("connected to ", target)
+		}
+	}
+
+	if err := SetUpstreamSocks("localhost", 1080); err == nil {
+		t.Fatal("accepted a socks domain")
+	}
+}
+
+func TestUpstreamSocksResolverFallback(t *testing.T) {
+	defer resetOptions()
+	hook := useLogHook(t)
+	SetLogLevel(int32(logrus.WarnLevel))
+	// REP 2: connection not allowed
+	address, port, targets := socksDNSProxy(t, 2)
+	if err := SetUpstreamSocks(address, port); err != nil {
+		t.Fatal(err)
+	}
+	ips, err := lookupDefault(context.Background(), "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) == 0 || !ips[0].IsLoopback() {
+		t.Fatal("unexpected direct answer ", ips)
+	}
+	<-targets
+	var fallbacks int
+	for _, entry := range hook.entries {
+		if strings.Contains(entry, "falling back to direct") {
+			fallbacks++
+		}
+	}
+	if fallbacks == 0 {
+		t.Fatal("fallback not logged: ", hook.entries)
+	}
+
+	// a proxy refusing connections falls back too
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	if err = SetUpstreamSocks("127.0.0.1", int32(closedPort)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = lookupDefault(context.Background(), "localhost"); err != nil {
+		t.Fatal("no fallback from an unreachable proxy: ", err)
+	}
+}
+
+// timeoutRecordingResolver answers with 192.0.2.1, recording the timeouts it is given.
+type timeoutRecordingResolver struct {
+	timeouts []int32
+}
+
+func (r *timeoutRecordingResolver) LookupIP(network string, domain string) ([]byte, error) {
+	return r.LookupIPTimeout(network, domain, 0)
+}
+
+func (r *timeoutRecordingResolver) LookupIPTimeout(network string, domain string, timeout int32) ([]byte, error) {
+	r.timeouts = append(r.timeouts, timeout)
+	return encodeIPs([]net.IP{net.IPv4(192, 0, 2, 1)}), nil
+}
+
+func TestTimeoutResolver(t *testing.T) {
+	defer resetOptions()
+	fake := useFakeClock(t)
+	resolver := &timeoutRecordingResolver{}
+	lookup := newResolverFunc(resolver)
+	for _, test := range []struct {
+		budget  time.Duration
+		timeout int32
+	}{
+		{1500 * time.Millisecond, 1500},
+		{time.Minute, 60000},
+		// rounded up rather than passing no time at all
+		{500 * time.Microsecond, 1},
+	} {
+		ctx, cancel := context.WithDeadline(context.Background(), fake.Now().Add(test.budget))
+		ips, err := lookup(ctx, "timeout.test")
+		cancel()
+		if err != nil || len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 1)) {
+			t.Fatal("resolved ", ips, ": ", err)
+		}
+		if timeouts := resolver.timeouts; len(timeouts) != 1 || timeouts[0] != test.timeout {
+			t.Fatal("budget ", test.budget, ": timeouts ", timeouts, ", expected ", test.timeout)
+		}
+		resolver.timeouts = nil
+	}
+
+	// without a deadline the resolve timeout is passed
+	SetResolveTimeout(2500)
+	if _, err := lookup(context.Background(), "timeout.test"); err != nil {
+		t.Fatal(err)
+	}
+	if timeouts := resolver.timeouts; len(timeouts) != 1 || timeouts[0] != 2500 {
+		t.Fatal("timeouts ", timeouts, " without a deadline")
+	}
+	resolver.timeouts = nil
+
+	// an expired deadline is not queried
+	ctx, cancel := context.WithDeadline(context.Background(), fake.Now())
+	defer cancel()
+	if _, err := lookup(ctx, "timeout.test"); err != context.DeadlineExceeded {
+		t.Fatal("unexpected error past the deadline: ", err)
+	}
+	if len(resolver.timeouts) != 0 {
+		t.Fatal("queried past the deadline")
+	}
+}
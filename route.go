@@ -1,13 +1,22 @@
 package libcore
 
-import "github.com/sirupsen/logrus"
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"libcore/comm"
+)
 
 var networkType string
 
 func SetNetworkType(network string) {
+	ipv6ModeAccess.Lock()
+	defer ipv6ModeAccess.Unlock()
 	if network != networkType {
 		logrus.Debug("updated network type: ", network)
 		networkType = network
+		updateIPv6Mode()
 	}
 }
 
@@ -19,3 +28,109 @@ func SetWifiSSID(ssid string) {
 		wifiSSID = ssid
 	}
 }
+
+const (
+	IPv6ModeDisable = comm.IPv6Disable
+	IPv6ModeEnable  = comm.IPv6Enable
+	IPv6ModePrefer  = comm.IPv6Prefer
+	IPv6ModeOnly    = comm.IPv6Only
+)
+
+var (
+	// ipv6Mode is the IPv6 preference of protected dials, one of the IPv6Mode constants,
+	// taken from networkIPv6Modes for the current network type or else globalIPv6Mode.
+	// It is written with ipv6ModeAccess held and read atomically.
+	ipv6Mode int32 = comm.IPv6Enable
+
+	ipv6ModeAccess   sync.Mutex
+	globalIPv6Mode   int32 = comm.IPv6Enable
+	networkIPv6Modes       = make(map[string]int32)
+)
+
+// SetIPv6Mode sets the IPv6 preference of protected dials on the networks without their
+// own mode set by SetIPv6ModeForNetwork, invalid modes are ignored.
+func SetIPv6Mode(mode int32) {
+	if mode < IPv6ModeDisable || mode > IPv6ModeOnly {
+		logrus.Warn("ignored invalid ipv6 mode ", mode)
+		return
+	}
+	ipv6ModeAccess.Lock()
+	defer ipv6ModeAccess.Unlock()
+	globalIPv6Mode = mode
+	updateIPv6Mode()
+}
+
+// The network types of SetCurrentNetworkType and SetIPv6ModeForNetwork, named in
+// networkTypeNames like the types SetNetworkType receives.
+const (
+	NetworkTypeUnknown int32 = iota
+	NetworkTypeWifi
+	NetworkTypeData
+	NetworkTypeBluetooth
+	NetworkTypeEthernet
+)
+
+var networkTypeNames = []string{"", "wifi", "data", "bluetooth", "ethernet"}
+
+func networkTypeName(networkType int32) (string, bool) {
+	if networkType < 0 || int(networkType) >= len(networkTypeNames) {
+		logrus.Warn("ignored unknown network type ", networkType)
+		return "", false
+	}
+	return networkTypeNames[networkType], true
+}
+
+// SetCurrentNetworkType is SetNetworkType with one of the NetworkType constants.
+func SetCurrentNetworkType(networkType int32) {
+	if network, ok := networkTypeName(networkType); ok {
+		SetNetworkType(network)
+	}
+}
+
+// SetIPv6ModeForNetwork sets the IPv6 preference of protected dials while the current
+// network is of networkType, one of the NetworkType constants, such as disabling IPv6 on
+// cellular data with broken IPv6. A negative mode removes it, other invalid modes are
+// ignored.
+func SetIPv6ModeForNetwork(networkType int32, mode int32) {
+	if mode > IPv6ModeOnly {
+		logrus.Warn("ignored invalid ipv6 mode ", mode)
+		return
+	}
+	network, ok := networkTypeName(networkType)
+	if !ok {
+		return
+	}
+	ipv6ModeAccess.Lock()
+	defer ipv6ModeAccess.Unlock()
+	if mode < 0 {
+		delete(networkIPv6Modes, network)
+	} else {
+		networkIPv6Modes[network] = mode
+	}
+	updateIPv6Mode()
+}
+
+// resetIPv6Mode restores the global mode and removes the modes of networks.
+func resetIPv6Mode() {
+	ipv6ModeAccess.Lock()
+	defer ipv6ModeAccess.Unlock()
+	globalIPv6Mode = comm.IPv6Enable
+	networkIPv6Modes = make(map[string]int32)
+	updateIPv6Mode()
+}
+
+// updateIPv6Mode recomputes ipv6Mode, ipv6ModeAccess must be held.
+func updateIPv6Mode() {
+	mode, loaded := networkIPv6Modes[networkType]
+	if !loaded {
+		mode = globalIPv6Mode
+	}
+	if mode != atomic.LoadInt32(&ipv6Mode) {
+		logrus.Debug("updated ipv6 mode: ", mode)
+		atomic.StoreInt32(&ipv6Mode, mode)
+	}
+}
+
+func GetIPv6Mode() int32 {
+	return atomic.LoadInt32(&ipv6Mode)
+}
@@ -0,0 +1,92 @@
+package libcore
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestIPv6Mode(t *testing.T) {
+	defer resetOptions()
+	if GetIPv6Mode() != IPv6ModeEnable {
+		t.Fatal("unexpected default mode ", GetIPv6Mode())
+	}
+	for mode, expected := range map[int32]int32{IPv6ModeDisable: 0, IPv6ModeEnable: 1, IPv6ModePrefer: 2, IPv6ModeOnly: 3} {
+		if mode != expected {
+			t.Fatal("mode constant ", mode, ", expected ", expected)
+		}
+		SetIPv6Mode(mode)
+		if GetIPv6Mode() != mode {
+			t.Fatal("mode ", GetIPv6Mode(), " after setting ", mode)
+		}
+	}
+
+	hook := useLogHook(t)
+	SetLogLevel(int32(logrus.WarnLevel))
+	SetIPv6Mode(IPv6ModePrefer)
+	for _, mode := range []int32{-1, 4, 42} {
+		SetIPv6Mode(mode)
+		if GetIPv6Mode() != IPv6ModePrefer {
+			t.Fatal("invalid mode ", mode, " replaced the mode")
+		}
+	}
+	if len(hook.entries) != 3 || !strings.Contains(hook.entries[0], "invalid ipv6 mode -1") {
+		t.Fatal("unexpected warnings ", hook.entries)
+	}
+}
+
+func TestIPv6ModeForNetwork(t *testing.T) {
+	defer resetOptions()
+	defer SetNetworkType("")
+	ips := []net.IP{net.IPv4(192, 0, 2, 1), net.ParseIP("2001:db8::1")}
+	SetIPv6ModeForNetwork(NetworkTypeData, IPv6ModeDisable)
+	SetIPv6ModeForNetwork(NetworkTypeWifi, IPv6ModeOnly)
+	for _, test := range []struct {
+		networkType int32
+		mode        int32
+		filtered    string
+	}{
+		{NetworkTypeWifi, IPv6ModeOnly, "[2001:db8::1]"},
+		{NetworkTypeData, IPv6ModeDisable, "[192.0.2.1]"},
+		// networks without their own mode use the global one
+		{NetworkTypeEthernet, IPv6ModeEnable, "[192.0.2.1 2001:db8::1]"},
+		{NetworkTypeUnknown, IPv6ModeEnable, "[192.0.2.1 2001:db8::1]"},
+		{NetworkTypeWifi, IPv6ModeOnly, "[2001:db8::1]"},
+	} {
+		SetCurrentNetworkType(test.networkType)
+		if mode := GetIPv6Mode(); mode != test.mode {
+			t.Fatal("network type ", test.networkType, ": mode ", mode, ", expected ", test.mode)
+		}
+		if filtered := fmt.Sprint(filterIPs(ips, GetIPv6Mode())); filtered != test.filtered {
+			t.Fatal("network type ", test.networkType, ": filtered ", filtered, ", expected ", test.filtered)
+		}
+	}
+	// the string types of SetNetworkType select the same modes
+	SetNetworkType("data")
+	if mode := GetIPv6Mode(); mode != IPv6ModeDisable {
+		t.Fatal("mode ", mode, " on network type data")
+	}
+	SetCurrentNetworkType(NetworkTypeEthernet + 1)
+	if mode := GetIPv6Mode(); mode != IPv6ModeDisable {
+		t.Fatal("unknown network type changed the mode")
+	}
+	SetCurrentNetworkType(NetworkTypeWifi)
+
+	// the global mode does not override the mode of the current network
+	SetIPv6Mode(IPv6ModePrefer)
+	if mode := GetIPv6Mode(); mode != IPv6ModeOnly {
+		t.Fatal("mode ", mode, " after setting the global mode")
+	}
+	SetIPv6ModeForNetwork(NetworkTypeWifi, -1)
+	if mode := GetIPv6Mode(); mode != IPv6ModePrefer {
+		t.Fatal("mode ", mode, " after removing the mode of the network")
+	}
+	SetIPv6ModeForNetwork(NetworkTypeWifi, IPv6ModeOnly+1)
+	SetIPv6ModeForNetwork(-1, IPv6ModeOnly)
+	if mode := GetIPv6Mode(); mode != IPv6ModePrefer {
+		t.Fatal("invalid mode replaced the mode")
+	}
+}
@@ -0,0 +1,27 @@
+package libcore
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// SetMaxProcs sets GOMAXPROCS to n and returns the previous value, limiting the number of
+// threads running Go code reduces the overhead on low-end devices.
+func SetMaxProcs(n int32) (int32, error) {
+	if n < 1 {
+		return 0, newError("invalid max procs ", n)
+	}
+	return int32(runtime.GOMAXPROCS(int(n))), nil
+}
+
+// SetGCPercent sets the garbage collection target percentage and returns the previous
+// value, a negative percentage disables the garbage collector.
+func SetGCPercent(percent int32) int32 {
+	return int32(debug.SetGCPercent(int(percent)))
+}
+
+// FreeOSMemory runs a garbage collection and returns as much memory as possible to the
+// system, for when Android reports memory pressure.
+func FreeOSMemory() {
+	debug.FreeOSMemory()
+}
@@ -0,0 +1,18 @@
+//go:build go1.19
+
+package libcore
+
+import "runtime/debug"
+
+// minMemoryLimit is the lowest memory limit accepted, the runtime would spend most of its
+// time collecting below it.
+const minMemoryLimit = 16 * 1024 * 1024
+
+// SetMemoryLimit sets the soft memory limit of the runtime in bytes and returns the previous
+// limit, math.MaxInt64 removes the limit.
+func SetMemoryLimit(limit int64) (int64, error) {
+	if limit < minMemoryLimit {
+		return 0, newError("memory limit ", limit, " is below the minimum of ", minMemoryLimit)
+	}
+	return debug.SetMemoryLimit(limit), nil
+}
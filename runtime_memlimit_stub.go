@@ -0,0 +1,10 @@
+//go:build !go1.19
+
+package libcore
+
+import "errors"
+
+// SetMemoryLimit requires Go 1.19, it always fails when built with older versions.
+func SetMemoryLimit(limit int64) (int64, error) {
+	return 0, errors.New("memory limit requires go1.19")
+}
@@ -0,0 +1,36 @@
+//go:build go1.19
+
+package libcore
+
+import (
+	"math"
+	"runtime/debug"
+	"testing"
+)
+
+func TestSetMemoryLimit(t *testing.T) {
+	original := debug.SetMemoryLimit(-1)
+	defer debug.SetMemoryLimit(original)
+
+	previous, err := SetMemoryLimit(256 << 20)
+	if err != nil || previous != original {
+		t.Fatal("previous limit ", previous, ", expected ", original, ": ", err)
+	}
+	if limit := debug.SetMemoryLimit(-1); limit != 256<<20 {
+		t.Fatal("limit ", limit, " after setting 256 MiB")
+	}
+	for _, limit := range []int64{-1, 0, minMemoryLimit - 1} {
+		if _, err = SetMemoryLimit(limit); err == nil {
+			t.Fatal("accepted limit ", limit)
+		}
+	}
+	if limit := debug.SetMemoryLimit(-1); limit != 256<<20 {
+		t.Fatal("limit ", limit, " after invalid values")
+	}
+	if previous, err = SetMemoryLimit(math.MaxInt64); err != nil || previous != 256<<20 {
+		t.Fatal("previous limit ", previous, ": ", err)
+	}
+
+	// releasing memory just has to work at any time
+	FreeOSMemory()
+}
@@ -0,0 +1,46 @@
+package libcore
+
+import (
+	"runtime"
+	"runtime/debug"
+	"testing"
+)
+
+func TestSetMaxProcs(t *testing.T) {
+	original := runtime.GOMAXPROCS(0)
+	defer runtime.GOMAXPROCS(original)
+
+	previous, err := SetMaxProcs(1)
+	if err != nil || previous != int32(original) {
+		t.Fatal("previous max procs ", previous, ", expected ", original, ": ", err)
+	}
+	if procs := runtime.GOMAXPROCS(0); procs != 1 {
+		t.Fatal("max procs ", procs, " after setting 1")
+	}
+	if previous, err = SetMaxProcs(2); err != nil || previous != 1 {
+		t.Fatal("previous max procs ", previous, ", expected 1: ", err)
+	}
+	for _, n := range []int32{0, -1} {
+		if _, err = SetMaxProcs(n); err == nil {
+			t.Fatal("accepted max procs ", n)
+		}
+	}
+	if procs := runtime.GOMAXPROCS(0); procs != 2 {
+		t.Fatal("max procs ", procs, " after invalid values")
+	}
+}
+
+func TestSetGCPercent(t *testing.T) {
+	original := debug.SetGCPercent(100)
+	defer debug.SetGCPercent(original)
+
+	if previous := SetGCPercent(50); previous != 100 {
+		t.Fatal("previous gc percent ", previous, ", expected 100")
+	}
+	if previous := SetGCPercent(-1); previous != 50 {
+		t.Fatal("previous gc percent ", previous, ", expected 50")
+	}
+	if previous := debug.SetGCPercent(100); previous != -1 {
+		t.Fatal("gc percent ", previous, " after disabling the collector")
+	}
+}
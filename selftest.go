@@ -0,0 +1,109 @@
+package libcore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+)
+
+// selfTestDomain is resolved by SelfTest, the connectivity check domain of Android.
+const selfTestDomain = "connectivitycheck.gstatic.com"
+
+type selfTestCheck struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Latency int64  `json:"latency"`
+	Error   string `json:"error,omitempty"`
+}
+
+type selfTestReport struct {
+	Passed bool            `json:"passed"`
+	Checks []selfTestCheck `json:"checks"`
+}
+
+// SelfTest checks the dialer subsystem and returns a JSON report with the result and
+// latency in milliseconds of each check: creating a socket, protecting it, dialing a
+// loopback listener and resolving a domain. Each check is given timeout milliseconds.
+// It only opens sockets of its own, so it is safe to call while the VPN is running.
+func SelfTest(timeout int32) string {
+	report := selfTestReport{Passed: true}
+	run := func(name string, check func(ctx context.Context) error) {
+		ctx, cancel := withTimeout(context.Background(), time.Duration(timeout)*time.Millisecond)
+		defer cancel()
+		start := clk.Now()
+		err := check(ctx)
+		result := selfTestCheck{
+			Name:    name,
+			Passed:  err == nil,
+			Latency: clk.Now().Sub(start).Milliseconds(),
+		}
+		if err != nil {
+			result.Error = err.Error()
+			report.Passed = false
+		}
+		report.Checks = append(report.Checks, result)
+	}
+	run("socket", selfTestSocket)
+	run("protect", selfTestProtect)
+	run("loopback", selfTestLoopback)
+	run("resolve", func(ctx context.Context) error {
+		_, err := defaultDialer().lookup(ctx, selfTestDomain)
+		return err
+	})
+	content, _ := json.Marshal(report)
+	return string(content)
+}
+
+// selfTestProtect passes the fd of a fresh loopback socket to the protector.
+func selfTestProtect(ctx context.Context) error {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	rawConn, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		return err
+	}
+	var protected bool
+	err = rawConn.Control(func(fd uintptr) {
+		protected = protect(ctx, defaultDialer().protector, int(fd))
+	})
+	if err != nil {
+		return err
+	}
+	if !protected {
+		return errors.New("protect failed")
+	}
+	return nil
+}
+
+// selfTestLoopback dials a loopback listener with the default dialer, quietly not to
+// replace the statistics of the last dial of the app.
+func selfTestLoopback(ctx context.Context) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	port := listener.Addr().(*net.TCPAddr).Port
+	destination := v2rayNet.TCPDestination(v2rayNet.LocalHostIP, v2rayNet.Port(port))
+	dialer := *defaultDialer()
+	dialer.quiet = true
+	conn, err := dialer.Dial(ctx, nil, destination, nil)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
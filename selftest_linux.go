@@ -0,0 +1,19 @@
+//go:build linux || android
+
+package libcore
+
+import (
+	"context"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"golang.org/x/sys/unix"
+)
+
+// selfTestSocket creates and closes a socket the way protected TCP dials do.
+func selfTestSocket(ctx context.Context) error {
+	fd, err := getFd(v2rayNet.Network_TCP, false, loadBool(&multipathTCP))
+	if err != nil {
+		return err
+	}
+	return unix.Close(fd)
+}
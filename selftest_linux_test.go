@@ -0,0 +1,131 @@
+//go:build linux || android
+
+package libcore
+
+import (
+	"encoding/json"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+type countingObserver struct {
+	calls int32
+}
+
+func (o *countingObserver) OnResolve(domain string, ips string, ms int32) {
+	atomic.AddInt32(&o.calls, 1)
+}
+
+func (o *countingObserver) OnConnectStart(addr string) {
+	atomic.AddInt32(&o.calls, 1)
+}
+
+func (o *countingObserver) OnConnectDone(addr string, ms int32, err string) {
+	atomic.AddInt32(&o.calls, 1)
+}
+
+type failingProtector struct{}
+
+func (failingProtector) Protect(fd int32) bool {
+	return false
+}
+
+// runSelfTest runs SelfTest with the check domain resolving to the loopback.
+func runSelfTest(t *testing.T) map[string]selfTestCheck {
+	if err := SetHosts(`{"` + selfTestDomain + `": ["127.0.0.1"]}`); err != nil {
+		t.Fatal(err)
+	}
+	var report selfTestReport
+	if err := json.Unmarshal([]byte(SelfTest(1000)), &report); err != nil {
+		t.Fatal(err)
+	}
+	checks := make(map[string]selfTestCheck)
+	passed := true
+	for _, check := range report.Checks {
+		checks[check.Name] = check
+		passed = passed && check.Passed
+		if check.Passed != (check.Error == "") || check.Latency < 0 {
+			t.Fatalf("inconsistent check %+v", check)
+		}
+	}
+	if len(checks) != 4 || report.Passed != passed {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	return checks
+}
+
+func TestSelfTest(t *testing.T) {
+	defer resetOptions()
+	for name, check := range runSelfTest(t) {
+		if !check.Passed {
+			t.Fatal(name, " failed: ", check.Error)
+		}
+	}
+}
+
+func TestSelfTestIsQuiet(t *testing.T) {
+	defer resetOptions()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_ = SetDialLogCapacity(10)
+	conn, err := DialProtected("tcp", listener.Addr().String(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	observer := &countingObserver{}
+	SetDialObserver(observer)
+	rtt, localAddr, dialLog := LastDialRTTMicros(), LastLocalAddr(), DumpDialLog()
+
+	runSelfTest(t)
+	if LastDialRTTMicros() != rtt || LastLocalAddr() != localAddr {
+		t.Fatal("self test replaced the last dial statistics")
+	}
+	if DumpDialLog() != dialLog {
+		t.Fatal("self test logged its dial: ", DumpDialLog())
+	}
+	if calls := atomic.LoadInt32(&observer.calls); calls != 0 {
+		t.Fatal("self test reported ", calls, " calls to the observer")
+	}
+}
+
+func TestSelfTestBrokenProtector(t *testing.T) {
+	defer resetOptions()
+	defer setDefaultDialer(defaultDialer())
+	setDefaultDialer(&protectedDialer{protector: failingProtector{}, resolver: lookupDefault})
+	checks := runSelfTest(t)
+	if checks["protect"].Passed || checks["protect"].Error == "" {
+		t.Fatalf("broken protector not reported: %+v", checks["protect"])
+	}
+	if !checks["socket"].Passed {
+		t.Fatalf("socket check failed: %+v", checks["socket"])
+	}
+}
+
+func TestSelfTestSocketFailure(t *testing.T) {
+	defer resetOptions()
+	dialSocket = func(domain int, typ int, proto int) (int, error) {
+		return -1, unix.EMFILE
+	}
+	defer func() {
+		dialSocket = unix.Socket
+	}()
+	if check := runSelfTest(t)["socket"]; check.Passed || check.Error != unix.EMFILE.Error() {
+		t.Fatalf("socket failure not reported: %+v", check)
+	}
+}
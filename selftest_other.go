@@ -0,0 +1,9 @@
+//go:build !linux && !android
+
+package libcore
+
+import "context"
+
+func selfTestSocket(ctx context.Context) error {
+	return errUnsupportedPlatform
+}
@@ -0,0 +1,584 @@
+//go:build linux || android
+
+package libcore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/transport/internet"
+	"golang.org/x/sys/unix"
+)
+
+// dialLoopback dials a loopback listener of network with the default dialer.
+func dialLoopback(t *testing.T, network v2rayNet.Network) net.Conn {
+	loopback := v2rayNet.IPAddress(net.IPv4(127, 0, 0, 1))
+	var destination v2rayNet.Destination
+	if network == v2rayNet.Network_UDP {
+		listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			listener.Close()
+		})
+		destination = v2rayNet.UDPDestination(loopback, v2rayNet.Port(listener.LocalAddr().(*net.UDPAddr).Port))
+	} else {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			listener.Close()
+		})
+		destination = v2rayNet.TCPDestination(loopback, v2rayNet.Port(listener.Addr().(*net.TCPAddr).Port))
+	}
+	conn, err := defaultDialer().Dial(context.Background(), nil, destination, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return conn
+}
+
+// rawConn returns the syscall.RawConn of a conn returned by the protected dialer.
+func rawConn(t *testing.T, conn interface{}) syscall.RawConn {
+	for {
+		switch c := conn.(type) {
+		case *dialerConn:
+			conn = c.Conn
+		case *internet.PacketConnWrapper:
+			conn = c.Conn
+		case *dialerPacketConn:
+			conn = c.PacketConn
+		case syscall.Conn:
+			raw, err := c.SyscallConn()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return raw
+		default:
+			t.Fatalf("no fd in %T", conn)
+		}
+	}
+}
+
+// sockoptInt reads an integer socket option of the fd of conn.
+func sockoptInt(t *testing.T, conn net.Conn, level int, name int) int {
+	t.Helper()
+	var value int
+	var err error
+	if controlErr := rawConn(t, conn).Control(func(fd uintptr) {
+		value, err = unix.GetsockoptInt(int(fd), level, name)
+	}); controlErr != nil {
+		t.Fatal(controlErr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestSocketMark(t *testing.T) {
+	defer resetOptions()
+	for _, network := range []v2rayNet.Network{v2rayNet.Network_TCP, v2rayNet.Network_UDP} {
+		SetSocketMark(0)
+		if mark := sockoptInt(t, dialLoopback(t, network), unix.SOL_SOCKET, unix.SO_MARK); mark != 0 {
+			t.Fatal(network, ": unexpected mark ", mark)
+		}
+		SetSocketMark(0x2333)
+		conn := dialLoopback(t, network)
+		if mark := sockoptInt(t, conn, unix.SOL_SOCKET, unix.SO_MARK); mark != 0x2333 {
+			// setting a mark needs CAP_NET_ADMIN, without it the dial only warns
+			if unix.Geteuid() != 0 {
+				t.Skip("no permission to set socket marks")
+			}
+			t.Fatal(network, ": unexpected mark ", mark)
+		}
+	}
+}
+
+// SO_BINDTOIFINDEX from asm-generic/socket.h, missing in x/sys/unix. Reading the bound
+// interface by index avoids GetsockoptString failing on unbound sockets.
+const soBindToIfindex = 62
+
+func TestBindInterface(t *testing.T) {
+	defer resetOptions()
+	loopback, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, network := range []v2rayNet.Network{v2rayNet.Network_TCP, v2rayNet.Network_UDP} {
+		SetBindInterface("")
+		if index := sockoptInt(t, dialLoopback(t, network), unix.SOL_SOCKET, soBindToIfindex); index != 0 {
+			t.Fatal(network, ": bound to interface ", index, " without a name set")
+		}
+		SetBindInterface("lo")
+		if index := sockoptInt(t, dialLoopback(t, network), unix.SOL_SOCKET, soBindToIfindex); index != loopback.Index {
+			t.Fatal(network, ": bound to interface ", index, ", expected ", loopback.Index)
+		}
+	}
+
+	SetBindInterface("libcore0")
+	destination := v2rayNet.TCPDestination(v2rayNet.IPAddress(net.IPv4(127, 0, 0, 1)), 1)
+	conn, err := defaultDialer().Dial(context.Background(), nil, destination, nil)
+	if err == nil {
+		conn.Close()
+		t.Fatal("dialed through a missing interface")
+	}
+	if !strings.Contains(err.Error(), "libcore0") || !errors.Is(err, unix.ENODEV) {
+		t.Fatal("unexpected error: ", err)
+	}
+}
+
+func TestTcpKeepAlive(t *testing.T) {
+	defer resetOptions()
+	defaults := dialLoopback(t, v2rayNet.Network_TCP)
+
+	SetTcpKeepAlive(30, 10, 5)
+	conn := dialLoopback(t, v2rayNet.Network_TCP)
+	for _, option := range []struct {
+		level, name, value int
+	}{
+		{unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1},
+		{unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, 30},
+		{unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, 10},
+		{unix.IPPROTO_TCP, unix.TCP_KEEPCNT, 5},
+	} {
+		if value := sockoptInt(t, conn, option.level, option.name); value != option.value {
+			t.Fatal("option ", option.name, " is ", value, ", expected ", option.value)
+		}
+	}
+
+	// zero values leave the defaults
+	SetTcpKeepAlive(30, 0, 0)
+	conn = dialLoopback(t, v2rayNet.Network_TCP)
+	if value := sockoptInt(t, conn, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE); value != 30 {
+		t.Fatal("keepalive idle ", value)
+	}
+	for _, name := range []int{unix.TCP_KEEPINTVL, unix.TCP_KEEPCNT} {
+		if value, expected := sockoptInt(t, conn, unix.IPPROTO_TCP, name), sockoptInt(t, defaults, unix.IPPROTO_TCP, name); value != expected {
+			t.Fatal("option ", name, " is ", value, ", expected the default ", expected)
+		}
+	}
+
+	// the options are TCP only
+	SetTcpKeepAlive(30, 10, 5)
+	if keepAlive := sockoptInt(t, dialLoopback(t, v2rayNet.Network_UDP), unix.SOL_SOCKET, unix.SO_KEEPALIVE); keepAlive != 0 {
+		t.Fatal("keepalive enabled on a udp socket")
+	}
+}
+
+func TestTcpNoDelay(t *testing.T) {
+	defer resetOptions()
+	// read at dial time, a change applies to the next dial
+	for _, enabled := range []bool{true, false, true} {
+		SetTcpNoDelay(enabled)
+		noDelay := sockoptInt(t, dialLoopback(t, v2rayNet.Network_TCP), unix.IPPROTO_TCP, unix.TCP_NODELAY)
+		if (noDelay != 0) != enabled {
+			t.Fatal("TCP_NODELAY ", noDelay, " with no delay ", enabled)
+		}
+	}
+	// udp sockets have no TCP_NODELAY, their dials ignore it
+	SetTcpNoDelay(false)
+	dialLoopback(t, v2rayNet.Network_UDP)
+}
+
+func TestSocketBuffers(t *testing.T) {
+	defer resetOptions()
+	for _, network := range []v2rayNet.Network{v2rayNet.Network_TCP, v2rayNet.Network_UDP} {
+		SetSocketBuffers(0, 0)
+		defaults := dialLoopback(t, network)
+		defaultSend := sockoptInt(t, defaults, unix.SOL_SOCKET, unix.SO_SNDBUF)
+		defaultReceive := sockoptInt(t, defaults, unix.SOL_SOCKET, unix.SO_RCVBUF)
+		SetSocketBuffers(48<<10, 0)
+		conn := dialLoopback(t, network)
+		// the kernel doubles the sizes, they are not asserted exactly
+		if size := sockoptInt(t, conn, unix.SOL_SOCKET, unix.SO_SNDBUF); size < 48<<10 {
+			t.Fatal(network, ": send buffer of ", size)
+		}
+		if size := sockoptInt(t, conn, unix.SOL_SOCKET, unix.SO_RCVBUF); size != defaultReceive {
+			t.Fatal(network, ": receive buffer of ", size, " changed from ", defaultReceive)
+		}
+		SetSocketBuffers(0, 40<<10)
+		conn = dialLoopback(t, network)
+		if size := sockoptInt(t, conn, unix.SOL_SOCKET, unix.SO_SNDBUF); size != defaultSend {
+			t.Fatal(network, ": send buffer of ", size, " changed from ", defaultSend)
+		}
+		if size := sockoptInt(t, conn, unix.SOL_SOCKET, unix.SO_RCVBUF); size < 40<<10 {
+			t.Fatal(network, ": receive buffer of ", size)
+		}
+	}
+}
+
+func TestSocketBuffersClamped(t *testing.T) {
+	defer resetOptions()
+	hook := useLogHook(t)
+	SetLogLevel(int32(logrus.WarnLevel))
+	// beyond net.core.wmem_max and rmem_max
+	SetSocketBuffers(1<<30, 1<<30)
+	dialLoopback(t, v2rayNet.Network_TCP)
+	var warnings int
+	for _, entry := range hook.entries {
+		if strings.Contains(entry, "clamped") {
+			warnings++
+		}
+	}
+	if warnings != 2 {
+		t.Fatal("unexpected warnings ", hook.entries)
+	}
+}
+
+func TestDSCP(t *testing.T) {
+	defer resetOptions()
+	for _, value := range []int32{-1, 64} {
+		if err := SetDSCP(value); err == nil {
+			t.Fatal("accepted dscp ", value)
+		}
+	}
+	if err := SetDSCP(46); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetDSCP(64); err == nil || atomic.LoadInt32(&dscp) != 46 {
+		t.Fatal("invalid dscp replaced the previous one")
+	}
+
+	conn := dialLoopback(t, v2rayNet.Network_TCP)
+	if tos := sockoptInt(t, conn, unix.IPPROTO_IP, unix.IP_TOS); tos != 46<<2 {
+		t.Fatal("IP_TOS ", tos)
+	}
+
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer listener.Close()
+	destination := v2rayNet.TCPDestination(v2rayNet.IPAddress(net.IPv6loopback), v2rayNet.Port(listener.Addr().(*net.TCPAddr).Port))
+	conn, err = defaultDialer().Dial(context.Background(), nil, destination, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if class := sockoptInt(t, conn, unix.IPPROTO_IPV6, unix.IPV6_TCLASS); class != 46<<2 {
+		t.Fatal("IPV6_TCLASS ", class)
+	}
+}
+
+func TestDialSource(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	packetListener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packetListener.Close()
+	loopback := v2rayNet.IPAddress(net.IPv4(127, 0, 0, 1))
+	for _, destination := range []v2rayNet.Destination{
+		v2rayNet.TCPDestination(loopback, v2rayNet.Port(listener.Addr().(*net.TCPAddr).Port)),
+		v2rayNet.UDPDestination(loopback, v2rayNet.Port(packetListener.LocalAddr().(*net.UDPAddr).Port)),
+	} {
+		for source, local := range map[string]string{
+			// an alias of the loopback
+			"127.0.0.2": "127.0.0.2",
+			// of another family, ignored
+			"::1":     "127.0.0.1",
+			"0.0.0.0": "127.0.0.1",
+		} {
+			conn, err := defaultDialer().Dial(context.Background(), v2rayNet.ParseAddress(source), destination, nil)
+			if err != nil {
+				t.Fatal(destination, " from ", source, ": ", err)
+			}
+			host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+			conn.Close()
+			if host != local {
+				t.Fatal(destination, " from ", source, ": local address ", conn.LocalAddr())
+			}
+		}
+	}
+}
+
+// listenMultipathTCP listens on the loopback with an MPTCP socket.
+func listenMultipathTCP(t *testing.T) net.Listener {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, unix.IPPROTO_MPTCP)
+	if err != nil {
+		t.Skip("mptcp is not supported: ", err)
+	}
+	err = unix.Bind(fd, &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}})
+	if err == nil {
+		err = unix.Listen(fd, 16)
+	}
+	if err != nil {
+		unix.Close(fd)
+		t.Fatal(err)
+	}
+	file := os.NewFile(uintptr(fd), "mptcp")
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return listener
+}
+
+func TestMultipathTCP(t *testing.T) {
+	defer resetOptions()
+	listener := listenMultipathTCP(t)
+	destination := v2rayNet.TCPDestination(v2rayNet.IPAddress(net.IPv4(127, 0, 0, 1)), v2rayNet.Port(listener.Addr().(*net.TCPAddr).Port))
+	dial := func() {
+		t.Helper()
+		conn, err := defaultDialer().Dial(context.Background(), nil, destination, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	SetMultipathTCP(true)
+	dial()
+	if !LastDialUsedMPTCP() {
+		t.Fatal("mptcp not negotiated with an mptcp listener")
+	}
+	SetMultipathTCP(false)
+	dial()
+	if LastDialUsedMPTCP() {
+		t.Fatal("mptcp used while disabled")
+	}
+	// an mptcp socket falls back to tcp with a plain listener
+	SetMultipathTCP(true)
+	dialLoopback(t, v2rayNet.Network_TCP)
+	if LastDialUsedMPTCP() {
+		t.Fatal("mptcp reported with a tcp listener")
+	}
+}
+
+func TestMultipathTCPUnsupported(t *testing.T) {
+	defer resetOptions()
+	defer func() {
+		dialSocket = unix.Socket
+	}()
+	for _, unsupported := range []unix.Errno{unix.EPROTONOSUPPORT, unix.ENOPROTOOPT} {
+		var protocols []int
+		dialSocket = func(domain int, typ int, proto int) (int, error) {
+			protocols = append(protocols, proto)
+			if proto == unix.IPPROTO_MPTCP {
+				return -1, unsupported
+			}
+			return unix.Socket(domain, typ, proto)
+		}
+		SetMultipathTCP(true)
+		dialLoopback(t, v2rayNet.Network_TCP)
+		if len(protocols) != 2 || protocols[0] != unix.IPPROTO_MPTCP || protocols[1] != unix.IPPROTO_TCP {
+			t.Fatal(unsupported, ": unexpected protocols ", protocols)
+		}
+		if LastDialUsedMPTCP() {
+			t.Fatal("mptcp reported after the fallback")
+		}
+	}
+	// other failures are not retried with tcp
+	dialSocket = func(domain int, typ int, proto int) (int, error) {
+		return -1, unix.EACCES
+	}
+	destination := v2rayNet.TCPDestination(v2rayNet.IPAddress(net.IPv4(127, 0, 0, 1)), 1)
+	if _, err := defaultDialer().Dial(context.Background(), nil, destination, nil); !errors.Is(err, unix.EACCES) {
+		t.Fatal("unexpected error: ", err)
+	}
+}
+
+func TestTCPFastOpen(t *testing.T) {
+	defer resetOptions()
+	for _, enabled := range []bool{false, true} {
+		SetTCPFastOpen(enabled)
+		conn := dialLoopback(t, v2rayNet.Network_TCP)
+		if fastOpen := sockoptInt(t, conn, unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT); (fastOpen != 0) != enabled {
+			t.Fatal("TCP_FASTOPEN_CONNECT ", fastOpen, " with fast open ", enabled)
+		}
+	}
+
+	// the deferred handshake carries the first write
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	destination := v2rayNet.TCPDestination(v2rayNet.IPAddress(net.IPv4(127, 0, 0, 1)), v2rayNet.Port(listener.Addr().(*net.TCPAddr).Port))
+	conn, err := defaultDialer().Dial(context.Background(), nil, destination, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("fast")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 4)
+	if _, err = io.ReadFull(conn, reply); err != nil || string(reply) != "fast" {
+		t.Fatalf("read %q: %v", reply, err)
+	}
+
+	// udp dials are not affected
+	dialLoopback(t, v2rayNet.Network_UDP)
+}
+
+func TestSocketCloseOnExec(t *testing.T) {
+	for _, test := range []struct {
+		network v2rayNet.Network
+		ipv6    bool
+		mptcp   bool
+	}{
+		{v2rayNet.Network_TCP, false, false},
+		{v2rayNet.Network_TCP, true, false},
+		{v2rayNet.Network_TCP, false, true},
+		{v2rayNet.Network_UDP, false, false},
+		{v2rayNet.Network_UDP, true, false},
+		{v2rayNet.Network_UNIX, false, false},
+	} {
+		fd, err := getFd(test.network, test.ipv6, test.mptcp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+		unix.Close(fd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if flags&unix.FD_CLOEXEC == 0 {
+			t.Fatal(test.network, " socket (ipv6 ", test.ipv6, ", mptcp ", test.mptcp, ") created without FD_CLOEXEC")
+		}
+	}
+
+	// the sockets are still usable by net.FileConn
+	conn := dialLoopback(t, v2rayNet.Network_TCP)
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStrictSockopt(t *testing.T) {
+	defer resetOptions()
+	hook := useLogHook(t)
+	SetLogLevel(int32(logrus.WarnLevel))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	destination := v2rayNet.TCPDestination(v2rayNet.LocalHostIP, v2rayNet.Port(listener.Addr().(*net.TCPAddr).Port))
+	// binding to a missing device fails to apply
+	sockopt := &internet.SocketConfig{BindToDevice: "libcore0"}
+
+	// lenient by default, the failure is only logged
+	conn, err := defaultDialer().Dial(context.Background(), nil, destination, sockopt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if len(hook.entries) != 1 || !strings.Contains(hook.entries[0], "failed to apply socket options") {
+		t.Fatal("unexpected warnings ", hook.entries)
+	}
+
+	SetStrictSockopt(true)
+	before := openFDs()
+	conn, err = defaultDialer().Dial(context.Background(), nil, destination, sockopt)
+	if err == nil {
+		conn.Close()
+		t.Fatal("dialed with socket options failing to apply")
+	}
+	if !strings.Contains(err.Error(), "failed to apply socket options") || !errors.Is(err, unix.ENODEV) {
+		t.Fatal("unexpected error: ", err)
+	}
+	if after := openFDs(); after != before {
+		t.Fatal(after, " fds after the failed dial, ", before, " before")
+	}
+	// options applying fine are not affected
+	conn, err = defaultDialer().Dial(context.Background(), nil, destination, &internet.SocketConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestUDPReadBuffer(t *testing.T) {
+	defer resetOptions()
+	defaultTCP := sockoptInt(t, dialLoopback(t, v2rayNet.Network_TCP), unix.SOL_SOCKET, unix.SO_RCVBUF)
+	defaultUDP := sockoptInt(t, dialLoopback(t, v2rayNet.Network_UDP), unix.SOL_SOCKET, unix.SO_RCVBUF)
+	// a size distinct from both defaults once doubled by the kernel
+	size := int32(defaultTCP + defaultUDP)
+	SetUDPReadBuffer(size)
+	if received := sockoptInt(t, dialLoopback(t, v2rayNet.Network_UDP), unix.SOL_SOCKET, unix.SO_RCVBUF); received < int(size) {
+		t.Fatal("udp receive buffer of ", received, ", requested ", size)
+	}
+	if received := sockoptInt(t, dialLoopback(t, v2rayNet.Network_TCP), unix.SOL_SOCKET, unix.SO_RCVBUF); received != defaultTCP {
+		t.Fatal("tcp receive buffer of ", received, " changed from ", defaultTCP)
+	}
+	// over the general receive buffer
+	SetSocketBuffers(0, 8<<10)
+	if received := sockoptInt(t, dialLoopback(t, v2rayNet.Network_UDP), unix.SOL_SOCKET, unix.SO_RCVBUF); received < int(size) {
+		t.Fatal("udp receive buffer of ", received, " with a general receive buffer")
+	}
+
+	// and the protected udp listener
+	listener, err := ListenProtectedUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var received int
+	if controlErr := rawConn(t, listener.conn).Control(func(fd uintptr) {
+		received, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF)
+	}); controlErr != nil || err != nil {
+		t.Fatal(controlErr, err)
+	}
+	if received < int(size) {
+		t.Fatal("listener receive buffer of ", received, ", requested ", size)
+	}
+}
@@ -0,0 +1,153 @@
+package libcore
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Dreamacro/clash/transport/socks5"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+)
+
+var socksUDP uint32
+
+// SetSocksUDP makes protected UDP dials egress through the SOCKS5 proxy of SetUpstreamSocks
+// with UDP ASSOCIATE, falling back to direct UDP if the proxy cannot relay them. Domains are
+// resolved before relaying so that the dial filter applies to them.
+func SetSocksUDP(enabled bool) {
+	storeBool(&socksUDP, enabled)
+}
+
+// dialSocksUDP associates a UDP relay for destination with the SOCKS5 proxy at socksAddress.
+func (dialer protectedDialer) dialSocksUDP(ctx context.Context, socksAddress string, destination v2rayNet.Destination) (net.Conn, error) {
+	target := socks5.ParseAddr(destination.NetAddr())
+	if target == nil {
+		return nil, newError("invalid socks target ", destination.NetAddr())
+	}
+	proxy, err := v2rayNet.ParseDestination("tcp:" + socksAddress)
+	if err != nil {
+		return nil, err
+	}
+	// the connections to the proxy itself are direct
+	dialer.direct = true
+	control, err := dialer.Dial(ctx, nil, proxy, nil)
+	if err != nil {
+		return nil, &socksError{err}
+	}
+	stop := watchDeadline(ctx, control)
+	bindAddr, err := socksHandshake(control, socks5.ParseAddr("0.0.0.0:0"), socks5.CmdUDPAssociate)
+	stop()
+	if err != nil {
+		control.Close()
+		return nil, &socksError{newError("socks udp associate failed").Base(err)}
+	}
+	_ = control.SetDeadline(time.Time{})
+	relayAddr := bindAddr.UDPAddr()
+	if relayAddr == nil {
+		control.Close()
+		return nil, &socksError{newError("invalid socks relay address ", bindAddr.String())}
+	}
+	if relayAddr.IP.IsUnspecified() {
+		relayAddr.IP = proxy.Address.IP()
+	}
+	relay, err := dialer.Dial(ctx, nil, v2rayNet.UDPDestination(v2rayNet.IPAddress(relayAddr.IP), v2rayNet.Port(relayAddr.Port)), nil)
+	if err != nil {
+		control.Close()
+		return nil, &socksError{err}
+	}
+	conn := &socksPacketConn{Conn: relay, control: control, target: target}
+	go conn.watchControl()
+	return conn, nil
+}
+
+// socksHandshake runs socks5.ClientHandshake for command, failing if the proxy replies with
+// an error code, which ClientHandshake ignores.
+func socksHandshake(conn net.Conn, addr socks5.Addr, command socks5.Command) (socks5.Addr, error) {
+	recorder := &socksReplyRecorder{ReadWriter: conn}
+	bindAddr, err := socks5.ClientHandshake(recorder, addr, command, nil)
+	if err != nil {
+		return nil, err
+	}
+	// ClientHandshake read at least the method selection reply followed by VER, REP, RSV
+	if code := recorder.read[3]; code != 0 {
+		return nil, newError("socks request rejected with code ", code)
+	}
+	return bindAddr, nil
+}
+
+// socksReplyRecorder keeps the first bytes read from a SOCKS5 proxy.
+type socksReplyRecorder struct {
+	io.ReadWriter
+	read []byte
+}
+
+func (r *socksReplyRecorder) Read(p []byte) (int, error) {
+	n, err := r.ReadWriter.Read(p)
+	if len(r.read) < 4 {
+		r.read = append(r.read, p[:n]...)
+	}
+	return n, err
+}
+
+// socksPacketConn relays datagrams to target through a SOCKS5 UDP association, which
+// lasts as long as its control connection.
+type socksPacketConn struct {
+	net.Conn
+	control net.Conn
+	target  socks5.Addr
+
+	readAccess sync.Mutex
+	buffer     []byte
+}
+
+// watchControl closes the relay once the proxy closes the control connection.
+func (c *socksPacketConn) watchControl() {
+	_, _ = io.Copy(io.Discard, c.control)
+	c.Conn.Close()
+}
+
+func (c *socksPacketConn) Read(p []byte) (int, error) {
+	c.readAccess.Lock()
+	defer c.readAccess.Unlock()
+	if c.buffer == nil {
+		c.buffer = make([]byte, 65535)
+	}
+	for {
+		n, err := c.Conn.Read(c.buffer)
+		if err != nil {
+			return 0, err
+		}
+		_, payload, err := socks5.DecodeUDPPacket(c.buffer[:n])
+		if err != nil {
+			// not a datagram of the association, or a fragment we do not reassemble
+			continue
+		}
+		return copy(p, payload), nil
+	}
+}
+
+func (c *socksPacketConn) Write(p []byte) (int, error) {
+	packet, err := socks5.EncodeUDPPacket(c.target, p)
+	if err != nil {
+		return 0, err
+	}
+	_, err = c.Conn.Write(packet)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *socksPacketConn) RemoteAddr() net.Addr {
+	if addr := c.target.UDPAddr(); addr != nil {
+		return addr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *socksPacketConn) Close() error {
+	c.control.Close()
+	return c.Conn.Close()
+}
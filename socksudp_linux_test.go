@@ -0,0 +1,171 @@
+//go:build linux || android
+
+package libcore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/Dreamacro/clash/transport/socks5"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+)
+
+// socksUDPRelay is a minimal SOCKS5 proxy answering UDP ASSOCIATE with reply, echoing the
+// datagrams relayed to it and reporting their targets.
+func socksUDPRelay(t *testing.T, reply byte) (address string, targets <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+		relay.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				greeting := make([]byte, 3)
+				if _, err := io.ReadFull(conn, greeting); err != nil {
+					return
+				}
+				conn.Write([]byte{5, 0})
+				// VER, CMD, RSV followed by the IPv4 address 0.0.0.0:0
+				request := make([]byte, 10)
+				if _, err := io.ReadFull(conn, request); err != nil || request[1] != byte(socks5.CmdUDPAssociate) {
+					return
+				}
+				bind := relay.LocalAddr().(*net.UDPAddr)
+				conn.Write([]byte{5, reply, 0, 1, 127, 0, 0, 1, byte(bind.Port >> 8), byte(bind.Port)})
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	seen := make(chan string, 16)
+	go func() {
+		buffer := make([]byte, 65535)
+		for {
+			n, from, err := relay.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			target, payload, err := socks5.DecodeUDPPacket(buffer[:n])
+			if err != nil {
+				continue
+			}
+			seen <- target.String()
+			packet, _ := socks5.EncodeUDPPacket(target, payload)
+			relay.WriteTo(packet, from)
+		}
+	}()
+	return listener.Addr().String(), seen
+}
+
+func useSocksUDP(t *testing.T, address string) {
+	t.Cleanup(resetOptions)
+	host, port, _ := net.SplitHostPort(address)
+	portNumber, _ := strconv.Atoi(port)
+	if err := SetUpstreamSocks(host, int32(portNumber)); err != nil {
+		t.Fatal(err)
+	}
+	SetSocksUDP(true)
+}
+
+// socksTestDialer resolves every domain to 192.0.2.10.
+var socksTestDialer = protectedDialer{
+	protector: noopProtectorInstance,
+	resolver: func(ctx context.Context, domain string) ([]net.IP, error) {
+		return []net.IP{net.IPv4(192, 0, 2, 10)}, nil
+	},
+}
+
+func TestSocksUDPRelay(t *testing.T) {
+	address, targets := socksUDPRelay(t, 0)
+	useSocksUDP(t, address)
+
+	destination := v2rayNet.UDPDestination(v2rayNet.DomainAddress("relay.test"), 53)
+	conn, err := socksTestDialer.Dial(context.Background(), nil, destination, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	socksConn, ok := conn.(*socksPacketConn)
+	if !ok {
+		t.Fatalf("dial returned %T", conn)
+	}
+	var buffer *byte
+	for _, message := range []string{"first", "second"} {
+		if _, err = conn.Write([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+		reply := make([]byte, 64)
+		n, err := conn.Read(reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(reply[:n]) != message {
+			t.Fatalf("read %q, expected %q", reply[:n], message)
+		}
+		// the domain is resolved before relaying
+		if target := <-targets; target != "192.0.2.10:53" {
+			t.Fatal("relayed to ", target)
+		}
+		if buffer != nil && buffer != &socksConn.buffer[0] {
+			t.Fatal("read buffer not reused")
+		}
+		buffer = &socksConn.buffer[0]
+	}
+}
+
+func TestSocksUDPDialFilter(t *testing.T) {
+	address, targets := socksUDPRelay(t, 0)
+	useSocksUDP(t, address)
+	if err := SetDialFilter(`[{"action": "deny", "cidr": "192.0.2.0/24"}]`); err != nil {
+		t.Fatal(err)
+	}
+	for _, destination := range []v2rayNet.Destination{
+		v2rayNet.UDPDestination(v2rayNet.DomainAddress("relay.test"), 53),
+		v2rayNet.UDPDestination(v2rayNet.IPAddress(net.IPv4(192, 0, 2, 10)), 53),
+	} {
+		conn, err := socksTestDialer.Dial(context.Background(), nil, destination, nil)
+		if err == nil {
+			conn.Close()
+		}
+		if !errors.Is(err, ErrBlocked) {
+			t.Fatal("dial of ", destination, " not blocked: ", err)
+		}
+	}
+	select {
+	case target := <-targets:
+		t.Fatal("relayed to ", target)
+	default:
+	}
+}
+
+func TestSocksUDPFallsBackToDirect(t *testing.T) {
+	// REP 7: command not supported
+	address, _ := socksUDPRelay(t, 7)
+	useSocksUDP(t, address)
+
+	destination := v2rayNet.UDPDestination(v2rayNet.IPAddress(net.IPv4(127, 0, 0, 1)), 53)
+	conn, err := socksTestDialer.Dial(context.Background(), nil, destination, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*socksPacketConn); ok {
+		t.Fatal("udp relayed through a proxy refusing to associate")
+	}
+}
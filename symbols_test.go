@@ -0,0 +1,50 @@
+package libcore
+
+import (
+	"runtime"
+	"testing"
+)
+
+// The exported API is the same on every platform, only working on Linux.
+var (
+	_ func(string, string, int32) (*Conn, error)                   = DialProtected
+	_ func(int32, string) (*Conn, error)                           = AdoptFd
+	_ func(string) (*PacketConn, error)                            = ListenProtectedUDP
+	_ func(string, int32) (int32, error)                           = IcmpPing
+	_ func(string, int32) (int32, error)                           = Icmp6Ping
+	_ func(string, string, int32) (int32, error)                   = IcmpPingFrom
+	_ func(string, int32, int32) (*PingResult, error)              = Ping
+	_ func(string, int32, int32, int32) (*PingStats, error)        = IcmpPingEx
+	_ func(string, int32, PingHandler) (*PingSession, error)       = StartPing
+	_ func(string, int32, int32) (int32, error)                    = TcpPing
+	_ func(string, int32, int32, bool, TracerouteHandler) error    = Traceroute
+	_ func(int32) error                                            = SetFdSoftLimit
+	_ func(string)                                                 = SetBindInterface
+	_ func(Protector, Resolver) *ProtectedDialer                   = NewProtectedDialer
+	_ func(*ProtectedDialer, string, string, int32) (*Conn, error) = (*ProtectedDialer).DialConn
+	_ func(Protector, Resolver)                                    = RegisterDialer
+	_ func(*TunConfig) (*Tun2ray, error)                           = NewTun2ray
+	_ func(*Tun2ray)                                               = (*Tun2ray).Close
+	_ func(*Tun2ray) bool                                          = (*Tun2ray).GetTrafficStatsEnabled
+	_ func(*Tun2ray)                                               = (*Tun2ray).ResetAppTraffics
+	_ func(*Tun2ray, int32)                                        = (*Tun2ray).CloseConnections
+	_ func(*Tun2ray, TrafficListener) error                        = (*Tun2ray).ReadAppTraffics
+	_ func(*RecordingProtector, int32) bool                        = (*RecordingProtector).Protect
+	_ func(*Conn, []byte) (int32, error)                           = (*Conn).Read
+	_ func(*PacketConn, []byte, string) (int32, error)             = (*PacketConn).WriteTo
+)
+
+func TestUnsupportedPlatform(t *testing.T) {
+	if runtime.GOOS == "linux" || runtime.GOOS == "android" {
+		t.Skip("sockets are supported on ", runtime.GOOS)
+	}
+	if _, err := DialProtected("tcp", "127.0.0.1:80", 1000); err == nil {
+		t.Fatal("dial succeeded")
+	}
+	if _, err := ListenProtectedUDP("127.0.0.1:0"); err == nil {
+		t.Fatal("listen succeeded")
+	}
+	if !NoopProtector().Protect(0) {
+		t.Fatal("noop protector failed")
+	}
+}
@@ -0,0 +1,101 @@
+package libcore
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/features/dns"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// systemDNSAttemptTimeout is how long a system DNS server is waited for before
+// failing over to the next one.
+const systemDNSAttemptTimeout = 2 * time.Second
+
+var (
+	systemDNSAccess  sync.Mutex
+	systemDNSServers []v2rayNet.Destination
+	// systemDNSPreferred is the index of the server that answered last, tried first.
+	systemDNSPreferred uint32
+)
+
+// SetSystemDNS sets the comma separated DNS servers of the underlying network, as IP or
+// IP:port, typically from the LinkProperties of ConnectivityManager. They are used by
+// the resolvers of NewSystemResolver.
+func SetSystemDNS(servers string) error {
+	destinations, err := parseDNSServers(servers)
+	if err != nil {
+		return err
+	}
+	systemDNSAccess.Lock()
+	systemDNSServers = destinations
+	systemDNSAccess.Unlock()
+	atomic.StoreUint32(&systemDNSPreferred, 0)
+	return nil
+}
+
+// systemResolver queries the servers of SetSystemDNS as plain DNS through the
+// protected dialer, failing over to the next server on errors.
+type systemResolver struct{}
+
+// NewSystemResolver creates a resolver querying the DNS servers set with SetSystemDNS,
+// following later changes of them.
+func NewSystemResolver() Resolver {
+	return systemResolver{}
+}
+
+func (r systemResolver) LookupIP(network string, domain string) ([]byte, error) {
+	ctx, cancel := withTimeout(context.Background(), loadDuration(&resolveTimeout))
+	defer cancel()
+	ips, err := r.lookupIP(ctx, network, domain)
+	if err != nil {
+		return nil, err
+	}
+	return encodeIPs(ips), nil
+}
+
+func (r systemResolver) lookupIP(ctx context.Context, network string, domain string) ([]net.IP, error) {
+	ips, _, err := r.lookupIPTTL(ctx, network, domain)
+	return ips, err
+}
+
+func (r systemResolver) lookupIPTTL(ctx context.Context, network string, domain string) ([]net.IP, time.Duration, error) {
+	systemDNSAccess.Lock()
+	servers := systemDNSServers
+	systemDNSAccess.Unlock()
+	if len(servers) == 0 {
+		return nil, 0, newError("no system dns servers")
+	}
+	preferred := int(atomic.LoadUint32(&systemDNSPreferred)) % len(servers)
+	var lastErr error
+	for i := range servers {
+		index := (preferred + i) % len(servers)
+		ips, ttl, err := r.lookupServer(ctx, servers[index], network, domain)
+		if err == nil {
+			atomic.StoreUint32(&systemDNSPreferred, uint32(index))
+			return ips, ttl, nil
+		}
+		if ctx.Err() != nil {
+			return nil, 0, err
+		}
+		// a missing domain would be missing on the other servers too
+		if errors.Is(err, dns.ErrEmptyResponse) || err == dns.RCodeError(dnsmessage.RCodeNameError) {
+			return nil, 0, err
+		}
+		lastErr = err
+	}
+	return nil, 0, lastErr
+}
+
+func (r systemResolver) lookupServer(ctx context.Context, server v2rayNet.Destination, network string, domain string) ([]net.IP, time.Duration, error) {
+	ctx, cancel := withTimeout(ctx, systemDNSAttemptTimeout)
+	defer cancel()
+	return lookupWire(ctx, network, domain, func(ctx context.Context, query []byte) ([]byte, error) {
+		return exchangePlain(ctx, server, query)
+	})
+}
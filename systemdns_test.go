@@ -0,0 +1,73 @@
+package libcore
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSystemResolverFailover(t *testing.T) {
+	defer resetOptions()
+	// the first server never answers
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	var silentQueries int32
+	go func() {
+		buffer := make([]byte, 512)
+		for {
+			if _, _, err := silent.ReadFrom(buffer); err != nil {
+				return
+			}
+			atomic.AddInt32(&silentQueries, 1)
+		}
+	}()
+	server := newBootstrapServer(t, net.IPv4(192, 0, 2, 1))
+	if err = SetSystemDNS(silent.LocalAddr().String() + "," + server.address); err != nil {
+		t.Fatal(err)
+	}
+	fake := useFakeClock(t)
+	resolver := NewSystemResolver()
+
+	type lookupResult struct {
+		ips []net.IP
+		err error
+	}
+	result := make(chan lookupResult, 1)
+	go func() {
+		encoded, err := resolver.LookupIP("ip4", "system.test")
+		var ips []net.IP
+		if err == nil {
+			ips, err = decodeIPs(encoded)
+		}
+		result <- lookupResult{ips, err}
+	}()
+	// the timers of the resolve timeout and the attempt timeout
+	fake.WaitTimers(2)
+	fake.Advance(systemDNSAttemptTimeout)
+	r := <-result
+	if r.err != nil || len(r.ips) != 1 || !r.ips[0].Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Fatal("resolved ", r.ips, ": ", r.err)
+	}
+	if atomic.LoadInt32(&silentQueries) == 0 || atomic.LoadInt32(&server.queries) == 0 {
+		t.Fatal("both servers should have been queried")
+	}
+
+	// the server answering last is tried first
+	time.Sleep(20 * time.Millisecond)
+	silentBefore := atomic.LoadInt32(&silentQueries)
+	if _, err = resolver.LookupIP("ip4", "system.test"); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&silentQueries); n != silentBefore {
+		t.Fatal("silent server queried again")
+	}
+
+	_ = SetSystemDNS("")
+	if _, err = resolver.LookupIP("ip4", "system.test"); err == nil {
+		t.Fatal("resolved without servers")
+	}
+}
@@ -0,0 +1,36 @@
+package libcore
+
+import "time"
+
+type TracerouteHandler interface {
+	// OnHop is called for each probed hop, with an empty ip and a rtt of -1 if it did not reply.
+	OnHop(ttl int32, ip string, rtt int32)
+}
+
+// Traceroute probes the hops to address with increasing TTLs up to maxHops, waiting
+// timeout milliseconds for each, and reports them to handler. Probes are UDP datagrams
+// if udp is set or ICMP echo requests otherwise, sent outside the VPN.
+func Traceroute(address string, maxHops int32, timeout int32, udp bool, handler TracerouteHandler) error {
+	if maxHops <= 0 || maxHops > 255 {
+		return newError("invalid max hops ", maxHops)
+	}
+	ip, err := resolveHost(address)
+	if err != nil {
+		return err
+	}
+	for ttl := 1; ttl <= int(maxHops); ttl++ {
+		hop, rtt, reached, err := probeHop(ip, ttl, udp, time.Duration(timeout)*time.Millisecond)
+		if err != nil {
+			return err
+		}
+		if hop == nil {
+			handler.OnHop(int32(ttl), "", -1)
+		} else {
+			handler.OnHop(int32(ttl), hop.String(), int32(rtt.Milliseconds()))
+		}
+		if reached {
+			break
+		}
+	}
+	return nil
+}
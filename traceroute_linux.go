@@ -0,0 +1,175 @@
+//go:build linux || android
+
+package libcore
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	tracerouteBasePort = 33434
+	// sizeofSockExtendedErr is the size of struct sock_extended_err preceding the offender address.
+	sizeofSockExtendedErr = 16
+)
+
+// probeHop sends a probe with ttl to ip and returns the hop replying to it, which is nil on
+// timeout. The ICMP errors of unprivileged sockets are read from the socket error queue.
+func probeHop(ip net.IP, ttl int, udp bool, timeout time.Duration) (hop net.IP, rtt time.Duration, reached bool, err error) {
+	v6 := ip.To4() == nil
+	af, proto := unix.AF_INET, unix.IPPROTO_ICMP
+	if v6 {
+		af, proto = unix.AF_INET6, unix.IPPROTO_ICMPV6
+	}
+	if udp {
+		proto = unix.IPPROTO_UDP
+	}
+	fd, err := unix.Socket(af, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, 0, false, newError("create probe socket").Base(err)
+	}
+	defer unix.Close(fd)
+	if !protect(rootContext(), defaultDialer().protector, fd) {
+		return nil, 0, false, errors.New("protect failed")
+	}
+	if !v6 {
+		err = unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TTL, ttl)
+		if err == nil {
+			err = unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_RECVERR, 1)
+		}
+	} else {
+		err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, ttl)
+		if err == nil {
+			err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_RECVERR, 1)
+		}
+	}
+	if err != nil {
+		return nil, 0, false, newError("set probe ttl").Base(err)
+	}
+
+	var port int
+	var payload []byte
+	if udp {
+		port = tracerouteBasePort + ttl
+		payload = []byte(pingPayload)
+	} else {
+		message := icmp.Message{
+			Type: ipv4.ICMPTypeEcho,
+			Body: &icmp.Echo{
+				ID:   0xDBB,
+				Seq:  ttl,
+				Data: []byte(pingPayload),
+			},
+		}
+		if v6 {
+			message.Type = ipv6.ICMPTypeEchoRequest
+		}
+		payload, err = message.Marshal(nil)
+		if err != nil {
+			return nil, 0, false, newError("make icmp message").Base(err)
+		}
+	}
+	var sockaddr unix.Sockaddr
+	if !v6 {
+		socketAddress := &unix.SockaddrInet4{Port: port}
+		copy(socketAddress.Addr[:], ip.To4())
+		sockaddr = socketAddress
+	} else {
+		socketAddress := &unix.SockaddrInet6{Port: port}
+		copy(socketAddress.Addr[:], ip)
+		sockaddr = socketAddress
+	}
+
+	start := clk.Now()
+	err = unix.Sendto(fd, payload, 0, sockaddr)
+	if err != nil {
+		return nil, 0, false, newError("send probe").Base(err)
+	}
+	deadline := start.Add(timeout)
+	buffer := make([]byte, 1500)
+	oob := make([]byte, 512)
+	pollFds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	for {
+		remaining := deadline.Sub(clk.Now())
+		if remaining <= 0 {
+			return nil, 0, false, nil
+		} else if remaining > 100*time.Millisecond {
+			remaining = 100 * time.Millisecond
+		}
+		n, err := unix.Poll(pollFds, int(remaining.Milliseconds())+1)
+		if err == unix.EINTR || err == nil && n == 0 {
+			continue
+		} else if err != nil {
+			return nil, 0, false, err
+		}
+		_, oobn, _, _, err := unix.Recvmsg(fd, buffer, oob, unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+		if err == nil {
+			if hop, reached, ok := parseProbeError(oob[:oobn]); ok {
+				return hop, clk.Now().Sub(start), reached, nil
+			}
+			continue
+		} else if err != unix.EAGAIN {
+			return nil, 0, false, newError("read probe error").Base(err)
+		}
+		n, _, err = unix.Recvfrom(fd, buffer, unix.MSG_DONTWAIT)
+		if err == unix.EAGAIN {
+			continue
+		} else if err != nil {
+			return nil, 0, false, newError("read probe reply").Base(err)
+		}
+		if udp {
+			return ip, clk.Now().Sub(start), true, nil
+		}
+		icmpProto := 1
+		if v6 {
+			icmpProto = 58
+		}
+		reply, err := icmp.ParseMessage(icmpProto, buffer[:n])
+		if err == nil && (reply.Type == ipv4.ICMPTypeEchoReply || reply.Type == ipv6.ICMPTypeEchoReply) {
+			return ip, clk.Now().Sub(start), true, nil
+		}
+	}
+}
+
+// parseProbeError parses the ICMP error queued on a socket with IP_RECVERR, returning
+// the address that sent it and whether it is from the destination.
+func parseProbeError(oob []byte) (hop net.IP, reached bool, ok bool) {
+	messages, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, false, false
+	}
+	for _, message := range messages {
+		isRecvErr := message.Header.Level == unix.SOL_IP && message.Header.Type == unix.IP_RECVERR ||
+			message.Header.Level == unix.SOL_IPV6 && message.Header.Type == unix.IPV6_RECVERR
+		if !isRecvErr || len(message.Data) < sizeofSockExtendedErr {
+			continue
+		}
+		origin, icmpType := message.Data[4], message.Data[5]
+		offender := message.Data[sizeofSockExtendedErr:]
+		switch origin {
+		case unix.SO_EE_ORIGIN_ICMP:
+			if len(offender) < unix.SizeofSockaddrInet4 {
+				continue
+			}
+			hop = net.IP(append([]byte(nil), offender[4:8]...))
+			// anything but time exceeded, such as port unreachable, ends the trace
+			reached = icmpType != byte(ipv4.ICMPTypeTimeExceeded)
+		case unix.SO_EE_ORIGIN_ICMP6:
+			if len(offender) < unix.SizeofSockaddrInet6 {
+				continue
+			}
+			hop = net.IP(append([]byte(nil), offender[8:24]...))
+			reached = icmpType != byte(ipv6.ICMPTypeTimeExceeded)
+		default:
+			continue
+		}
+		return hop, reached, true
+	}
+	return nil, false, false
+}
@@ -0,0 +1,62 @@
+//go:build linux || android
+
+package libcore
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+type tracerouteHop struct {
+	ttl int32
+	ip  string
+	rtt int32
+}
+
+type recordingTracerouteHandler struct {
+	hops []tracerouteHop
+}
+
+func (h *recordingTracerouteHandler) OnHop(ttl int32, ip string, rtt int32) {
+	h.hops = append(h.hops, tracerouteHop{ttl, ip, rtt})
+}
+
+func TestTraceroute(t *testing.T) {
+	defer setDefaultDialer(defaultDialer())
+	protector := NewRecordingProtector()
+	setDefaultDialer(&protectedDialer{protector: protector, resolver: lookupDefault})
+	for _, address := range []string{"127.0.0.1", "::1"} {
+		for _, udp := range []bool{true, false} {
+			handler := &recordingTracerouteHandler{}
+			protector.Reset()
+			if err := Traceroute(address, 5, 1000, udp, handler); err != nil {
+				if !udp && errors.Is(err, unix.EACCES) {
+					// unprivileged icmp sockets are not allowed by net.ipv4.ping_group_range
+					t.Log(address, ": ", err)
+					continue
+				}
+				t.Fatal(address, " (udp ", udp, "): ", err)
+			}
+			// the loopback is reached at the first hop
+			if len(handler.hops) != 1 {
+				t.Fatal(address, " (udp ", udp, "): unexpected hops ", handler.hops)
+			}
+			hop := handler.hops[0]
+			if hop.ttl != 1 || hop.ip != address || hop.rtt < 0 || hop.rtt > 1000 {
+				t.Fatal(address, " (udp ", udp, "): unexpected hop ", fmt.Sprintf("%+v", hop))
+			}
+			if protector.Count() != 1 {
+				t.Fatal(address, " (udp ", udp, "): ", protector.Count(), " probes protected")
+			}
+		}
+	}
+
+	for _, maxHops := range []int32{0, 256} {
+		if err := Traceroute("127.0.0.1", maxHops, 1000, true, &recordingTracerouteHandler{}); err == nil {
+			t.Fatal("accepted max hops ", maxHops)
+		}
+	}
+}
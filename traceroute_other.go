@@ -0,0 +1,12 @@
+//go:build !linux && !android
+
+package libcore
+
+import (
+	"net"
+	"time"
+)
+
+func probeHop(ip net.IP, ttl int, udp bool, timeout time.Duration) (hop net.IP, rtt time.Duration, reached bool, err error) {
+	return nil, 0, false, errUnsupportedPlatform
+}
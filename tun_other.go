@@ -0,0 +1,11 @@
+//go:build (!linux && !android) || !cgo
+
+package libcore
+
+// NewTun2ray fails since the tun device needs Linux and cgo.
+func NewTun2ray(config *TunConfig) (*Tun2ray, error) {
+	return nil, newError("tun needs Linux and cgo")
+}
+
+func (t *Tun2ray) Close() {
+}
@@ -80,3 +80,52 @@ func UrlTest(instance *V2RayInstance, inbound string, link string, timeout int32
 	}
 	return int32(time.Since(start).Milliseconds()), nil
 }
+
+// ProtectedUrlTest measures the time taken to request link in milliseconds,
+// connecting through the protected dialer instead of an outbound.
+func ProtectedUrlTest(link string, timeout int32) (int32, error) {
+	return protectedUrlTest(context.Background(), link, timeout)
+}
+
+func protectedUrlTest(ctx context.Context, link string, timeout int32) (int32, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSHandshakeTimeout: time.Duration(timeout) * time.Millisecond,
+			DisableKeepAlives:   true,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				dest, err := net.ParseDestination(fmt.Sprintf("%s:%s", network, addr))
+				if err != nil {
+					return nil, err
+				}
+				return defaultDialer().Dial(ctx, nil, dest, nil)
+			},
+		},
+		Timeout: time.Duration(timeout) * time.Millisecond,
+	}
+	userAgent := fmt.Sprintf("curl/7.%d.%d", rand.Int()%54, rand.Int()%2)
+	var (
+		elapsed time.Duration
+		resp    *http.Response
+	)
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		req, err := http.NewRequestWithContext(ctx, method, link, nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("User-Agent", userAgent)
+		start := time.Now()
+		resp, err = client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		elapsed = time.Since(start)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed && resp.StatusCode != http.StatusNotImplemented {
+			break
+		}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return 0, fmt.Errorf("unexpected response status: %d", resp.StatusCode)
+	}
+	return int32(elapsed.Milliseconds()), nil
+}
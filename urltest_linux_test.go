@@ -0,0 +1,69 @@
+//go:build linux || android
+
+package libcore
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProtectedUrlTest(t *testing.T) {
+	var access sync.Mutex
+	var methods []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		access.Lock()
+		methods = append(methods, r.Method)
+		access.Unlock()
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+			w.WriteHeader(http.StatusNoContent)
+		case "/get-only":
+			if r.Method != http.MethodGet {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	rtt, err := ProtectedUrlTest(server.URL+"/slow", 3000)
+	if err != nil || rtt < 100 || rtt > 3000 {
+		t.Fatal("unexpected result ", rtt, ", ", err)
+	}
+
+	methods = nil
+	if _, err = ProtectedUrlTest(server.URL+"/get-only", 3000); err != nil {
+		t.Fatal(err)
+	}
+	if len(methods) != 2 || methods[0] != http.MethodHead || methods[1] != http.MethodGet {
+		t.Fatal("unexpected requests ", methods)
+	}
+
+	if _, err = ProtectedUrlTest(server.URL+"/unavailable", 3000); err == nil {
+		t.Fatal("non-2xx status not reported")
+	}
+}
+
+func TestProtectedUrlTestCanceled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := protectedUrlTest(ctx, server.URL, 10000)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatal("unexpected error ", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatal("cancellation took ", elapsed)
+	}
+}
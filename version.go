@@ -0,0 +1,33 @@
+package libcore
+
+import (
+	"encoding/json"
+	"runtime"
+
+	"github.com/v2fly/v2ray-core/v5"
+)
+
+// buildRevision and buildTime are set by build.sh with -ldflags -X.
+var (
+	buildRevision = "unknown"
+	buildTime     = "unknown"
+)
+
+type versionInfo struct {
+	V2RayCore string `json:"v2rayCore"`
+	Go        string `json:"go"`
+	Revision  string `json:"revision"`
+	BuildTime string `json:"buildTime"`
+}
+
+// Version returns a JSON object describing the running build, with the versions of
+// v2ray-core and Go, and the git revision and time libcore was built at.
+func Version() string {
+	content, _ := json.Marshal(versionInfo{
+		V2RayCore: core.Version(),
+		Go:        runtime.Version(),
+		Revision:  buildRevision,
+		BuildTime: buildTime,
+	})
+	return string(content)
+}
@@ -0,0 +1,30 @@
+package libcore
+
+import (
+	"encoding/json"
+	"runtime"
+	"testing"
+
+	"github.com/v2fly/v2ray-core/v5"
+)
+
+func TestVersion(t *testing.T) {
+	var info map[string]string
+	if err := json.Unmarshal([]byte(Version()), &info); err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]string{
+		"v2rayCore": core.Version(),
+		"go":        runtime.Version(),
+		// without -ldflags -X
+		"revision":  "unknown",
+		"buildTime": "unknown",
+	} {
+		if value, found := info[key]; !found || value != expected {
+			t.Fatal(key, " is ", value, ", expected ", expected)
+		}
+	}
+	if len(info) != 4 {
+		t.Fatal("unexpected keys ", info)
+	}
+}